@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 手臂控制 - 黑臂动作序列（hlsup/hlsdown）与"抬臂 → 预姿态 → 演奏 → 释放 → 落臂"编排
+////////////////////////////////////////////////////////////////////////////////
+//
+// 配置：
+//   arms:        CAN接口 → 设备名（如 can2: left_black_arm）
+//   handsleft/handsright: 防撞预姿态（6个手指值，格式同 release_profile），抬臂后、演奏前下发给左右手
+//                （乐器配置了 posture.before/after 时改用姿态序列，释放阶段同样改为 after 姿态，见 posture.go）
+//   arm_routine: 动作序列目录与抬臂/落臂序列名；enabled 时Web演奏默认走完整流程（请求中 arms 可覆盖）
+// 动作序列文件 <sequences_dir>/<名称>.json：
+//   {"name":"hlsup","steps":[{"frames":[{"arm":"left_black_arm","id":"0x01","data":[1,2,3]}],"wait_ms":500}, ...]}
+//   arm 为设备名或CAN接口；同一步的帧同时发送，发送后等待 wait_ms 再执行下一步
+// 中断：抬臂、预姿态、演奏过程中停止或被替换时跳过剩余阶段，仍然释放手指并落臂（落臂不受停止影响）；
+// 急停时立即停止动作，之后不再移动（保持急停发出的释放状态）。
+
+// 编排阶段（演奏状态中的 arm_phase）
+const (
+	ArmPhaseUp      = "arm_up"
+	ArmPhasePosture = "posture"
+	ArmPhasePlay    = "play"
+	ArmPhaseRelease = "release"
+	ArmPhaseDown    = "arm_down"
+)
+
+const (
+	defaultArmSequencesDir = "arm_sequences"
+	defaultArmUpSequence   = "hlsup"
+	defaultArmDownSequence = "hlsdown"
+	defaultPostureHoldMS   = 300
+)
+
+// armSequenceNamePattern 动作序列名（也是文件名，不允许路径）
+var armSequenceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ArmConfig 单个手臂（arms 中以CAN接口为键）
+type ArmConfig struct {
+	DeviceName string `yaml:"device_name" json:"device_name"` // 设备名（动作序列中引用）
+}
+
+// ArmRoutineConfig 手臂编排配置
+type ArmRoutineConfig struct {
+	Enabled       bool   `yaml:"enabled" json:"enabled"`                 // Web演奏默认是否走完整流程
+	SequencesDir  string `yaml:"sequences_dir" json:"sequences_dir"`     // 动作序列目录（默认 arm_sequences）
+	Up            string `yaml:"up" json:"up"`                           // 抬臂序列名（默认 hlsup）
+	Down          string `yaml:"down" json:"down"`                       // 落臂序列名（默认 hlsdown）
+	PostureHoldMS int    `yaml:"posture_hold_ms" json:"posture_hold_ms"` // 预姿态下发后等待时间（默认300ms）
+}
+
+// effective 填入默认值后的配置（用于展示）
+func (c ArmRoutineConfig) effective() ArmRoutineConfig {
+	return ArmRoutineConfig{
+		Enabled:       c.Enabled,
+		SequencesDir:  c.sequencesDir(),
+		Up:            c.upSequence(),
+		Down:          c.downSequence(),
+		PostureHoldMS: int(c.postureHold() / time.Millisecond),
+	}
+}
+
+func (c ArmRoutineConfig) sequencesDir() string {
+	if c.SequencesDir == "" {
+		return defaultArmSequencesDir
+	}
+	return c.SequencesDir
+}
+
+func (c ArmRoutineConfig) upSequence() string {
+	if c.Up == "" {
+		return defaultArmUpSequence
+	}
+	return c.Up
+}
+
+func (c ArmRoutineConfig) downSequence() string {
+	if c.Down == "" {
+		return defaultArmDownSequence
+	}
+	return c.Down
+}
+
+func (c ArmRoutineConfig) postureHold() time.Duration {
+	if c.PostureHoldMS <= 0 {
+		return defaultPostureHoldMS * time.Millisecond
+	}
+	return time.Duration(c.PostureHoldMS) * time.Millisecond
+}
+
+// ArmFrame 动作序列中的一帧
+type ArmFrame struct {
+	Arm  string `json:"arm"`  // 设备名或CAN接口
+	ID   string `json:"id"`   // 设备ID（如 "0x01"）
+	Data []int  `json:"data"` // 数据字节（0~255，最多8个）
+}
+
+// ArmStep 动作序列中的一步
+type ArmStep struct {
+	Frames []ArmFrame `json:"frames"`
+	WaitMS int        `json:"wait_ms"` // 发送后等待时间（毫秒）
+}
+
+// ArmSequence 命名的手臂动作序列
+type ArmSequence struct {
+	Name  string    `json:"name"`
+	Steps []ArmStep `json:"steps"`
+
+	messages [][]CanMessage // 每一步解析后的CAN消息（加载时校验）
+}
+
+// armInterface 按CAN接口或设备名查找手臂所在的CAN接口
+func armInterface(cfg Config, arm string) (string, error) {
+	if _, ok := cfg.Arms[arm]; ok {
+		return arm, nil
+	}
+	for iface, armCfg := range cfg.Arms {
+		if armCfg.DeviceName == arm {
+			return iface, nil
+		}
+	}
+	return "", fmt.Errorf("未配置的手臂: %s（见 config.yaml arms）", arm)
+}
+
+// armSequencePath 动作序列文件路径
+func armSequencePath(cfg Config, name string) (string, error) {
+	if !armSequenceNamePattern.MatchString(name) {
+		return "", fmt.Errorf("无效的动作序列名: %q", name)
+	}
+	return filepath.Join(cfg.ArmRoutine.sequencesDir(), name+".json"), nil
+}
+
+// LoadArmSequence 加载并校验动作序列（手臂、ID、数据在开始动作前全部检查）
+func LoadArmSequence(cfg Config, name string) (*ArmSequence, error) {
+	path, err := armSequencePath(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取动作序列失败: %v", err)
+	}
+	var seq ArmSequence
+	if err := json.Unmarshal(data, &seq); err != nil {
+		return nil, fmt.Errorf("解析动作序列 %s 失败: %v", path, err)
+	}
+	if len(seq.Steps) == 0 {
+		return nil, fmt.Errorf("动作序列 %s 没有步骤", path)
+	}
+	seq.Name = name
+
+	utils := NewUtils()
+	seq.messages = make([][]CanMessage, len(seq.Steps))
+	for i, step := range seq.Steps {
+		if step.WaitMS < 0 {
+			return nil, fmt.Errorf("动作序列 %s 第%d步: wait_ms 不能为负数", name, i+1)
+		}
+		for _, frame := range step.Frames {
+			iface, err := armInterface(cfg, frame.Arm)
+			if err != nil {
+				return nil, fmt.Errorf("动作序列 %s 第%d步: %v", name, i+1, err)
+			}
+			if !strings.HasPrefix(strings.ToLower(frame.ID), "0x") {
+				return nil, fmt.Errorf("动作序列 %s 第%d步: 无效的设备ID %q", name, i+1, frame.ID)
+			}
+			if len(frame.Data) > 8 {
+				return nil, fmt.Errorf("动作序列 %s 第%d步: 数据长度%d超过8字节", name, i+1, len(frame.Data))
+			}
+			payload := make([]byte, len(frame.Data))
+			for j, v := range frame.Data {
+				if v < 0 || v > 255 {
+					return nil, fmt.Errorf("动作序列 %s 第%d步: 数据值%d超出0~255", name, i+1, v)
+				}
+				payload[j] = byte(v)
+			}
+			seq.messages[i] = append(seq.messages[i], CanMessage{
+				Interface: iface,
+				Id:        utils.ParseCanID(frame.ID),
+				Data:      payload,
+			})
+		}
+	}
+	return &seq, nil
+}
+
+// ListArmSequences 列出可用的动作序列名
+func ListArmSequences(cfg Config) ([]string, error) {
+	entries, err := os.ReadDir(cfg.ArmRoutine.sequencesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("读取动作序列目录失败: %v", err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if !entry.IsDir() && name != entry.Name() && armSequenceNamePattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RunArmSequence 依次执行动作序列的每一步（ctx 取消或急停时在步骤之间停止）
+func RunArmSequence(ctx context.Context, cfg Config, seq *ArmSequence) error {
+	if err := globalEStop.Check(); err != nil {
+		return err
+	}
+	ctx, cancel := globalEStop.WithEStop(ctx)
+	defer cancel()
+
+	utils := NewUtils()
+	fmt.Printf("🦾 执行手臂动作 %s（%d步）\n", seq.Name, len(seq.Steps))
+	for i, step := range seq.Steps {
+		if ctx.Err() != nil {
+			return playbackCause(ctx)
+		}
+		if cfg.DryRun {
+			fmt.Printf("   [dry_run] 第%d步: %d帧，等待%dms\n", i+1, len(seq.messages[i]), step.WaitMS)
+		}
+		if len(seq.messages[i]) > 0 {
+			if err := utils.SendCanFrames(cfg, seq.messages[i]...); err != nil {
+				return fmt.Errorf("手臂动作 %s 第%d步发送失败: %v", seq.Name, i+1, err)
+			}
+		}
+		if err := sleepContext(ctx, time.Duration(step.WaitMS)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sleepContext 等待指定时间，ctx 取消时提前返回取消原因
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return playbackCause(ctx)
+	}
+}
+
+// ArmRoutine 一次"抬臂 → 预姿态 → 演奏 → 释放 → 落臂"编排
+type ArmRoutine struct {
+	cfg  Config
+	up   *ArmSequence
+	down *ArmSequence
+}
+
+// NewArmRoutine 创建编排（抬臂、落臂序列在开始前加载并校验）
+func NewArmRoutine(cfg Config) (*ArmRoutine, error) {
+	if len(cfg.Arms) == 0 {
+		return nil, errors.New("配置文件中没有手臂（arms）")
+	}
+	up, err := LoadArmSequence(cfg, cfg.ArmRoutine.upSequence())
+	if err != nil {
+		return nil, err
+	}
+	down, err := LoadArmSequence(cfg, cfg.ArmRoutine.downSequence())
+	if err != nil {
+		return nil, err
+	}
+	return &ArmRoutine{cfg: cfg, up: up, down: down}, nil
+}
+
+// Run 执行完整编排；play 在预姿态之后调用，返回演奏结果
+// 返回演奏（或被中断的阶段）的结果；收尾阶段的错误只在前面都成功时返回
+func (r *ArmRoutine) Run(ctx context.Context, instrument string, play func(context.Context) error) error {
+	defer setArmPhase("")
+
+	setArmPhase(ArmPhaseUp)
+	err := RunArmSequence(ctx, r.cfg, r.up)
+	if err == nil {
+		setArmPhase(ArmPhasePosture)
+		err = r.prePosture(ctx, instrument)
+	}
+	if err == nil {
+		setArmPhase(ArmPhasePlay)
+		err = play(ctx)
+	}
+
+	// 急停后不再移动手指和手臂
+	if globalEStop.Latched() {
+		fmt.Println("🚨 急停已锁定，跳过释放与落臂")
+		return err
+	}
+
+	setArmPhase(ArmPhaseRelease)
+	if releaseErr := NewReadyGestureController().ExecuteEndGesture(r.cfg, instrument); releaseErr != nil {
+		fmt.Printf("⚠️  释放手指失败: %v\n", releaseErr)
+		if err == nil {
+			err = releaseErr
+		}
+	}
+
+	// 落臂不随会话停止而中断（停止后仍需回到安全位置），急停仍然可以中断
+	setArmPhase(ArmPhaseDown)
+	if downErr := RunArmSequence(context.Background(), r.cfg, r.down); downErr != nil {
+		fmt.Printf("⚠️  落臂失败: %v\n", downErr)
+		if err == nil {
+			err = downErr
+		}
+	}
+	return err
+}
+
+// prePosture 下发防撞预姿态：乐器配置了 before 姿态序列时按步骤执行，否则下发 handsleft/handsright 并等待到位
+func (r *ArmRoutine) prePosture(ctx context.Context, instrument string) error {
+	if HasPosture(r.cfg, instrument, PostureBefore) {
+		return RunPosture(ctx, r.cfg, instrument, PostureBefore)
+	}
+	if len(r.cfg.HandsLeft) == 0 && len(r.cfg.HandsRight) == 0 {
+		return nil
+	}
+	builder := NewFingeringBuilder()
+	utils := NewUtils()
+	var msgs []CanMessage
+	if len(r.cfg.HandsLeft) > 0 {
+		msgs = append(msgs, CanMessage{
+			Interface: r.cfg.Hands.Left.Interface,
+			Id:        utils.ParseCanID(r.cfg.Hands.Left.ID),
+			Data:      builder.BuildReleaseFrame(r.cfg.HandsLeft),
+		})
+	}
+	if len(r.cfg.HandsRight) > 0 {
+		msgs = append(msgs, CanMessage{
+			Interface: r.cfg.Hands.Right.Interface,
+			Id:        utils.ParseCanID(r.cfg.Hands.Right.ID),
+			Data:      builder.BuildReleaseFrame(r.cfg.HandsRight),
+		})
+	}
+	fmt.Println("✋ 下发防撞预姿态")
+	if err := utils.SendCanFrames(r.cfg, msgs...); err != nil {
+		return fmt.Errorf("下发预姿态失败: %v", err)
+	}
+	return sleepContext(ctx, r.cfg.ArmRoutine.postureHold())
+}
+
+// setArmPhase 更新演奏状态中的编排阶段
+func setArmPhase(phase string) {
+	playbackController.mutex.Lock()
+	playbackController.status.ArmPhase = phase
+	playbackController.mutex.Unlock()
+}
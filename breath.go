@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 换气规划 - 在长乐句中自动安排换气点
+////////////////////////////////////////////////////////////////////////////////
+//
+// 气泵本身不需要换气，但听众期待乐句之间有呼吸，气泵连续工作也需要散热间隙。
+// 规划规则：
+//   - 空拍本身就是换气，连续吹奏时间从空拍结束重新计算
+//   - 时间轴中手动标记的换气点（["C5", 2, {"breath": true}]）总是保留
+//   - 连续吹奏超过 max_blow_ms 时，在上一个换气点之后的音符中选择最合适的位置：
+//     长音优先，落在小节线前的音加倍；连音（slur）中间不换气
+//   - 换气从该音符的结尾借 gap_ms（最多一半时值），关闭气泵并预先切换到下一个音符的指法，下一个音符起点重新开启
+
+const (
+	defaultBreathGapMS  = 150.0 // 默认换气间隙（毫秒）
+	breathMinBlowRatio  = 1.0 / 3.0
+	breathBarLineWeight = 2.0 // 落在小节线前的音符的权重
+)
+
+// 换气原因
+const (
+	BreathManual   = "manual"    // 时间轴手动标记
+	BreathLongNote = "long_note" // 长音之后
+	BreathBarLine  = "bar_line"  // 小节线处
+	BreathForced   = "max_blow"  // 没有合适位置，在超出前的最后一个音符后强制换气
+)
+
+// BreathConfig 换气规划配置
+type BreathConfig struct {
+	MaxBlowMS float64 `yaml:"max_blow_ms" json:"max_blow_ms"` // 最长连续吹奏时间（毫秒，0表示不自动换气，只保留手动标记）
+	GapMS     float64 `yaml:"gap_ms" json:"gap_ms"`           // 换气间隙（毫秒，默认150）
+}
+
+// BreathPoint 一个换气点（写入执行序列元数据并在预处理时打印）
+type BreathPoint struct {
+	Index     int     `json:"index"`   // 换气前音符在时间轴中的序号（从1开始）
+	Note      string  `json:"note"`    // 换气前的音符
+	Bar       int     `json:"bar"`     // 换气前音符所在小节
+	Beat      float64 `json:"beat"`    // 换气前音符的小节内拍位置
+	AtMS      float64 `json:"at_ms"`   // 换气开始时刻（毫秒，未扣除间隙前的音符结束时刻）
+	BlowMS    float64 `json:"blow_ms"` // 换气前已连续吹奏的时间（毫秒）
+	Reason    string  `json:"reason"`  // 原因：manual/long_note/bar_line/max_blow
+	GapMS     float64 `json:"gap_ms"`  // 实际换气间隙（毫秒）
+	noteIndex int     // 在展开后音符列表中的下标
+}
+
+// gapMS 实际使用的换气间隙
+func (bc BreathConfig) gapMS() float64 {
+	if bc.GapMS > 0 {
+		return bc.GapMS
+	}
+	return defaultBreathGapMS
+}
+
+// planBreaths 规划换气点（durations 为各音符的实际时长，毫秒）
+// 音符的 Breath 字段只表示时间轴中的手动标记，规划结果以返回的换气点为准
+func (sp *SequencePreprocessor) planBreaths(events []NoteEvent, durations []float64) []BreathPoint {
+	cfg := sp.breath
+	var points []BreathPoint
+
+	ends := make([]float64, len(events))
+	t := 0.0
+	for i := range events {
+		t += durations[i]
+		ends[i] = t
+	}
+
+	// canBreatheAfter 音符之后是否可以换气（下一个是音符、不在连音中）
+	canBreatheAfter := func(i int) bool {
+		return events[i].Note != "NO" && i+1 < len(events) && events[i+1].Note != "NO" && !events[i].Slur
+	}
+	add := func(i int, blowStart float64, reason string) {
+		points = append(points, BreathPoint{
+			Index:     events[i].Index,
+			Note:      events[i].Note,
+			Bar:       events[i].Bar,
+			Beat:      events[i].Beat,
+			AtMS:      ends[i],
+			BlowMS:    ends[i] - blowStart,
+			Reason:    reason,
+			GapMS:     math.Min(cfg.gapMS(), durations[i]/2),
+			noteIndex: i,
+		})
+	}
+
+	blowStart := 0.0 // 当前连续吹奏的起点
+	windowStart := 0 // 可选换气位置的起始音符
+	for i, event := range events {
+		if event.Note == "NO" {
+			blowStart = ends[i]
+			windowStart = i + 1
+			continue
+		}
+
+		// 自动换气：加上当前音符会超出最长连续吹奏时间时，在此前的音符中选位置
+		if cfg.MaxBlowMS > 0 && ends[i]-blowStart > cfg.MaxBlowMS && i > windowStart {
+			best, bestScore, reason := -1, 0.0, ""
+			for j := windowStart; j < i; j++ {
+				if !canBreatheAfter(j) || ends[j]-blowStart < cfg.MaxBlowMS*breathMinBlowRatio {
+					continue
+				}
+				score, why := durations[j], BreathLongNote
+				if events[j+1].Beat == 1 {
+					score *= breathBarLineWeight
+					why = BreathBarLine
+				}
+				// 同分时取更靠后的位置，尽量用满连续吹奏时间
+				if score >= bestScore {
+					best, bestScore, reason = j, score, why
+				}
+			}
+			if best < 0 && canBreatheAfter(i-1) {
+				best, reason = i-1, BreathForced
+			}
+			if best >= 0 {
+				add(best, blowStart, reason)
+				blowStart = ends[best]
+				windowStart = best + 1
+			} else {
+				fmt.Printf("⚠️  %s 连续吹奏超过%.1fs，但连音中没有可换气的位置\n",
+					FormatBarBeat(event.Bar, event.Beat), cfg.MaxBlowMS/1000.0)
+				windowStart = i
+			}
+		}
+
+		// 手动换气点
+		if event.Breath && canBreatheAfter(i) {
+			if len(points) == 0 || points[len(points)-1].noteIndex != i {
+				add(i, blowStart, BreathManual)
+			}
+			blowStart = ends[i]
+			windowStart = i + 1
+		}
+	}
+
+	return points
+}
+
+// generateBreathEvent 生成换气事件：关闭气泵，并预先切换到下一个音符的指法
+func (sp *SequencePreprocessor) generateBreathEvent(timestampMS, gapMS float64, next NoteEvent) ExecutionEvent {
+	event := ExecutionEvent{
+		TimestampMS: timestampMS,
+		DurationMS:  gapMS,
+		Note:        "BREATH",
+		SerialCmd:   "off",
+	}
+	if frames, err := sp.buildFingeringFrames(next.Note); err == nil {
+		event.Frames = frames
+	}
+	return event
+}
+
+// printBreathPoints 打印换气点报告
+func printBreathPoints(points []BreathPoint) {
+	if len(points) == 0 {
+		return
+	}
+	reasons := map[string]string{
+		BreathManual:   "手动标记",
+		BreathLongNote: "长音后",
+		BreathBarLine:  "小节线",
+		BreathForced:   "强制",
+	}
+	fmt.Printf("   换气点: %d个\n", len(points))
+	for _, p := range points {
+		fmt.Printf("     %-14s %s之后 @%.2fs，已连续吹奏%.2fs（%s，间隙%.0fms）\n",
+			FormatBarBeat(p.Bar, p.Beat), p.Note, p.AtMS/1000.0, p.BlowMS/1000.0, reasons[p.Reason], p.GapMS)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gosks/canbridge"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 内置CAN桥接服务 - -bridge 模式，本程序代替独立的桥接服务写入 can0-can3
+////////////////////////////////////////////////////////////////////////////////
+//
+// 实现 ForwardToCanService 使用的HTTP约定（POST /api/can、/api/can/batch），由 SocketCAN 写入；
+// 另有 GET /api/status 查看各接口 up/down 与收发计数。树莓派上只需运行本程序：
+//   ./newsksgo -bridge &      # 桥接服务（监听地址默认取 can_bridge_url 的端口）
+//   ./newsksgo                # Web服务/演奏
+// 集成测试可使用 vcan 接口（bridge.interfaces: [vcan0]，hands.*.interface 同样改为 vcan0）。
+
+// defaultBridgeInterfaces 未配置 bridge.interfaces 时允许写入的接口
+var defaultBridgeInterfaces = []string{"can0", "can1", "can2", "can3"}
+
+// BridgeConfig 内置桥接服务配置
+type BridgeConfig struct {
+	Listen     string   `yaml:"listen"`     // 监听地址（留空时使用 can_bridge_url 的端口，如 :5260）
+	Interfaces []string `yaml:"interfaces"` // 允许写入的CAN接口（留空时为 can0-can3）
+}
+
+// bridgeListenAddr 桥接服务监听地址
+func bridgeListenAddr(cfg Config) string {
+	if cfg.Bridge.Listen != "" {
+		return cfg.Bridge.Listen
+	}
+	if u, err := url.Parse(cfg.CanBridgeURL); err == nil && u.Port() != "" {
+		return ":" + u.Port()
+	}
+	return ":5260"
+}
+
+// RunCanBridge 运行内置桥接服务（阻塞直到监听失败）
+func RunCanBridge(cfg Config) error {
+	interfaces := cfg.Bridge.Interfaces
+	if len(interfaces) == 0 {
+		interfaces = defaultBridgeInterfaces
+	}
+	bridge := canbridge.NewBridge(interfaces)
+	defer bridge.Close()
+
+	for _, iface := range bridge.Status().Interfaces {
+		switch {
+		case !iface.Exists:
+			fmt.Printf("⚠️  CAN接口 %s 不存在\n", iface.Name)
+		case !iface.Up:
+			fmt.Printf("⚠️  CAN接口 %s 未启用（ip link set %s up）\n", iface.Name, iface.Name)
+		default:
+			fmt.Printf("✅ CAN接口 %s 已启用\n", iface.Name)
+		}
+	}
+
+	addr := bridgeListenAddr(cfg)
+	fmt.Printf("🔌 内置CAN桥接服务监听 %s，接口: %s（状态: GET /api/status）\n", addr, strings.Join(interfaces, ", "))
+	if err := http.ListenAndServe(addr, bridge.Handler()); err != nil {
+		return fmt.Errorf("CAN桥接服务退出: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CAN批量发送 - 左右手的帧在一个请求中发往桥接服务，两只手同时动作
+////////////////////////////////////////////////////////////////////////////////
+//
+// 桥接服务通过 GET /api/capabilities 声明 {"batch": true} 时使用 POST /api/can/batch：
+//   请求 {"messages":[CanMessage, ...]}
+//   响应 200 全部写入成功；其他状态码时响应体 {"results":[{"ok":true},{"ok":false,"error":"..."}]} 给出逐帧结果
+// 能力在演奏前预检时探测（见 CanBridgePreflight）；不支持（404）或探测失败时逐帧 POST /api/can。
+// 批量请求返回 404/405 时（例如桥接服务被替换为旧版本）立即退回逐帧发送。
+// 仓库自带的桥接服务实现见 canbridge 包（go run ./cmd/canbridge）。
+
+// errBatchUnsupported 桥接服务不支持批量发送
+var errBatchUnsupported = errors.New("CAN桥接服务不支持批量发送")
+
+// CanBatchRequest 批量发送请求
+type CanBatchRequest struct {
+	Messages []CanMessage `json:"messages"`
+}
+
+// CanBatchResponse 批量发送响应（逐帧结果）
+type CanBatchResponse struct {
+	Results []struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	} `json:"results"`
+}
+
+// BridgeCapabilities 桥接服务能力
+type BridgeCapabilities struct {
+	Batch      bool     `json:"batch"`
+	Interfaces []string `json:"interfaces,omitempty"`
+}
+
+// DetectBridgeCapabilities 探测桥接服务能力并设置发送器的批量模式
+// 旧版桥接服务没有 /api/capabilities（404），视为不支持批量；请求失败时保持原来的模式并返回错误
+func DetectBridgeCapabilities(canBridgeURL string) (BridgeCapabilities, error) {
+	var caps BridgeCapabilities
+	resp, err := InitGlobalHTTPClient().Get(canBridgeURL + "/api/capabilities")
+	if err != nil {
+		return caps, fmt.Errorf("查询CAN桥接服务能力失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+			return caps, fmt.Errorf("解析CAN桥接服务能力失败: %v", err)
+		}
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+	globalCanSender.SetBatchSupported(canBridgeURL, caps.Batch)
+	return caps, nil
+}
+
+// postCanBatch 在一个请求中发送多帧并逐帧记录结果（统计与录制）
+// 返回每帧的错误；请求本身失败时返回 err（桥接服务不支持时为 errBatchUnsupported，此时不记录）
+func postCanBatch(ctx context.Context, canBridgeURL string, items []*canSendItem) ([]error, error) {
+	request := CanBatchRequest{Messages: make([]CanMessage, len(items))}
+	for i, item := range items {
+		request.Messages[i] = item.msg
+	}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("消息序列化失败: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, canBridgeURL+"/api/can/batch", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	sentAt := time.Now()
+	resp, err := InitGlobalHTTPClient().Do(req)
+	if err != nil {
+		for _, msg := range request.Messages {
+			recordCanDelivery(sentAt, msg, 0, err)
+		}
+		return nil, fmt.Errorf("发送到CAN服务失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		for _, msg := range request.Messages {
+			recordCanDelivery(sentAt, msg, resp.StatusCode, nil)
+		}
+		return make([]error, len(items)), nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, errBatchUnsupported
+	}
+
+	// 部分失败：按逐帧结果记录；没有逐帧结果时整批视为失败
+	var result CanBatchResponse
+	json.Unmarshal(body, &result)
+	errs := make([]error, len(items))
+	for i, msg := range request.Messages {
+		var err error
+		switch {
+		case i >= len(result.Results):
+			err = fmt.Errorf("CAN服务错误: %s", strings.TrimSpace(string(body)))
+		case !result.Results[i].OK:
+			err = fmt.Errorf("CAN服务错误: %s", result.Results[i].Error)
+		}
+		recordCanDelivery(sentAt, msg, resp.StatusCode, err)
+		errs[i] = err
+	}
+	return errs, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CAN桥接服务健康监测 - 按接口统计发送/失败/超时与延迟分布，演奏前预检桥接服务
+////////////////////////////////////////////////////////////////////////////////
+//
+// 每个发往桥接服务的请求（同步与异步）结束时记录一次结果：
+//   - ok：返回200，延迟计入直方图
+//   - failed：返回非200或连接失败等错误
+//   - timed_out：超过HTTP客户端超时（100ms），这类丢帧以前会被静默忽略
+//   - canceled：因停止/替换/急停被中断，不算失败
+//   - coalesced：排队时被同一设备的新帧合并（见 frame_sender.go），没有发出
+// 统计分两份：进程启动以来（/api/health）和当前演奏会话（/api/playback/status，开始演奏时清零）。
+// 预检：演奏开始前 GET 桥接服务地址若干次（任何HTTP响应都说明可达），不可达或最慢一次超过
+// can_health.max_ping_ms 时拒绝开始。dry_run 时跳过。
+
+const (
+	defaultPreflightPings = 3
+	defaultMaxPingMS      = 50.0 // 默认预检延迟上限（需明显小于HTTP客户端的100ms超时）
+)
+
+// CAN请求延迟直方图的桶上限（毫秒），最后一个桶为 +Inf
+var canLatencyBucketsMS = []float64{1, 2, 5, 10, 20, 50, 100, 200}
+
+// CanHealthConfig 桥接服务健康检查配置
+type CanHealthConfig struct {
+	Preflight *bool   `yaml:"preflight"`   // 演奏前是否预检（默认开启）
+	Pings     int     `yaml:"pings"`       // 预检请求次数（默认3）
+	MaxPingMS float64 `yaml:"max_ping_ms"` // 预检允许的最大延迟（毫秒，默认50）
+}
+
+// preflightEnabled 是否启用预检
+func (hc CanHealthConfig) preflightEnabled() bool {
+	return hc.Preflight == nil || *hc.Preflight
+}
+
+// LatencyBucket 直方图的一个桶（累计计数，Prometheus风格）
+type LatencyBucket struct {
+	LE    string `json:"le"` // 上限（毫秒），"+Inf" 为最后一个桶
+	Count int64  `json:"count"`
+}
+
+// LatencyStats 延迟分布（百分位为所在桶的上限，近似值）
+type LatencyStats struct {
+	Count   int64           `json:"count"`
+	MeanMS  float64         `json:"mean_ms"`
+	P50MS   float64         `json:"p50_ms"`
+	P95MS   float64         `json:"p95_ms"`
+	P99MS   float64         `json:"p99_ms"`
+	MaxMS   float64         `json:"max_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// InterfaceCanStats 单个CAN接口的发送统计
+type InterfaceCanStats struct {
+	Interface string       `json:"interface"`
+	Sent      int64        `json:"sent"` // 发出的请求数（含失败、超时、中断）
+	OK        int64        `json:"ok"`
+	Failed    int64        `json:"failed"`
+	TimedOut  int64        `json:"timed_out"`
+	Canceled  int64        `json:"canceled"`
+	Coalesced int64        `json:"coalesced"` // 待发时被同一设备的新帧合并而未发送的帧数
+	LastError string       `json:"last_error,omitempty"`
+	LastAt    *time.Time   `json:"last_error_at,omitempty"`
+	Latency   LatencyStats `json:"latency"`
+}
+
+// CanStatsSnapshot 统计快照
+type CanStatsSnapshot struct {
+	Since      time.Time           `json:"since"`
+	Sent       int64               `json:"sent"`
+	OK         int64               `json:"ok"`
+	Failed     int64               `json:"failed"`
+	TimedOut   int64               `json:"timed_out"`
+	Canceled   int64               `json:"canceled"`
+	Coalesced  int64               `json:"coalesced"`
+	Interfaces []InterfaceCanStats `json:"interfaces"`
+}
+
+// interfaceCounters 单个接口的计数器
+type interfaceCounters struct {
+	sent, ok, failed, timedOut, canceled int64
+	coalesced                            int64
+	buckets                              []int64 // 每个桶的计数（非累计），长度为桶上限数+1
+	latencySumMS                         float64
+	latencyMaxMS                         float64
+	lastError                            string
+	lastErrorAt                          time.Time
+}
+
+// CanStats CAN发送统计
+type CanStats struct {
+	mutex      sync.Mutex
+	since      time.Time
+	interfaces map[string]*interfaceCounters
+}
+
+// NewCanStats 创建CAN发送统计
+func NewCanStats() *CanStats {
+	return &CanStats{since: time.Now(), interfaces: make(map[string]*interfaceCounters)}
+}
+
+// 全局统计：进程启动以来 / 当前演奏会话
+var (
+	globalCanStats  = NewCanStats()
+	sessionCanStats = NewCanStats()
+)
+
+// Reset 清零统计
+func (cs *CanStats) Reset() {
+	cs.mutex.Lock()
+	cs.since = time.Now()
+	cs.interfaces = make(map[string]*interfaceCounters)
+	cs.mutex.Unlock()
+}
+
+// counters 接口的计数器（不存在时创建，调用方持有锁）
+func (cs *CanStats) counters(iface string) *interfaceCounters {
+	c := cs.interfaces[iface]
+	if c == nil {
+		c = &interfaceCounters{buckets: make([]int64, len(canLatencyBucketsMS)+1)}
+		cs.interfaces[iface] = c
+	}
+	return c
+}
+
+// RecordCoalesced 记录一次帧合并
+func (cs *CanStats) RecordCoalesced(iface string) {
+	cs.mutex.Lock()
+	cs.counters(iface).coalesced++
+	cs.mutex.Unlock()
+}
+
+// Record 记录一次请求结果
+func (cs *CanStats) Record(iface string, latency time.Duration, err error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	c := cs.counters(iface)
+	c.sent++
+	switch {
+	case err == nil:
+		c.ok++
+		ms := float64(latency.Microseconds()) / 1000.0
+		c.latencySumMS += ms
+		c.latencyMaxMS = math.Max(c.latencyMaxMS, ms)
+		c.buckets[sort.SearchFloat64s(canLatencyBucketsMS, ms)]++
+		return
+	case errors.Is(err, context.Canceled):
+		c.canceled++
+		return
+	case isTimeoutError(err):
+		c.timedOut++
+	default:
+		c.failed++
+	}
+	c.lastError = err.Error()
+	c.lastErrorAt = time.Now()
+}
+
+// Snapshot 统计快照（接口按名称排序）
+func (cs *CanStats) Snapshot() CanStatsSnapshot {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	snapshot := CanStatsSnapshot{Since: cs.since, Interfaces: []InterfaceCanStats{}}
+	for name, c := range cs.interfaces {
+		stats := InterfaceCanStats{
+			Interface: name,
+			Sent:      c.sent,
+			OK:        c.ok,
+			Failed:    c.failed,
+			TimedOut:  c.timedOut,
+			Canceled:  c.canceled,
+			Coalesced: c.coalesced,
+			LastError: c.lastError,
+			Latency:   c.latencyStats(),
+		}
+		if !c.lastErrorAt.IsZero() {
+			at := c.lastErrorAt
+			stats.LastAt = &at
+		}
+		snapshot.Interfaces = append(snapshot.Interfaces, stats)
+		snapshot.Sent += c.sent
+		snapshot.OK += c.ok
+		snapshot.Failed += c.failed
+		snapshot.TimedOut += c.timedOut
+		snapshot.Canceled += c.canceled
+		snapshot.Coalesced += c.coalesced
+	}
+	sort.Slice(snapshot.Interfaces, func(i, j int) bool {
+		return snapshot.Interfaces[i].Interface < snapshot.Interfaces[j].Interface
+	})
+	return snapshot
+}
+
+// latencyStats 由直方图计算延迟分布
+func (c *interfaceCounters) latencyStats() LatencyStats {
+	stats := LatencyStats{Count: c.ok, MaxMS: roundMS(c.latencyMaxMS), Buckets: []LatencyBucket{}}
+	if c.ok > 0 {
+		stats.MeanMS = roundMS(c.latencySumMS / float64(c.ok))
+	}
+
+	// percentile 第一个累计计数达到 p 的桶的上限（落在 +Inf 桶时取最大值）
+	percentile := func(p float64) float64 {
+		need := int64(math.Ceil(p * float64(c.ok)))
+		var cumulative int64
+		for i, n := range c.buckets {
+			cumulative += n
+			if cumulative >= need {
+				if i < len(canLatencyBucketsMS) {
+					return math.Min(canLatencyBucketsMS[i], stats.MaxMS)
+				}
+				return stats.MaxMS
+			}
+		}
+		return stats.MaxMS
+	}
+	if c.ok > 0 {
+		stats.P50MS = percentile(0.50)
+		stats.P95MS = percentile(0.95)
+		stats.P99MS = percentile(0.99)
+	}
+
+	var cumulative int64
+	for i, n := range c.buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < len(canLatencyBucketsMS) {
+			le = fmt.Sprintf("%g", canLatencyBucketsMS[i])
+		}
+		stats.Buckets = append(stats.Buckets, LatencyBucket{LE: le, Count: cumulative})
+	}
+	return stats
+}
+
+// isTimeoutError 是否为超时错误（HTTP客户端超时或截止时间已过）
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// recordCanDelivery 记录一次CAN请求的结果（统计与硬件I/O录制）
+func recordCanDelivery(sentAt time.Time, msg CanMessage, status int, err error) {
+	latency := time.Since(sentAt)
+	globalCanStats.Record(msg.Interface, latency, err)
+	sessionCanStats.Record(msg.Interface, latency, err)
+	globalCapture.RecordCAN(sentAt, msg, status, err)
+}
+
+// recordCanCoalesced 记录一次帧合并（见 OrderedCanSender）
+func recordCanCoalesced(iface string) {
+	globalCanStats.RecordCoalesced(iface)
+	sessionCanStats.RecordCoalesced(iface)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// 预检
+////////////////////////////////////////////////////////////////////////////////
+
+// BridgePing 一次桥接服务探测结果
+type BridgePing struct {
+	URL       string  `json:"url"`
+	Reachable bool    `json:"reachable"`
+	Status    int     `json:"status,omitempty"` // HTTP状态码（任何响应都说明可达）
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// PingCanBridge 探测桥接服务（GET 服务地址，使用与演奏相同的HTTP客户端和超时）
+func PingCanBridge(canBridgeURL string) BridgePing {
+	ping, _ := pingCanBridge(canBridgeURL)
+	return ping
+}
+
+// pingCanBridge 探测桥接服务，同时返回原始错误（用于区分超时）
+func pingCanBridge(canBridgeURL string) (BridgePing, error) {
+	ping := BridgePing{URL: canBridgeURL}
+	start := time.Now()
+	resp, err := InitGlobalHTTPClient().Get(canBridgeURL)
+	ping.LatencyMS = roundMS(float64(time.Since(start).Microseconds()) / 1000.0)
+	if err != nil {
+		ping.Error = err.Error()
+		return ping, err
+	}
+	resp.Body.Close()
+	ping.Reachable = true
+	ping.Status = resp.StatusCode
+	return ping, nil
+}
+
+// CanBridgePreflight 演奏前检查桥接服务是否可达且足够快（dry_run 或关闭预检时跳过）
+// 返回的错误包装了 ErrPreflightFailed
+func CanBridgePreflight(cfg Config) error {
+	hc := cfg.CanHealth
+	if cfg.DryRun {
+		return nil
+	}
+	// 探测是否支持批量发送（失败时保持原来的模式，由下面的探活给出结论）
+	if _, err := DetectBridgeCapabilities(cfg.CanBridgeURL); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+	if !hc.preflightEnabled() {
+		return nil
+	}
+	pings := hc.Pings
+	if pings <= 0 {
+		pings = defaultPreflightPings
+	}
+	maxPingMS := hc.MaxPingMS
+	if maxPingMS <= 0 {
+		maxPingMS = defaultMaxPingMS
+	}
+
+	slowest := 0.0
+	for i := 0; i < pings; i++ {
+		ping, err := pingCanBridge(cfg.CanBridgeURL)
+		if err != nil {
+			if isTimeoutError(err) {
+				return fmt.Errorf("%w: CAN桥接服务 %s 响应超时（>%v），指法帧会被丢弃",
+					ErrPreflightFailed, cfg.CanBridgeURL, InitGlobalHTTPClient().Timeout)
+			}
+			return fmt.Errorf("%w: CAN桥接服务 %s 不可达: %v", ErrPreflightFailed, cfg.CanBridgeURL, err)
+		}
+		slowest = math.Max(slowest, ping.LatencyMS)
+	}
+	if slowest > maxPingMS {
+		return fmt.Errorf("%w: CAN桥接服务 %s 响应过慢: %.1fms（上限 %.0fms，见 can_health.max_ping_ms）",
+			ErrPreflightFailed, cfg.CanBridgeURL, slowest, maxPingMS)
+	}
+	fmt.Printf("✅ CAN桥接服务预检通过: %s（最慢 %.1fms）\n", cfg.CanBridgeURL, slowest)
+	return nil
+}
+
+// ErrPreflightFailed 演奏前预检未通过（Web API 返回 503）
+var ErrPreflightFailed = errors.New("演奏前预检未通过")
@@ -0,0 +1,221 @@
+package canbridge
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CAN桥接服务 - 接收HTTP请求并写入SocketCAN接口（can0-can3 或测试用 vcan）
+////////////////////////////////////////////////////////////////////////////////
+//
+// HTTP 约定（与主程序 ForwardToCanService 一致）：
+//   POST /api/can          {"interface":"can0","id":39,"data":"<base64>"}   成功返回200，失败返回非200和错误文本
+//   POST /api/can/batch    {"messages":[{...},{...}]}                       各帧依次写入（左右手在同一请求中到达）
+//                          全部成功返回200，否则返回502；响应体 {"results":[{"ok":true},{"ok":false,"error":"..."}]}
+//   GET  /api/capabilities {"batch":true,"interfaces":["can0",...]}         主程序据此决定是否使用批量发送
+//   GET  /api/status       各接口 up/down 状态与收发计数（见 status.go）
+//   GET  /                 探活（演奏前预检）
+// 接口在首次使用时打开；写入失败后关闭套接字，下一帧重新打开（接口重新up后自动恢复）。
+
+// Message 一个CAN帧（JSON格式与主程序的 CanMessage 相同）
+type Message struct {
+	Interface string `json:"interface"`
+	Id        uint32 `json:"id"`
+	Data      []byte `json:"data"`
+}
+
+// BatchRequest 批量发送请求
+type BatchRequest struct {
+	Messages []Message `json:"messages"`
+}
+
+// BatchItemResult 批量发送中单帧的结果
+type BatchItemResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchResponse 批量发送响应
+type BatchResponse struct {
+	Results []BatchItemResult `json:"results"`
+}
+
+// Capabilities 桥接服务能力
+type Capabilities struct {
+	Batch      bool     `json:"batch"`
+	Interfaces []string `json:"interfaces"`
+}
+
+// Socket 一个已打开的CAN接口
+type Socket interface {
+	WriteFrame(id uint32, data []byte) error
+	Close() error
+}
+
+// Bridge CAN桥接服务
+type Bridge struct {
+	mutex      sync.Mutex
+	interfaces map[string]bool   // 允许写入的接口（为空表示不限制）
+	sockets    map[string]Socket // 已打开的接口
+	counters   map[string]*InterfaceCounters
+	startedAt  time.Time
+	open       func(name string) (Socket, error)
+}
+
+// NewBridge 创建桥接服务（interfaces 为允许写入的接口名，为空时不限制）
+func NewBridge(interfaces []string) *Bridge {
+	allowed := make(map[string]bool)
+	for _, name := range interfaces {
+		allowed[name] = true
+	}
+	return &Bridge{
+		interfaces: allowed,
+		sockets:    make(map[string]Socket),
+		counters:   make(map[string]*InterfaceCounters),
+		startedAt:  time.Now(),
+		open:       OpenSocketCAN,
+	}
+}
+
+// Interfaces 允许写入的接口（排序后）
+func (b *Bridge) Interfaces() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	names := make([]string, 0, len(b.interfaces))
+	for name := range b.interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Send 写入一帧
+func (b *Bridge) Send(msg Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	err := b.sendLocked(msg)
+	b.record(msg.Interface, err)
+	return err
+}
+
+// SendBatch 依次写入多帧（持锁期间连续写入，帧之间不被其他请求插入）
+func (b *Bridge) SendBatch(msgs []Message) []error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = b.sendLocked(msg)
+		b.record(msg.Interface, errs[i])
+	}
+	return errs
+}
+
+// sendLocked 写入一帧（调用方持有锁）
+func (b *Bridge) sendLocked(msg Message) error {
+	if len(b.interfaces) > 0 && !b.interfaces[msg.Interface] {
+		return fmt.Errorf("未配置的CAN接口: %s", msg.Interface)
+	}
+	if len(msg.Data) > 8 {
+		return fmt.Errorf("数据长度%d超过8字节", len(msg.Data))
+	}
+
+	socket := b.sockets[msg.Interface]
+	if socket == nil {
+		var err error
+		socket, err = b.open(msg.Interface)
+		if err != nil {
+			return fmt.Errorf("打开CAN接口 %s 失败: %v", msg.Interface, err)
+		}
+		b.sockets[msg.Interface] = socket
+	}
+
+	if err := socket.WriteFrame(msg.Id, msg.Data); err != nil {
+		socket.Close()
+		delete(b.sockets, msg.Interface)
+		return fmt.Errorf("写入CAN接口 %s 失败: %v", msg.Interface, err)
+	}
+	return nil
+}
+
+// Close 关闭所有接口
+func (b *Bridge) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for name, socket := range b.sockets {
+		socket.Close()
+		delete(b.sockets, name)
+	}
+}
+
+// Register 在路由上注册桥接服务的HTTP接口
+func (b *Bridge) Register(r gin.IRoutes) {
+	r.GET("/", b.ping)
+	r.GET("/api/capabilities", b.capabilities)
+	r.GET("/api/status", b.status)
+	r.POST("/api/can", b.handleSend)
+	r.POST("/api/can/batch", b.handleBatch)
+}
+
+// ping 探活
+func (b *Bridge) ping(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// capabilities 查询能力
+func (b *Bridge) capabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, Capabilities{Batch: true, Interfaces: b.Interfaces()})
+}
+
+// status 查询各接口状态与计数
+func (b *Bridge) status(c *gin.Context) {
+	c.JSON(http.StatusOK, b.Status())
+}
+
+// handleSend 写入单帧
+func (b *Bridge) handleSend(c *gin.Context) {
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.String(http.StatusBadRequest, "请求格式错误: %v", err)
+		return
+	}
+	if err := b.Send(msg); err != nil {
+		c.String(http.StatusBadGateway, err.Error())
+		return
+	}
+	c.String(http.StatusOK, "ok")
+}
+
+// handleBatch 批量写入
+func (b *Bridge) handleBatch(c *gin.Context) {
+	var request BatchRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.String(http.StatusBadRequest, "请求格式错误: %v", err)
+		return
+	}
+
+	response := BatchResponse{Results: make([]BatchItemResult, len(request.Messages))}
+	status := http.StatusOK
+	for i, err := range b.SendBatch(request.Messages) {
+		response.Results[i].OK = err == nil
+		if err != nil {
+			response.Results[i].Error = err.Error()
+			status = http.StatusBadGateway
+		}
+	}
+	c.JSON(status, response)
+}
+
+// Handler 独立运行时使用的HTTP处理器
+func (b *Bridge) Handler() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
+	b.Register(r)
+	return r
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package canbridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// SocketCAN - 通过原始CAN套接字写入 can0-can3 / vcan 接口（仅 Linux）
+////////////////////////////////////////////////////////////////////////////////
+//
+// 帧格式为内核的 struct can_frame（16字节）：can_id(4, 本机字节序) + len(1) + 填充(3) + data(8)。
+// ID 超过 11 位时按扩展帧发送（置 CAN_EFF_FLAG）。
+
+const canFrameSize = 16
+
+// socketCAN 一个绑定到接口的原始CAN套接字
+type socketCAN struct {
+	fd   int
+	name string
+}
+
+// OpenSocketCAN 打开并绑定CAN接口
+func OpenSocketCAN(name string) (Socket, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("创建CAN套接字失败: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrCAN{Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("绑定 %s 失败: %v", name, err)
+	}
+	return &socketCAN{fd: fd, name: name}, nil
+}
+
+// WriteFrame 写入一帧
+func (s *socketCAN) WriteFrame(id uint32, data []byte) error {
+	if len(data) > 8 {
+		return fmt.Errorf("数据长度%d超过8字节", len(data))
+	}
+	if id > unix.CAN_SFF_MASK {
+		id = (id & unix.CAN_EFF_MASK) | unix.CAN_EFF_FLAG
+	}
+
+	var frame [canFrameSize]byte
+	binary.NativeEndian.PutUint32(frame[0:4], id)
+	frame[4] = byte(len(data))
+	copy(frame[8:], data)
+
+	n, err := unix.Write(s.fd, frame[:])
+	if err != nil {
+		return err
+	}
+	if n != canFrameSize {
+		return fmt.Errorf("只写入了%d字节", n)
+	}
+	return nil
+}
+
+// Close 关闭套接字
+func (s *socketCAN) Close() error {
+	return unix.Close(s.fd)
+}
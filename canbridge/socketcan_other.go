@@ -0,0 +1,14 @@
+//go:build !linux
+
+package canbridge
+
+import "fmt"
+
+////////////////////////////////////////////////////////////////////////////////
+// SocketCAN - 非 Linux 平台不可用
+////////////////////////////////////////////////////////////////////////////////
+
+// OpenSocketCAN 非 Linux 平台没有 SocketCAN，总是返回错误
+func OpenSocketCAN(name string) (Socket, error) {
+	return nil, fmt.Errorf("SocketCAN 仅支持 Linux，无法打开 %s", name)
+}
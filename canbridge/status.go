@@ -0,0 +1,89 @@
+package canbridge
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 接口状态 - 每个CAN接口的 up/down 状态与收发计数（GET /api/status）
+////////////////////////////////////////////////////////////////////////////////
+//
+// up/down 取自内核的接口标志（ip link set canX up/down），每次查询时实时读取；
+// 计数从桥接服务启动开始累计，接口 down 期间写入失败的帧计入 failed。
+
+// InterfaceCounters 单个接口的收发计数
+type InterfaceCounters struct {
+	Sent        int64      `json:"sent"`   // 收到的写入请求帧数
+	OK          int64      `json:"ok"`     // 写入成功
+	Failed      int64      `json:"failed"` // 写入失败（未配置、打开失败、写入出错）
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	LastOKAt    *time.Time `json:"last_ok_at,omitempty"`
+}
+
+// InterfaceStatus 单个接口的状态
+type InterfaceStatus struct {
+	Name   string `json:"name"`
+	Exists bool   `json:"exists"` // 系统中存在该接口
+	Up     bool   `json:"up"`     // 接口已启用
+	Open   bool   `json:"open"`   // 桥接服务已打开套接字
+	InterfaceCounters
+}
+
+// Status 桥接服务状态
+type Status struct {
+	StartedAt  time.Time         `json:"started_at"`
+	Interfaces []InterfaceStatus `json:"interfaces"`
+}
+
+// record 记录一帧的写入结果（调用方持有锁）
+func (b *Bridge) record(name string, err error) {
+	counters := b.counters[name]
+	if counters == nil {
+		counters = &InterfaceCounters{}
+		b.counters[name] = counters
+	}
+	now := time.Now()
+	counters.Sent++
+	if err != nil {
+		counters.Failed++
+		counters.LastError = err.Error()
+		counters.LastErrorAt = &now
+		return
+	}
+	counters.OK++
+	counters.LastOKAt = &now
+}
+
+// Status 查询各接口状态（配置的接口和收到过请求的接口）
+func (b *Bridge) Status() Status {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	names := make(map[string]bool)
+	for name := range b.interfaces {
+		names[name] = true
+	}
+	for name := range b.counters {
+		names[name] = true
+	}
+
+	status := Status{StartedAt: b.startedAt, Interfaces: []InterfaceStatus{}}
+	for name := range names {
+		item := InterfaceStatus{Name: name, Open: b.sockets[name] != nil}
+		if counters := b.counters[name]; counters != nil {
+			item.InterfaceCounters = *counters
+		}
+		if iface, err := net.InterfaceByName(name); err == nil {
+			item.Exists = true
+			item.Up = iface.Flags&net.FlagUp != 0
+		}
+		status.Interfaces = append(status.Interfaces, item)
+	}
+	sort.Slice(status.Interfaces, func(i, j int) bool {
+		return status.Interfaces[i].Name < status.Interfaces[j].Name
+	})
+	return status
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 硬件I/O录制与回放 - 记录实际发往各CAN接口和气泵串口的数据，并可按原时序重放
+////////////////////////////////////////////////////////////////////////////////
+//
+// 录制文件为 JSONL：第一行是文件头（format/version/开始时间/来源），之后每行一条I/O记录：
+//   {"t_ms":12.345,"kind":"can","iface":"can3","id":40,"data":"0001ff","status":200,"latency_ms":1.8}
+//   {"t_ms":13.001,"kind":"serial","cmd":"on","result":"OK","latency_ms":0.05}
+// t_ms 为发出时刻（相对录制开始），异步CAN请求在收到响应后才写入，所以文件中的行不保证按时间排序，
+// 回放前按 t_ms 排序。只记录真正发出的I/O：因停止/急停/气泵保护而拒绝的命令不写入。
+//
+// 启用方式：配置 capture.enabled 时每个Web演奏会话录制到 <dir>/<会话ID>.capture.jsonl（写入演奏报告）；
+// 命令行 -capture 文件 为 -exec/-in/-replay 模式指定录制文件。回放：-replay 文件。
+
+const (
+	captureFormat     = "gosks-capture"
+	captureVersion    = 1
+	defaultCaptureDir = "captures"
+)
+
+// 录制记录类型
+const (
+	CaptureKindCAN    = "can"
+	CaptureKindSerial = "serial"
+)
+
+// CaptureConfig 硬件I/O录制配置
+type CaptureConfig struct {
+	Enabled bool   `yaml:"enabled"` // Web演奏会话是否自动录制
+	Dir     string `yaml:"dir"`     // 录制文件目录（默认 captures）
+}
+
+// CaptureHeader 录制文件头
+type CaptureHeader struct {
+	Format       string    `json:"format"`
+	Version      int       `json:"version"`
+	StartedAt    time.Time `json:"started_at"`
+	Source       string    `json:"source"` // 来源（会话ID或执行文件）
+	CanBridgeURL string    `json:"can_bridge_url"`
+}
+
+// CaptureEntry 一条I/O记录
+type CaptureEntry struct {
+	TMS       float64 `json:"t_ms"` // 发出时刻（相对录制开始，毫秒）
+	Kind      string  `json:"kind"` // can/serial
+	Interface string  `json:"iface,omitempty"`
+	ID        uint32  `json:"id,omitempty"`
+	Data      string  `json:"data,omitempty"`   // CAN数据（十六进制）
+	Status    int     `json:"status,omitempty"` // CAN桥接服务HTTP状态码（请求失败时为0）
+	Cmd       string  `json:"cmd,omitempty"`    // 串口命令（不含换行）
+	Result    string  `json:"result,omitempty"` // 串口返回（异步发送为 OK）
+	LatencyMS float64 `json:"latency_ms"`       // CAN为HTTP往返耗时，串口为写入（同步命令含读取）耗时
+	Error     string  `json:"error,omitempty"`
+}
+
+// CaptureRecorder 硬件I/O录制器（同一时间只录制一个文件）
+type CaptureRecorder struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	path   string
+	start  time.Time
+	count  int
+}
+
+// 全局录制器（未开始录制时所有记录调用直接返回）
+var globalCapture = &CaptureRecorder{}
+
+// Start 开始录制到指定文件
+func (cr *CaptureRecorder) Start(path, source string, cfg Config) error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cr.file != nil {
+		return fmt.Errorf("已在录制 %s", cr.path)
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("创建录制目录失败: %v", err)
+		}
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("创建录制文件失败: %v", err)
+	}
+
+	cr.start = time.Now()
+	header, _ := json.Marshal(CaptureHeader{
+		Format:       captureFormat,
+		Version:      captureVersion,
+		StartedAt:    cr.start,
+		Source:       source,
+		CanBridgeURL: cfg.CanBridgeURL,
+	})
+	cr.file = file
+	cr.writer = bufio.NewWriter(file)
+	cr.writer.Write(append(header, '\n'))
+	cr.path = path
+	cr.count = 0
+	fmt.Printf("🎙️  开始录制硬件I/O: %s\n", path)
+	return nil
+}
+
+// Stop 结束录制，返回录制文件路径和记录条数（未在录制时返回空路径）
+func (cr *CaptureRecorder) Stop() (string, int) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cr.file == nil {
+		return "", 0
+	}
+	cr.writer.Flush()
+	cr.file.Close()
+	path, count := cr.path, cr.count
+	cr.file, cr.writer, cr.path = nil, nil, ""
+	fmt.Printf("🎙️  硬件I/O录制结束: %s（%d条）\n", path, count)
+	return path, count
+}
+
+// Active 是否正在录制
+func (cr *CaptureRecorder) Active() bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.file != nil
+}
+
+// RecordCAN 记录一条CAN消息（sentAt 为请求发出时刻，status 为0表示请求失败）
+func (cr *CaptureRecorder) RecordCAN(sentAt time.Time, msg CanMessage, status int, err error) {
+	entry := CaptureEntry{
+		Kind:      CaptureKindCAN,
+		Interface: msg.Interface,
+		ID:        msg.Id,
+		Data:      hex.EncodeToString(msg.Data),
+		Status:    status,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	cr.record(sentAt, entry)
+}
+
+// RecordSerial 记录一条气泵串口命令
+func (cr *CaptureRecorder) RecordSerial(sentAt time.Time, cmd, result string) {
+	cr.record(sentAt, CaptureEntry{
+		Kind:   CaptureKindSerial,
+		Cmd:    strings.TrimSpace(cmd),
+		Result: strings.TrimSpace(result),
+	})
+}
+
+// record 写入一条记录（耗时为 sentAt 到现在）
+func (cr *CaptureRecorder) record(sentAt time.Time, entry CaptureEntry) {
+	now := time.Now()
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cr.file == nil {
+		return
+	}
+	entry.TMS = float64(sentAt.Sub(cr.start).Microseconds()) / 1000.0
+	entry.LatencyMS = float64(now.Sub(sentAt).Microseconds()) / 1000.0
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	cr.writer.Write(append(line, '\n'))
+	cr.count++
+}
+
+// sessionCapturePath Web演奏会话的录制文件路径
+func sessionCapturePath(cfg Config, sessionID string) string {
+	dir := cfg.Capture.Dir
+	if dir == "" {
+		dir = defaultCaptureDir
+	}
+	return filepath.Join(dir, sessionID+".capture.jsonl")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// 回放
+////////////////////////////////////////////////////////////////////////////////
+
+// LoadCapture 读取录制文件（记录按 t_ms 排序）
+func LoadCapture(path string) (*CaptureHeader, []CaptureEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开录制文件失败: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("录制文件为空: %s", path)
+	}
+	var header CaptureHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != captureFormat {
+		return nil, nil, fmt.Errorf("不是录制文件: %s", path)
+	}
+	if header.Version > captureVersion {
+		return nil, nil, fmt.Errorf("录制文件版本 %d 高于支持的版本 %d", header.Version, captureVersion)
+	}
+
+	var entries []CaptureEntry
+	line := 1
+	for scanner.Scan() {
+		line++
+		var entry CaptureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, nil, fmt.Errorf("第%d行解析失败: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("读取录制文件失败: %v", err)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].TMS < entries[j].TMS })
+	return &header, entries, nil
+}
+
+// ReplayCapture 按原时序重新发送录制的I/O（CAN帧发往当前配置的桥接服务，dry_run 时不发CAN）
+// ctx 取消或急停时立即停止并关闭气泵
+func ReplayCapture(ctx context.Context, cfg Config, path string) error {
+	header, entries, err := LoadCapture(path)
+	if err != nil {
+		return err
+	}
+
+	canCount, serialCount := 0, 0
+	for _, entry := range entries {
+		if entry.Kind == CaptureKindCAN {
+			canCount++
+		} else {
+			serialCount++
+		}
+	}
+	durationMS := 0.0
+	if len(entries) > 0 {
+		durationMS = entries[len(entries)-1].TMS
+	}
+	fmt.Printf("⏯️  回放录制: %s\n", path)
+	fmt.Printf("   来源: %s（录制于 %s）\n", header.Source, header.StartedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("   CAN消息: %d条, 串口命令: %d条, 时长: %.2fs\n", canCount, serialCount, durationMS/1000.0)
+
+	if err := globalEStop.Check(); err != nil {
+		return err
+	}
+	if err := CanBridgePreflight(cfg); err != nil {
+		return err
+	}
+	ctx, cancel := globalEStop.WithEStop(ctx)
+	defer cancel()
+
+	utils := NewUtils()
+	pumpGuard := globalPumpGuard.Load()
+	pumpGuard.PlaybackStarted()
+	defer pumpGuard.PlaybackStopped()
+
+	start := time.Now()
+	for _, entry := range entries {
+		scheduled := start.Add(time.Duration(entry.TMS * float64(time.Millisecond)))
+		pumpGuard.Feed(scheduled)
+		if wait := time.Until(scheduled); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				if globalPumpController != nil {
+					GlobalPumpOff()
+				}
+				return playbackCause(ctx)
+			}
+		}
+
+		switch entry.Kind {
+		case CaptureKindCAN:
+			if cfg.DryRun {
+				continue
+			}
+			data, err := hex.DecodeString(entry.Data)
+			if err != nil {
+				fmt.Printf("⚠️  @%.1fms CAN数据无效: %v\n", entry.TMS, err)
+				continue
+			}
+			utils.ForwardToCanServiceAsync(ctx, cfg.CanBridgeURL, CanMessage{Interface: entry.Interface, Id: entry.ID, Data: data}, nil)
+		case CaptureKindSerial:
+			if globalPumpController != nil {
+				GlobalPumpSendContext(ctx, entry.Cmd)
+			}
+		}
+	}
+
+	if globalPumpController != nil {
+		GlobalPumpOff()
+	}
+	fmt.Printf("✅ 回放完成，实际用时 %.2fs\n", time.Since(start).Seconds())
+	return nil
+}
@@ -28,13 +28,44 @@ func (cli *CLIExecutor) PrintUsage() {
 	fmt.Println("  1. 执行预计算序列（最快，推荐）:")
 	fmt.Println("    ./newsksgo -json exec/青花瓷-葫芦丝-4min-108_sn_108_30.exec.json")
 	fmt.Println("    ./newsksgo -exec exec/茉莉花_sks_120_30.exec.json")
+	fmt.Println("    ./newsksgo -exec exec/茉莉花_sks_120_30.exec.json -from-bar 17 -to-bar 24 -loop 3")
+	fmt.Println("    → 排练：从第17小节演奏到第24小节，循环3遍（-loop -1 循环直到中断）")
 	fmt.Println("\n  2. 预处理模式（生成exec文件）:")
 	fmt.Println("    ./newsksgo -preprocess -in trsmusic/青花瓷-葫芦丝-4min-108.json -instrument sn -bpm 108 -tongue 30")
-	fmt.Println("    → 自动生成: exec/青花瓷-葫芦丝-4min-108_sn_108_30.exec.json")
+	fmt.Println("    → 自动生成: exec/青花瓷-葫芦丝-4min-108_sn_108_30_1a2b3c4d.exec.json")
 	fmt.Println("\n  3. 自动预处理+执行模式（一步到位）:")
 	fmt.Println("    ./newsksgo -in trsmusic/test.json -instrument sks -bpm 120 -tongue 30")
-	fmt.Println("    → 自动预处理并立即演奏")
-	fmt.Println("\n  4. Web服务模式:")
+	fmt.Println("    → 自动预处理并立即演奏（时间轴、指法、配置和参数均未变化时复用已有exec文件）")
+	fmt.Println("\n  4. 升级旧版本执行序列文件:")
+	fmt.Println("    ./newsksgo -migrate exec/茉莉花_sks_120_30.exec.json")
+	fmt.Println("\n  5. 转换为紧凑二进制格式（体积更小、加载更快，-exec 自动识别格式）:")
+	fmt.Println("    ./newsksgo -convert exec/茉莉花_sks_120_30.exec.json")
+	fmt.Println("    → 生成: exec/茉莉花_sks_120_30.exec.bin（反向转换: -convert xxx.exec.bin -out xxx.exec.json）")
+	fmt.Println("\n  6. 查看/对比执行序列:")
+	fmt.Println("    ./newsksgo -inspect exec/茉莉花_sks_120_30.exec.json")
+	fmt.Println("    ./newsksgo -diff exec/旧.exec.json exec/新.exec.json")
+	fmt.Println("    → 按时间对齐两个序列的事件（相差≤50ms视为同一事件），报告音符、时间、帧字节、气泵命令的变化和新增/删除的事件")
+	fmt.Println("    → Web查看: http://localhost:1105/inspect")
+	fmt.Println("\n  7. 多机合奏（协调者）:")
+	fmt.Println("    ./newsksgo -coordinator -exec 茉莉花_sks_120_30.exec.json -peers 192.168.1.21:1105,192.168.1.22:1105")
+	fmt.Println("    → 各成员预加载同名执行文件，并在统一的挂钟时刻开始（成员需以Web服务模式运行）")
+	fmt.Println("    ./newsksgo -coordinator -score trsmusic/合奏总谱.json -bpm 100")
+	fmt.Println("    → 按配置 ensemble.assignments 把各声部分发给对应机器人，用其自己的指法编译后统一开始")
+	fmt.Println("\n  8. 录制与回放硬件I/O:")
+	fmt.Println("    ./newsksgo -exec exec/茉莉花_sks_120_30.exec.json -capture captures/茉莉花.capture.jsonl")
+	fmt.Println("    ./newsksgo -replay captures/茉莉花.capture.jsonl")
+	fmt.Println("    → 按原时序重新发送录制的CAN消息和气泵命令（配置 capture.enabled 时Web演奏自动录制）")
+	fmt.Println("\n  9. 内置CAN桥接服务（代替独立的桥接服务，写入 can0-can3）:")
+	fmt.Println("    ./newsksgo -bridge")
+	fmt.Println("    → 监听 can_bridge_url 的端口（可用 bridge.listen 覆盖），接口状态与计数: GET /api/status")
+	fmt.Println("\n  10. 手臂（黑臂）:")
+	fmt.Println("    ./newsksgo -arm hlsup")
+	fmt.Println("    ./newsksgo -exec exec/茉莉花_sks_120_30.exec.json -arms")
+	fmt.Println("    → 抬臂(hlsup) → 防撞预姿态 → 演奏 → 释放手指 → 落臂(hlsdown)，中途停止仍会释放并落臂，急停时不再移动")
+	fmt.Println("\n  11. 演奏前后姿态序列（防止手撞击管身）:")
+	fmt.Println("    ./newsksgo -posture sn")
+	fmt.Println("    → 打印 posture.sn 的 before/after 每一步与动作的手指，并检查顺序约束（如拇指旋转先于拇指弯曲），不需要硬件")
+	fmt.Println("\n  12. Web服务模式:")
 	fmt.Println("    ./newsksgo")
 	fmt.Println("    ./newsksgo -config config.yaml")
 	fmt.Println("\n参数说明:")
@@ -42,7 +73,7 @@ func (cli *CLIExecutor) PrintUsage() {
 	fmt.Println("\n完整示例:")
 	fmt.Println("  # 预处理：生成exec文件（自动命名）")
 	fmt.Println("  ./newsksgo -preprocess -in trsmusic/青花瓷-葫芦丝-4min-108.json -instrument sn -bpm 108 -tongue 30")
-	fmt.Println("  → 生成文件: exec/青花瓷-葫芦丝-4min-108_sn_108_30.exec.json")
+	fmt.Println("  → 生成文件: exec/青花瓷-葫芦丝-4min-108_sn_108_30_1a2b3c4d.exec.json")
 	fmt.Println("")
 	fmt.Println("  # 执行预计算的音乐序列（最快）")
 	fmt.Println("  ./newsksgo -json exec/青花瓷-葫芦丝-4min-108_sn_108_30.exec.json")
@@ -53,10 +84,11 @@ func (cli *CLIExecutor) PrintUsage() {
 	fmt.Println("  # 启动Web服务（默认监听8088端口）")
 	fmt.Println("  ./newsksgo")
 	fmt.Println("\n文件命名规则:")
-	fmt.Println("  格式: exec/{原文件名}_{乐器类型}_{BPM}_{吐音延迟}.exec.json")
-	fmt.Println("  示例: exec/青花瓷-葫芦丝-4min-108_sn_108_30.exec.json")
+	fmt.Println("  格式: exec/{原文件名}_{乐器类型}_{BPM}_{吐音延迟}_{设置哈希}.exec.json")
+	fmt.Println("  示例: exec/青花瓷-葫芦丝-4min-108_sn_108_30_1a2b3c4d.exec.json")
 	fmt.Println("        └─ 青花瓷-葫芦丝-4min-108: 原音乐文件名")
 	fmt.Println("        └─ sn: 乐器类型 (sn=唢呐, sks=萨克斯)")
 	fmt.Println("        └─ 108: BPM (每分钟节拍数)")
 	fmt.Println("        └─ 30: 吐音延迟 (毫秒)")
+	fmt.Println("        └─ 1a2b3c4d: 换指/表情/换气等设置的哈希（设置不同的编译结果分别保存）")
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 时钟同步模块 - 估计本机与领队机器人之间的时钟偏差与漂移
+////////////////////////////////////////////////////////////////////////////////
+//
+// 协议（NTP风格，基于HTTP）：
+//
+//	客户端记录发送时刻 t0，领队在 /api/clock 返回收到请求时刻 t1 与发送响应时刻 t2，客户端记录收到时刻 t3
+//	偏差 offset = ((t1 - t0) + (t2 - t3)) / 2   （领队时间 - 本机时间）
+//	往返 delay  = (t3 - t0) - (t2 - t1)
+//
+// 每轮连续测量若干次，取往返时间最小的一次（排队延迟最少、最对称）；
+// 保留最近若干轮结果，对"偏差-本机时间"做最小二乘拟合得到漂移，在两轮测量之间按漂移外推。
+
+const (
+	clockBurstSize      = 8                // 每轮测量次数
+	clockWindowSize     = 32               // 参与拟合的测量轮数
+	clockMinDriftSpan   = 10 * time.Second // 测量跨度达到该值后才估计漂移
+	defaultClockSyncInt = 1000             // 默认测量间隔（毫秒）
+)
+
+// globalClockSync 全局时钟同步器（未配置领队时为nil，即本机就是时间基准）
+var globalClockSync *ClockSync
+
+// ClockResponse /api/clock 的响应
+type ClockResponse struct {
+	ReceiveNS int64 `json:"t1"` // 收到请求时刻（Unix纳秒）
+	SendNS    int64 `json:"t2"` // 发送响应时刻（Unix纳秒）
+}
+
+// clockSample 一轮测量的结果
+type clockSample struct {
+	local    time.Time     // 测量时的本机时间（请求中点）
+	offsetNS float64       // 领队时间 - 本机时间（纳秒）
+	delay    time.Duration // 往返时间
+}
+
+// ClockSyncStatus 时钟同步状态
+type ClockSyncStatus struct {
+	Leader     string  `json:"leader"`       // 领队地址
+	Synced     bool    `json:"synced"`       // 是否已同步（最近有有效测量）
+	OffsetMS   float64 `json:"offset_ms"`    // 当前偏差估计（毫秒，领队-本机）
+	DriftPPM   float64 `json:"drift_ppm"`    // 漂移估计（百万分之一）
+	DelayMS    float64 `json:"delay_ms"`     // 最近一轮的最小往返时间（毫秒）
+	Samples    int     `json:"samples"`      // 参与拟合的测量轮数
+	LastSyncAt string  `json:"last_sync_at"` // 最近一次有效测量时间
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// ClockSync 时钟同步器
+type ClockSync struct {
+	leader   string
+	interval time.Duration
+	client   *http.Client
+
+	mutex     sync.RWMutex
+	samples   []clockSample
+	baseNS    float64   // 拟合结果：参考时刻的偏差
+	driftRate float64   // 拟合结果：偏差随本机时间的变化率（纳秒/纳秒）
+	refTime   time.Time // 拟合参考时刻
+	lastError string
+	stopChan  chan struct{}
+}
+
+// NewClockSync 创建新的时钟同步器
+func NewClockSync(leader string, intervalMS int) *ClockSync {
+	if intervalMS <= 0 {
+		intervalMS = defaultClockSyncInt
+	}
+	return &ClockSync{
+		leader:   leader,
+		interval: time.Duration(intervalMS) * time.Millisecond,
+		client:   &http.Client{Timeout: 500 * time.Millisecond},
+		stopChan: make(chan struct{}),
+	}
+}
+
+// StartGlobalClockSync 按配置启动全局时钟同步（clock.leader 为空表示本机即领队，不启动）
+func StartGlobalClockSync(cfg Config) {
+	if cfg.Clock.Leader == "" {
+		return
+	}
+	globalClockSync = NewClockSync(cfg.Clock.Leader, cfg.Clock.IntervalMS)
+	globalClockSync.Start()
+	fmt.Printf("🕒 时钟同步已启动，领队: %s\n", cfg.Clock.Leader)
+}
+
+// LeaderNow 返回当前的领队时间（未启用时钟同步时为本机时间）
+func LeaderNow() time.Time {
+	if globalClockSync == nil {
+		return time.Now()
+	}
+	return globalClockSync.LeaderTime(time.Now())
+}
+
+// LeaderToLocal 将领队时间换算为本机时间（未启用时钟同步时原样返回）
+func LeaderToLocal(leaderTime time.Time) time.Time {
+	if globalClockSync == nil {
+		return leaderTime
+	}
+	return globalClockSync.LocalTime(leaderTime)
+}
+
+// Start 启动后台测量goroutine（首轮立即测量）
+func (cs *ClockSync) Start() {
+	go func() {
+		ticker := time.NewTicker(cs.interval)
+		defer ticker.Stop()
+		for {
+			cs.measure()
+			select {
+			case <-ticker.C:
+			case <-cs.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止后台测量
+func (cs *ClockSync) Stop() {
+	close(cs.stopChan)
+}
+
+// WaitSynced 等待首次有效测量（最多等待timeout）
+func (cs *ClockSync) WaitSynced(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		cs.mutex.RLock()
+		n := len(cs.samples)
+		cs.mutex.RUnlock()
+		if n > 0 {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+// measure 进行一轮测量并更新拟合结果
+func (cs *ClockSync) measure() {
+	var best *clockSample
+	var lastErr error
+	for i := 0; i < clockBurstSize; i++ {
+		sample, err := cs.exchange()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if best == nil || sample.delay < best.delay {
+			best = &sample
+		}
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if best == nil {
+		cs.lastError = fmt.Sprintf("测量失败: %v", lastErr)
+		return
+	}
+	cs.lastError = ""
+	cs.samples = append(cs.samples, *best)
+	if len(cs.samples) > clockWindowSize {
+		cs.samples = cs.samples[len(cs.samples)-clockWindowSize:]
+	}
+	cs.fit()
+}
+
+// exchange 与领队进行一次时间交换
+func (cs *ClockSync) exchange() (clockSample, error) {
+	t0 := time.Now()
+	resp, err := cs.client.Get(peerURL(cs.leader, "/api/clock"))
+	if err != nil {
+		return clockSample{}, err
+	}
+	defer resp.Body.Close()
+
+	var clock ClockResponse
+	if err := json.NewDecoder(resp.Body).Decode(&clock); err != nil {
+		return clockSample{}, fmt.Errorf("解析响应失败: %v", err)
+	}
+	t3 := time.Now()
+
+	t0ns, t3ns := float64(t0.UnixNano()), float64(t3.UnixNano())
+	t1ns, t2ns := float64(clock.ReceiveNS), float64(clock.SendNS)
+	return clockSample{
+		local:    t0.Add(t3.Sub(t0) / 2),
+		offsetNS: ((t1ns - t0ns) + (t2ns - t3ns)) / 2,
+		delay:    time.Duration((t3ns - t0ns) - (t2ns - t1ns)),
+	}, nil
+}
+
+// fit 对测量窗口做最小二乘拟合（调用方持有写锁）
+func (cs *ClockSync) fit() {
+	n := len(cs.samples)
+	latest := cs.samples[n-1]
+	cs.refTime = latest.local
+
+	span := latest.local.Sub(cs.samples[0].local)
+	if n < 4 || span < clockMinDriftSpan {
+		// 跨度不足时只用最新偏差，不估计漂移
+		cs.baseNS = latest.offsetNS
+		cs.driftRate = 0
+		return
+	}
+
+	var sumX, sumY, sumXX, sumXY float64
+	for _, s := range cs.samples {
+		x := float64(s.local.Sub(cs.refTime))
+		sumX += x
+		sumY += s.offsetNS
+		sumXX += x * x
+		sumXY += x * s.offsetNS
+	}
+	fn := float64(n)
+	denominator := fn*sumXX - sumX*sumX
+	if denominator == 0 {
+		cs.baseNS = latest.offsetNS
+		cs.driftRate = 0
+		return
+	}
+	cs.driftRate = (fn*sumXY - sumX*sumY) / denominator
+	cs.baseNS = (sumY - cs.driftRate*sumX) / fn
+}
+
+// offsetAt 本机时刻 local 的偏差估计（纳秒）
+func (cs *ClockSync) offsetAt(local time.Time) float64 {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	if len(cs.samples) == 0 {
+		return 0
+	}
+	return cs.baseNS + cs.driftRate*float64(local.Sub(cs.refTime))
+}
+
+// LeaderTime 将本机时间换算为领队时间
+func (cs *ClockSync) LeaderTime(local time.Time) time.Time {
+	return local.Add(time.Duration(cs.offsetAt(local)))
+}
+
+// LocalTime 将领队时间换算为本机时间
+// 偏差在本机时刻上定义，先按领队时刻近似求一次，再用求得的本机时刻修正（漂移极小，一次迭代足够）
+func (cs *ClockSync) LocalTime(leader time.Time) time.Time {
+	local := leader.Add(-time.Duration(cs.offsetAt(leader)))
+	return leader.Add(-time.Duration(cs.offsetAt(local)))
+}
+
+// Status 返回时钟同步状态
+func (cs *ClockSync) Status() ClockSyncStatus {
+	now := time.Now()
+	offset := cs.offsetAt(now)
+
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	status := ClockSyncStatus{
+		Leader:    cs.leader,
+		OffsetMS:  offset / 1e6,
+		DriftPPM:  cs.driftRate * 1e6,
+		Samples:   len(cs.samples),
+		LastError: cs.lastError,
+	}
+	if n := len(cs.samples); n > 0 {
+		latest := cs.samples[n-1]
+		status.DelayMS = float64(latest.delay.Microseconds()) / 1000.0
+		status.LastSyncAt = latest.local.Format("15:04:05.000")
+		// 超过5个测量周期没有有效测量视为失去同步（仍按漂移外推）
+		status.Synced = now.Sub(latest.local) < 5*cs.interval
+	}
+	if math.IsNaN(status.DriftPPM) {
+		status.DriftPPM = 0
+	}
+	return status
+}
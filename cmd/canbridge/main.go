@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gosks/canbridge"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 独立的CAN桥接服务 - 本地替代原桥接服务（支持批量发送），写入 SocketCAN/vcan
+////////////////////////////////////////////////////////////////////////////////
+//
+// 用法：
+//   go run ./cmd/canbridge -addr :5260 -ifaces can0,can1,can2,can3
+//   主程序也可直接以 ./newsksgo -bridge 运行同一服务（读取 config.yaml 的 bridge 配置）
+//   测试：sudo ip link add dev vcan0 type vcan && sudo ip link set up vcan0，然后 -ifaces vcan0 并用 candump vcan0 查看
+
+func main() {
+	addr := flag.String("addr", ":5260", "监听地址")
+	ifaces := flag.String("ifaces", "can0,can1,can2,can3", "允许写入的CAN接口，逗号分隔（留空不限制）")
+	flag.Parse()
+
+	var names []string
+	for _, name := range strings.Split(*ifaces, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	bridge := canbridge.NewBridge(names)
+	defer bridge.Close()
+
+	fmt.Printf("🔌 CAN桥接服务监听 %s，接口: %s\n", *addr, strings.Join(names, ", "))
+	if err := http.ListenAndServe(*addr, bridge.Handler()); err != nil {
+		fmt.Printf("❌ CAN桥接服务退出: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 多机合奏协调者 - 预加载各机器人的执行文件并下发统一的开始时刻
+////////////////////////////////////////////////////////////////////////////////
+
+// defaultEnsembleStartDelayMS 默认的统一开始延迟（毫秒）
+const defaultEnsembleStartDelayMS = 2000
+
+// PeerStatus 合奏成员状态
+type PeerStatus struct {
+	Name      string          `json:"name"`             // 名称
+	Host      string          `json:"host"`             // 地址
+	ExecFile  string          `json:"exec_file"`        // 执行文件
+	Reachable bool            `json:"reachable"`        // 是否可达
+	Preloaded bool            `json:"preloaded"`        // 是否已预加载
+	Scheduled bool            `json:"scheduled"`        // 是否已接受开始时刻
+	RTTMS     float64         `json:"rtt_ms"`           // 最近一次请求往返时间（毫秒）
+	Error     string          `json:"error,omitempty"`  // 错误信息
+	Status    *PlaybackStatus `json:"status,omitempty"` // 成员上报的播放状态
+}
+
+// EnsembleCoordinator 合奏协调者
+// 流程：并发预加载（各成员加载/按需重新编译执行文件）→ 按最大往返时间确定未来的统一开始时刻 → 并发下发
+// 各成员的执行引擎在该时刻开始，因此网络延迟不再影响起奏时间差；时刻以领队时间表示，各成员通过时钟同步换算
+type EnsembleCoordinator struct {
+	peers      []EnsemblePeer
+	startDelay time.Duration
+	client     *http.Client
+	expression ExpressionSettings // 分发声部时统一使用的表情设置
+	breath     BreathConfig       // 分发声部时统一使用的换气设置
+}
+
+// NewEnsembleCoordinator 创建新的合奏协调者
+func NewEnsembleCoordinator(cfg Config, peers []EnsemblePeer) *EnsembleCoordinator {
+	delayMS := cfg.Ensemble.StartDelayMS
+	if delayMS <= 0 {
+		delayMS = defaultEnsembleStartDelayMS
+	}
+	return &EnsembleCoordinator{
+		peers:      peers,
+		startDelay: time.Duration(delayMS) * time.Millisecond,
+		client:     &http.Client{Timeout: 30 * time.Second}, // 预加载可能触发重新编译
+		expression: cfg.Expression,
+		breath:     cfg.Breath,
+	}
+}
+
+// ParsePeerList 解析命令行指定的成员列表（逗号分隔的 host:port）
+func ParsePeerList(list string) []EnsemblePeer {
+	var peers []EnsemblePeer
+	for _, host := range strings.Split(list, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		peers = append(peers, EnsemblePeer{Name: host, Host: host})
+	}
+	return peers
+}
+
+// Peers 返回合奏成员列表
+func (ec *EnsembleCoordinator) Peers() []EnsemblePeer {
+	return ec.peers
+}
+
+// peerExecFile 成员使用的执行文件名（成员单独配置的优先）
+func peerExecFile(peer EnsemblePeer, execFile string) string {
+	if peer.ExecFile != "" {
+		return peer.ExecFile
+	}
+	if execFile == "" {
+		return ""
+	}
+	return filepath.Base(execFile)
+}
+
+// peerURL 拼接成员API地址
+func peerURL(host, path string) string {
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/") + path
+}
+
+// call 调用成员API，返回往返时间
+func (ec *EnsembleCoordinator) call(method, host, path string, body, out any) (time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("序列化请求失败: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, peerURL(host, path), reader)
+	if err != nil {
+		return 0, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := ec.client.Do(req)
+	rtt := time.Since(start)
+	if err != nil {
+		return rtt, fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return rtt, fmt.Errorf("读取响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return rtt, fmt.Errorf("HTTP %d: %s", resp.StatusCode, apiErr.Error)
+		}
+		return rtt, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return rtt, fmt.Errorf("解析响应失败: %v", err)
+		}
+	}
+	return rtt, nil
+}
+
+// forEachPeer 并发对所有成员执行操作，结果按成员顺序返回
+func (ec *EnsembleCoordinator) forEachPeer(execFile string, fn func(peer EnsemblePeer, status *PeerStatus)) []PeerStatus {
+	statuses := make([]PeerStatus, len(ec.peers))
+	var wg sync.WaitGroup
+	for i, peer := range ec.peers {
+		statuses[i] = PeerStatus{Name: peer.Name, Host: peer.Host, ExecFile: peerExecFile(peer, execFile)}
+		wg.Add(1)
+		go func(peer EnsemblePeer, status *PeerStatus) {
+			defer wg.Done()
+			fn(peer, status)
+		}(peer, &statuses[i])
+	}
+	wg.Wait()
+	return statuses
+}
+
+// PartCompileResult 成员编译声部的结果（/api/parts/compile 的响应）
+type PartCompileResult struct {
+	ExecFile        string   `json:"exec_file"`         // exec目录下的执行文件名
+	Recompiled      bool     `json:"recompiled"`        // 是否重新编译
+	Reasons         []string `json:"reasons"`           // 重新编译的原因
+	TotalEvents     int      `json:"total_events"`      // 事件数
+	TotalDurationMS float64  `json:"total_duration_ms"` // 总时长（毫秒）
+}
+
+// DistributeParts 将多声部总谱按分配表分发给各机器人编译
+// 每台机器人用自己的指法映射与力度配置编译分到的声部。为保证各声部的时间轴一致，所有声部使用同一个速度图
+// （总谱元数据共用，BPM 取速度图的起始速度），表情与换气设置统一使用协调者的配置（覆盖成员本机配置）；
+// 乐句尾延长按各声部自己的空拍位置延长，会使声部之间逐渐错开，合奏时固定关闭。
+// 成功后协调者的成员列表替换为各声部对应的机器人与执行文件
+func (ec *EnsembleCoordinator) DistributeParts(scoreFile string, assignments map[string]PartAssignment, bpm float64, tonguingDelay int) ([]EnsemblePeer, error) {
+	raw, err := os.ReadFile(scoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取总谱失败: %v", err)
+	}
+	var score TimelineFile
+	if err := json.Unmarshal(raw, &score); err != nil {
+		return nil, fmt.Errorf("解析总谱失败: %v", err)
+	}
+	if len(score.Parts) == 0 {
+		return nil, fmt.Errorf("%s 不是多声部总谱（缺少 parts）", scoreFile)
+	}
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("没有配置声部分配（ensemble.assignments）")
+	}
+
+	// 所有声部共用一个速度图：命令行 > 速度图起始速度 > 总谱元数据 bpm > 默认60
+	tempoMap, err := ParseTempoMap(score.Meta)
+	if err != nil {
+		return nil, fmt.Errorf("解析总谱速度图失败: %v", err)
+	}
+	if bpm <= 0 {
+		if tempoMap != nil {
+			bpm = tempoMap.InitialBPM()
+		} else if metaBPM, ok := NewUtils().ConvertToFloat(score.Meta["bpm"]); ok && metaBPM > 0 {
+			bpm = metaBPM
+		} else {
+			bpm = 60
+		}
+	}
+	expression := ec.expression
+	expression.PhraseEndStretch = 0
+
+	// 检查分配表与各声部总拍数（拍数不一致时各声部无法同时结束）
+	utils := NewUtils()
+	partBeats := map[string]float64{}
+	for _, name := range score.PartNames() {
+		for _, item := range score.Parts[name] {
+			if len(item) >= 2 {
+				if beats, ok := utils.ConvertToFloat(item[1]); ok {
+					partBeats[name] += beats
+				}
+			}
+		}
+		if _, ok := assignments[name]; !ok {
+			fmt.Printf("⚠️  声部 %s 没有分配机器人，将不会演奏\n", name)
+		}
+	}
+	parts := make([]string, 0, len(assignments))
+	for part := range assignments {
+		if _, ok := score.Parts[part]; !ok {
+			return nil, fmt.Errorf("分配表中的声部 %q 不在总谱中（可用声部: %s）", part, strings.Join(score.PartNames(), ", "))
+		}
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	for _, part := range parts[1:] {
+		if math.Abs(partBeats[part]-partBeats[parts[0]]) > 1e-6 {
+			fmt.Printf("⚠️  声部总拍数不一致: %s=%.2f拍, %s=%.2f拍\n", parts[0], partBeats[parts[0]], part, partBeats[part])
+		}
+	}
+
+	fmt.Printf("🎼 分发总谱 %s（%d个声部，BPM %.1f）\n", filepath.Base(scoreFile), len(parts), bpm)
+	peers := make([]EnsemblePeer, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		assignment := assignments[part]
+		wg.Add(1)
+		go func(i int, part string) {
+			defer wg.Done()
+			var result PartCompileResult
+			_, err := ec.call(http.MethodPost, assignment.Host, "/api/parts/compile", map[string]any{
+				"score_name":     filepath.Base(scoreFile),
+				"score":          json.RawMessage(raw),
+				"part":           part,
+				"instrument":     assignment.Instrument,
+				"bpm":            bpm,
+				"tonguing_delay": tonguingDelay,
+				"expression":     expression,
+				"breath":         ec.breath,
+			}, &result)
+			if err != nil {
+				errs[i] = fmt.Errorf("声部 %s → %s 编译失败: %v", part, assignment.Host, err)
+				return
+			}
+			peers[i] = EnsemblePeer{Name: part, Host: assignment.Host, ExecFile: result.ExecFile}
+			state := "复用"
+			if result.Recompiled {
+				state = "已编译"
+			}
+			fmt.Printf("   %-10s → %-22s %-4s %s %s（%d事件, %.2fs）\n", part, assignment.Host, assignment.Instrument,
+				state, result.ExecFile, result.TotalEvents, result.TotalDurationMS/1000.0)
+		}(i, part)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	ec.peers = peers
+	return peers, nil
+}
+
+// Preload 通知所有成员预加载执行文件
+func (ec *EnsembleCoordinator) Preload(execFile string) ([]PeerStatus, error) {
+	statuses := ec.forEachPeer(execFile, func(peer EnsemblePeer, status *PeerStatus) {
+		rtt, err := ec.call(http.MethodPost, peer.Host, "/api/exec/preload", map[string]any{"exec_file": status.ExecFile}, nil)
+		status.RTTMS = float64(rtt.Microseconds()) / 1000.0
+		if err != nil {
+			status.Error = fmt.Sprintf("预加载失败: %v", err)
+			return
+		}
+		status.Reachable = true
+		status.Preloaded = true
+	})
+
+	var failed []string
+	for _, status := range statuses {
+		if !status.Preloaded {
+			failed = append(failed, fmt.Sprintf("%s(%s)", status.Name, status.Error))
+		}
+	}
+	if len(failed) > 0 {
+		return statuses, fmt.Errorf("%d个成员预加载失败: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return statuses, nil
+}
+
+// Start 预加载并下发统一开始时刻，返回开始时刻
+// 开始时刻 = 当前时间 + max(配置延迟, 3×最大往返时间 + 500ms)，保证下发请求在开始前到达所有成员
+func (ec *EnsembleCoordinator) Start(execFile string) (time.Time, []PeerStatus, error) {
+	if len(ec.peers) == 0 {
+		return time.Time{}, nil, fmt.Errorf("没有配置合奏成员")
+	}
+
+	statuses, err := ec.Preload(execFile)
+	if err != nil {
+		return time.Time{}, statuses, err
+	}
+
+	maxRTT := 0.0
+	for _, status := range statuses {
+		maxRTT = max(maxRTT, status.RTTMS)
+	}
+	delay := max(ec.startDelay, time.Duration(3*maxRTT*float64(time.Millisecond))+500*time.Millisecond)
+	startAt := LeaderNow().Add(delay) // 开始时刻使用领队时间，成员各自换算为本机时刻
+
+	statuses = ec.forEachPeer(execFile, func(peer EnsemblePeer, status *PeerStatus) {
+		status.Reachable = true
+		status.Preloaded = true
+		rtt, err := ec.call(http.MethodPost, peer.Host, "/api/exec/start_at", map[string]any{
+			"exec_file":   status.ExecFile,
+			"start_at_ms": startAt.UnixMilli(),
+		}, nil)
+		status.RTTMS = float64(rtt.Microseconds()) / 1000.0
+		if err != nil {
+			status.Error = fmt.Sprintf("下发开始时刻失败: %v", err)
+			return
+		}
+		status.Scheduled = true
+	})
+
+	var failed []string
+	for _, status := range statuses {
+		if !status.Scheduled {
+			failed = append(failed, status.Name)
+		}
+	}
+	if len(failed) > 0 {
+		// 部分成员未能按时开始时停止所有成员，避免残缺的合奏
+		ec.Stop()
+		return startAt, statuses, fmt.Errorf("成员 %s 未接受开始时刻，已停止全部成员", strings.Join(failed, ", "))
+	}
+	return startAt, statuses, nil
+}
+
+// Status 汇总所有成员的播放状态
+func (ec *EnsembleCoordinator) Status() []PeerStatus {
+	return ec.forEachPeer("", func(peer EnsemblePeer, status *PeerStatus) {
+		var playback PlaybackStatus
+		rtt, err := ec.call(http.MethodGet, peer.Host, "/api/playback/status", nil, &playback)
+		status.RTTMS = float64(rtt.Microseconds()) / 1000.0
+		if err != nil {
+			status.Error = err.Error()
+			return
+		}
+		status.Reachable = true
+		status.ExecFile = playback.CurrentFile
+		status.Status = &playback
+	})
+}
+
+// Stop 停止所有成员
+func (ec *EnsembleCoordinator) Stop() []PeerStatus {
+	return ec.forEachPeer("", func(peer EnsemblePeer, status *PeerStatus) {
+		rtt, err := ec.call(http.MethodPost, peer.Host, "/api/playback/stop", nil, nil)
+		status.RTTMS = float64(rtt.Microseconds()) / 1000.0
+		if err != nil {
+			status.Error = err.Error()
+			return
+		}
+		status.Reachable = true
+	})
+}
+
+// Run 命令行协调者模式：开始合奏并持续打印汇总状态，直到所有成员结束
+func (ec *EnsembleCoordinator) Run(execFile string) error {
+	fmt.Printf("🎼 合奏协调者: %d 个成员\n", len(ec.peers))
+	for _, peer := range ec.peers {
+		fmt.Printf("   %-12s %-24s %s\n", peer.Name, peer.Host, peerExecFile(peer, execFile))
+	}
+
+	startAt, statuses, err := ec.Start(execFile)
+	printPeerStatuses(statuses)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("⏰ 统一开始时刻: %s（领队时间，%v后）\n", startAt.Format("15:04:05.000"), startAt.Sub(LeaderNow()).Round(time.Millisecond))
+
+	time.Sleep(time.Until(LeaderToLocal(startAt)))
+	for {
+		time.Sleep(time.Second)
+		statuses := ec.Status()
+		printPeerStatuses(statuses)
+
+		playing := 0
+		for _, status := range statuses {
+			if status.Status != nil && status.Status.IsPlaying {
+				playing++
+			}
+		}
+		if playing == 0 {
+			fmt.Println("✅ 所有成员演奏结束")
+			return nil
+		}
+	}
+}
+
+// printPeerStatuses 打印成员状态表
+func printPeerStatuses(statuses []PeerStatus) {
+	for _, status := range statuses {
+		state := "❌"
+		detail := status.Error
+		switch {
+		case status.Status != nil && status.Status.IsPlaying:
+			state = "🎵"
+			detail = fmt.Sprintf("%.1f%% (%d/%d)", status.Status.Progress, status.Status.CurrentNote, status.Status.TotalNotes)
+		case status.Status != nil:
+			state = "⏹️"
+			detail = fmt.Sprintf("空闲 %s", status.Status.CurrentFile)
+		case status.Scheduled:
+			state = "⏰"
+			detail = "已接受开始时刻"
+		case status.Preloaded:
+			state = "📦"
+			detail = "已预加载"
+		}
+		fmt.Printf("   %s %-12s %-24s rtt=%6.1fms  %s\n", state, status.Name, status.Host, status.RTTMS, detail)
+	}
+}
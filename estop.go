@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial.v1"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 急停 - 独立于演奏goroutine的紧急停止，触发后锁定故障状态直到显式解除
+////////////////////////////////////////////////////////////////////////////////
+//
+// 触发来源：POST /api/estop、SIGUSR1（SIGINT/SIGTERM 退出前也走同一流程）、
+// 可选的GPIO输入（sysfs 轮询）和串口输入（收到一行关键字）。
+// 触发后依次：
+//   1. 取消急停上下文：演奏循环立即退出，尚未发出的异步CAN帧直接丢弃，正在发送的HTTP请求被中断，并等待它们退出
+//   2. 同步关闭气泵并等待串口应答确认（超时重试）
+//   3. 向左右手发送释放姿态（此时不会再有旧的指法帧在其后到达）
+//   4. 锁定故障：拒绝开始演奏、拒绝开启气泵、拒绝发送指法，直到 POST /api/estop/clear
+
+const (
+	defaultEStopPollMS     = 20      // 默认GPIO轮询间隔（毫秒）
+	defaultEStopKeyword    = "ESTOP" // 默认串口急停关键字
+	estopDrainTimeout      = 300 * time.Millisecond
+	estopPumpTimeout       = 300 * time.Millisecond
+	estopPumpRetries       = 3
+	estopSerialRetryPeriod = 2 * time.Second
+)
+
+// ErrEmergencyStop 急停中断演奏
+var ErrEmergencyStop = errors.New("emergency stop")
+
+// EStopConfig 急停输入配置（配置文件 estop 段，均为可选）
+type EStopConfig struct {
+	GPIOPath      string `yaml:"gpio_path"`       // GPIO值文件（如 /sys/class/gpio/gpio17/value）
+	GPIOActiveLow bool   `yaml:"gpio_active_low"` // 低电平有效（常闭按钮）
+	PollMS        int    `yaml:"poll_ms"`         // GPIO轮询间隔（毫秒，默认20）
+	SerialPort    string `yaml:"serial_port"`     // 急停串口（如 /dev/ttyUSB3）
+	SerialBaud    int    `yaml:"serial_baud"`     // 波特率（默认9600）
+	SerialKeyword string `yaml:"serial_keyword"`  // 串口收到该行时触发（默认 ESTOP）
+}
+
+// EStopStatus 急停状态
+type EStopStatus struct {
+	Latched       bool      `json:"latched"`                 // 是否处于锁定的故障状态
+	Source        string    `json:"source,omitempty"`        // 触发来源：api/signal/gpio/serial
+	Reason        string    `json:"reason,omitempty"`        // 触发原因
+	TriggeredAt   time.Time `json:"triggered_at,omitempty"`  // 触发时刻
+	CanceledSends int       `json:"canceled_sends"`          // 触发时被取消的在途帧发送数
+	PumpConfirmed bool      `json:"pump_confirmed"`          // 气泵关闭是否收到应答
+	PumpResponse  string    `json:"pump_response,omitempty"` // 气泵应答
+	ReleaseSent   bool      `json:"release_sent"`            // 释放姿态是否发送成功
+	ReleaseError  string    `json:"release_error,omitempty"` // 释放姿态发送失败原因
+	InputActive   bool      `json:"input_active"`            // GPIO急停输入当前是否有效
+	TriggerCount  int       `json:"trigger_count"`           // 累计触发次数
+}
+
+// EmergencyStop 急停控制器
+type EmergencyStop struct {
+	mutex    sync.Mutex
+	cfg      Config
+	hasCfg   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inflight int           // 在途的异步帧发送数
+	drained  chan struct{} // 在途发送全部退出时关闭（没有在途发送时为 nil）
+	status   EStopStatus
+}
+
+// 全局急停控制器（始终存在，输入监听由 StartGlobalEStop 启动）
+var globalEStop = NewEmergencyStop()
+
+// NewEmergencyStop 创建急停控制器
+func NewEmergencyStop() *EmergencyStop {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EmergencyStop{ctx: ctx, cancel: cancel}
+}
+
+// StartGlobalEStop 记录配置（用于发送释放姿态）并启动GPIO/串口急停输入监听
+func StartGlobalEStop(cfg Config) {
+	globalEStop.mutex.Lock()
+	globalEStop.cfg = cfg
+	globalEStop.hasCfg = true
+	globalEStop.mutex.Unlock()
+
+	if cfg.EStop.GPIOPath != "" {
+		go globalEStop.pollGPIO(cfg.EStop)
+		fmt.Printf("🚨 急停GPIO输入: %s\n", cfg.EStop.GPIOPath)
+	}
+	if cfg.EStop.SerialPort != "" {
+		go globalEStop.listenSerial(cfg.EStop)
+		fmt.Printf("🚨 急停串口输入: %s\n", cfg.EStop.SerialPort)
+	}
+}
+
+// Armed 是否已加载配置（演奏/Web模式下为 true，转换、检查等离线模式下为 false）
+func (es *EmergencyStop) Armed() bool {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	return es.hasCfg
+}
+
+// Context 当前的急停上下文（急停时取消，解除后换新）
+func (es *EmergencyStop) Context() context.Context {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	return es.ctx
+}
+
+// WithEStop 派生一个在急停时同样被取消的上下文（原因为 ErrEmergencyStop）
+func (es *EmergencyStop) WithEStop(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	stop := context.AfterFunc(es.Context(), func() { cancel(ErrEmergencyStop) })
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+// Latched 是否处于锁定的故障状态
+func (es *EmergencyStop) Latched() bool {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	return es.status.Latched
+}
+
+// Check 锁定时返回错误（开始演奏、手动发送指法前调用）
+func (es *EmergencyStop) Check() error {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	if es.status.Latched {
+		return fmt.Errorf("急停已锁定（%s: %s），请先解除急停", es.status.Source, es.status.Reason)
+	}
+	return nil
+}
+
+// blocksPumpCommand 锁定时拒绝开启气泵（关闭与其它命令不受影响）
+func (es *EmergencyStop) blocksPumpCommand(cmd string) bool {
+	return strings.TrimSpace(cmd) == "on" && es.Latched()
+}
+
+// acquireSend 开始一次异步帧发送，锁定时返回 false
+func (es *EmergencyStop) acquireSend() bool {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	if es.status.Latched {
+		return false
+	}
+	if es.inflight == 0 {
+		es.drained = make(chan struct{})
+	}
+	es.inflight++
+	return true
+}
+
+// releaseSend 结束一次异步帧发送
+func (es *EmergencyStop) releaseSend() {
+	es.mutex.Lock()
+	es.inflight--
+	if es.inflight == 0 {
+		close(es.drained)
+		es.drained = nil
+	}
+	es.mutex.Unlock()
+}
+
+// Trigger 触发急停（可重复触发：已锁定时保留首次触发信息，但仍重新关闭气泵并发送释放姿态）
+func (es *EmergencyStop) Trigger(source, reason string) EStopStatus {
+	es.mutex.Lock()
+	first := !es.status.Latched
+	es.status.TriggerCount++
+	if first {
+		es.status = EStopStatus{
+			Latched:       true,
+			Source:        source,
+			Reason:        reason,
+			TriggeredAt:   time.Now(),
+			CanceledSends: es.inflight,
+			InputActive:   es.status.InputActive,
+			TriggerCount:  es.status.TriggerCount,
+		}
+	}
+	es.cancel()
+	drained := es.drained
+	es.mutex.Unlock()
+	fmt.Printf("🚨 急停触发[%s]: %s\n", source, reason)
+
+	// 1. 等待在途的帧发送退出（锁定后不再有新的异步帧入队），之后不会再有旧的指法帧到达
+	if drained != nil {
+		timer := time.NewTimer(estopDrainTimeout)
+		select {
+		case <-drained:
+		case <-timer.C:
+			es.mutex.Lock()
+			inflight := es.inflight
+			es.mutex.Unlock()
+			fmt.Printf("⚠️  急停: 仍有%d个帧发送未退出\n", inflight)
+		}
+		timer.Stop()
+	}
+
+	// 2. 同步关闭气泵并确认
+	confirmed, response := confirmPumpOff()
+	if confirmed {
+		fmt.Printf("🔴 急停: 气泵已关闭，应答: %s\n", response)
+	} else {
+		fmt.Printf("❌ 急停: 气泵关闭未确认（%s）\n", response)
+	}
+
+	// 3. 左右手释放姿态
+	releaseErr := es.sendRelease()
+	if releaseErr != nil {
+		fmt.Printf("❌ 急停: 释放姿态发送失败: %v\n", releaseErr)
+	} else {
+		fmt.Println("🤲 急停: 已发送释放姿态")
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.status.PumpConfirmed = confirmed
+	es.status.PumpResponse = response
+	es.status.ReleaseSent = releaseErr == nil
+	es.status.ReleaseError = ""
+	if releaseErr != nil {
+		es.status.ReleaseError = releaseErr.Error()
+	}
+	return es.status
+}
+
+// Clear 解除急停（GPIO输入仍有效时拒绝）
+func (es *EmergencyStop) Clear() error {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	if !es.status.Latched {
+		return nil
+	}
+	if es.status.InputActive {
+		return fmt.Errorf("急停输入仍处于触发状态，请先复位急停按钮")
+	}
+	es.ctx, es.cancel = context.WithCancel(context.Background())
+	es.status.Latched = false
+	fmt.Printf("✅ 急停已解除（触发于 %s，来源 %s）\n", es.status.TriggeredAt.Format("15:04:05"), es.status.Source)
+	return nil
+}
+
+// Status 当前状态
+func (es *EmergencyStop) Status() EStopStatus {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	return es.status
+}
+
+// confirmPumpOff 同步关闭气泵，等待串口应答（超时重试；应答由气泵控制器唯一的读取goroutine接收，不会遗留阻塞的读取）
+func confirmPumpOff() (bool, string) {
+	if globalPumpController == nil || globalPumpController.port == nil {
+		return false, "气泵控制器未初始化"
+	}
+	for attempt := 1; attempt <= estopPumpRetries; attempt++ {
+		if response := strings.TrimSpace(GlobalPumpSendSyncTimeout("off", estopPumpTimeout)); response != "" {
+			return true, response
+		}
+		fmt.Printf("⚠️  急停: 第%d次关闭气泵未收到应答\n", attempt)
+	}
+	return false, "无应答"
+}
+
+// sendRelease 向左右手发送释放姿态（乐器取当前演奏的乐器）
+func (es *EmergencyStop) sendRelease() error {
+	running := playbackController.Running()
+	playbackController.mutex.RLock()
+	cfg := playbackController.config
+	instrument := playbackController.instrument
+	playbackController.mutex.RUnlock()
+
+	if !running {
+		es.mutex.Lock()
+		cfg, running = es.cfg, es.hasCfg
+		es.mutex.Unlock()
+		if !running {
+			return fmt.Errorf("配置未加载")
+		}
+	}
+	return NewReadyGestureController().ExecuteReadyGesture(cfg, instrument)
+}
+
+// setInputActive 记录GPIO输入状态，从无效变为有效时触发
+func (es *EmergencyStop) setInputActive(active bool, source, reason string) {
+	es.mutex.Lock()
+	rising := active && !es.status.InputActive
+	es.status.InputActive = active
+	es.mutex.Unlock()
+	if rising {
+		es.Trigger(source, reason)
+	}
+}
+
+// pollGPIO 轮询 sysfs GPIO 值文件
+func (es *EmergencyStop) pollGPIO(cfg EStopConfig) {
+	interval := time.Duration(cfg.PollMS) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultEStopPollMS * time.Millisecond
+	}
+	warned := false
+	for {
+		data, err := os.ReadFile(cfg.GPIOPath)
+		if err != nil {
+			if !warned {
+				fmt.Printf("⚠️  读取急停GPIO失败: %v\n", err)
+				warned = true
+			}
+		} else {
+			warned = false
+			active := strings.TrimSpace(string(data)) == "1"
+			if cfg.GPIOActiveLow {
+				active = !active
+			}
+			es.setInputActive(active, "gpio", cfg.GPIOPath)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// listenSerial 监听急停串口，收到关键字行时触发（断开后定期重连）
+func (es *EmergencyStop) listenSerial(cfg EStopConfig) {
+	baud := cfg.SerialBaud
+	if baud <= 0 {
+		baud = 9600
+	}
+	keyword := cfg.SerialKeyword
+	if keyword == "" {
+		keyword = defaultEStopKeyword
+	}
+	for {
+		port, err := serial.Open(cfg.SerialPort, &serial.Mode{BaudRate: baud})
+		if err != nil {
+			fmt.Printf("⚠️  打开急停串口失败: %v，%v后重试\n", err, estopSerialRetryPeriod)
+			time.Sleep(estopSerialRetryPeriod)
+			continue
+		}
+		scanner := bufio.NewScanner(port)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == keyword {
+				es.Trigger("serial", cfg.SerialPort)
+			}
+		}
+		port.Close()
+		fmt.Printf("⚠️  急停串口断开: %v，%v后重连\n", scanner.Err(), estopSerialRetryPeriod)
+		time.Sleep(estopSerialRetryPeriod)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 紧凑二进制执行序列格式
+////////////////////////////////////////////////////////////////////////////////
+//
+// 文件布局（小端序）：
+//
+//	文件头   magic "GSKX" | 格式版本 uint16 | 保留 uint16
+//	元数据   长度 uint32 | SequenceMeta 的JSON
+//	字符串池 数量 uint32 | 每项：长度 uint16 + UTF-8字节（音符名、串口命令、标记、手部、设备ID）
+//	帧池     数量 uint32 | 每项固定16字节（binaryFrame），相同的帧只存一份
+//	帧引用表 数量 uint32 | 每项 uint32 帧池下标
+//	事件表   数量 uint32 | 每项固定56字节（binaryEvent），通过 [refStart, refStart+refCount) 引用帧
+//
+// 格式版本2在事件记录末尾增加了小节与拍位置；仍可读取版本1文件（40字节事件记录，无小节信息）。
+//
+// 元数据保留JSON以便与JSON格式共用版本迁移；事件与帧为定长记录，树莓派上解析无需逐字段反射。
+
+// execBinaryMagic 二进制执行文件魔数
+var execBinaryMagic = [4]byte{'G', 'S', 'K', 'X'}
+
+// execBinaryFormat 二进制容器格式版本（与 ExecSchemaVersion 独立，仅描述布局）
+const execBinaryFormat uint16 = 2
+
+// ExecBinaryExt 二进制执行文件扩展名
+const ExecBinaryExt = ".exec.bin"
+
+// binaryHeader 文件头
+type binaryHeader struct {
+	Magic    [4]byte
+	Format   uint16
+	Reserved uint16
+}
+
+// binaryFrame 帧池记录（16字节）
+type binaryFrame struct {
+	Hand    uint16  // 手部标识在字符串池中的下标
+	ID      uint16  // 设备ID在字符串池中的下标
+	DataLen uint8   // 数据长度（≤8）
+	Data    [8]byte // 数据内容
+	_       [3]byte // 对齐填充
+}
+
+// binaryEventV1 格式版本1的事件表记录（40字节）
+type binaryEventV1 struct {
+	TimestampMS float64
+	DurationMS  float64
+	Beats       float64
+	Note        uint32 // 音符名在字符串池中的下标
+	Serial      uint16 // 串口命令在字符串池中的下标
+	Marker      uint16 // 时间标记在字符串池中的下标
+	RefStart    uint32 // 帧引用表起始下标
+	RefCount    uint16 // 帧数量
+	_           [2]byte
+}
+
+// binaryEvent 事件表记录（56字节）
+type binaryEvent struct {
+	binaryEventV1
+	BeatInBar float64 // 小节内拍位置
+	Bar       uint32  // 小节
+	_         [4]byte
+}
+
+// stringPool 字符串池（构建时去重）
+type stringPool struct {
+	index   map[string]int
+	strings []string
+}
+
+// add 添加字符串并返回下标
+func (sp *stringPool) add(s string) int {
+	if i, ok := sp.index[s]; ok {
+		return i
+	}
+	sp.index[s] = len(sp.strings)
+	sp.strings = append(sp.strings, s)
+	return len(sp.strings) - 1
+}
+
+// IsBinaryExecFile 判断数据是否为二进制执行序列（按魔数识别）
+func IsBinaryExecFile(data []byte) bool {
+	return len(data) >= 4 && bytes.Equal(data[:4], execBinaryMagic[:])
+}
+
+// EncodeExecutionSequenceBinary 将执行序列编码为二进制格式
+func EncodeExecutionSequenceBinary(sequence *ExecutionSequence) ([]byte, error) {
+	metaJSON, err := json.Marshal(sequence.Meta)
+	if err != nil {
+		return nil, fmt.Errorf("元数据序列化失败: %v", err)
+	}
+
+	pool := &stringPool{index: map[string]int{}}
+	pool.add("") // 下标0固定为空字符串
+
+	frameIndex := map[binaryFrame]uint32{}
+	var frames []binaryFrame
+	var refs []uint32
+	events := make([]binaryEvent, 0, len(sequence.Events))
+
+	for i, event := range sequence.Events {
+		if len(event.Frames) > 0xFFFF {
+			return nil, fmt.Errorf("事件%d的帧数量过多: %d", i+1, len(event.Frames))
+		}
+		record := binaryEvent{
+			binaryEventV1: binaryEventV1{
+				TimestampMS: event.TimestampMS,
+				DurationMS:  event.DurationMS,
+				Beats:       event.Beats,
+				Note:        uint32(pool.add(event.Note)),
+				Serial:      uint16(pool.add(event.SerialCmd)),
+				Marker:      uint16(pool.add(event.Marker)),
+				RefStart:    uint32(len(refs)),
+				RefCount:    uint16(len(event.Frames)),
+			},
+			BeatInBar: event.BeatInBar,
+			Bar:       uint32(event.Bar),
+		}
+
+		for _, frame := range event.Frames {
+			if len(frame.Data) > 8 {
+				return nil, fmt.Errorf("事件%d的CAN帧超过8字节: %d", i+1, len(frame.Data))
+			}
+			bf := binaryFrame{
+				Hand:    uint16(pool.add(frame.Hand)),
+				ID:      uint16(pool.add(frame.ID)),
+				DataLen: uint8(len(frame.Data)),
+			}
+			copy(bf.Data[:], frame.Data)
+
+			// 相同的帧只存一份（整曲通常只有几十种指法）
+			idx, ok := frameIndex[bf]
+			if !ok {
+				idx = uint32(len(frames))
+				frameIndex[bf] = idx
+				frames = append(frames, bf)
+			}
+			refs = append(refs, idx)
+		}
+		events = append(events, record)
+	}
+	if len(pool.strings) > 0xFFFF {
+		return nil, fmt.Errorf("字符串池过大: %d", len(pool.strings))
+	}
+
+	var buf bytes.Buffer
+	w := func(v any) {
+		binary.Write(&buf, binary.LittleEndian, v) // 写入内存缓冲区不会失败
+	}
+
+	w(binaryHeader{Magic: execBinaryMagic, Format: execBinaryFormat})
+	w(uint32(len(metaJSON)))
+	buf.Write(metaJSON)
+
+	w(uint32(len(pool.strings)))
+	for _, s := range pool.strings {
+		if len(s) > 0xFFFF {
+			return nil, fmt.Errorf("字符串过长: %d字节", len(s))
+		}
+		w(uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	w(uint32(len(frames)))
+	w(frames)
+	w(uint32(len(refs)))
+	w(refs)
+	w(uint32(len(events)))
+	w(events)
+
+	return buf.Bytes(), nil
+}
+
+// DecodeExecutionSequenceBinary 解码二进制执行序列
+func DecodeExecutionSequenceBinary(data []byte) (*ExecutionSequence, error) {
+	r := bytes.NewReader(data)
+	read := func(v any) error {
+		return binary.Read(r, binary.LittleEndian, v)
+	}
+	readCount := func(what string, recordSize int) (int, error) {
+		var n uint32
+		if err := read(&n); err != nil {
+			return 0, fmt.Errorf("读取%s数量失败: %v", what, err)
+		}
+		// 防止损坏文件导致超大分配
+		if int64(n)*int64(recordSize) > int64(r.Len()) {
+			return 0, fmt.Errorf("%s数量 %d 超出文件长度", what, n)
+		}
+		return int(n), nil
+	}
+
+	var header binaryHeader
+	if err := read(&header); err != nil {
+		return nil, fmt.Errorf("读取文件头失败: %v", err)
+	}
+	if header.Magic != execBinaryMagic {
+		return nil, fmt.Errorf("不是二进制执行序列文件")
+	}
+	if header.Format != 1 && header.Format != execBinaryFormat {
+		return nil, fmt.Errorf("二进制格式版本 %d 不受支持（当前支持 1~%d）", header.Format, execBinaryFormat)
+	}
+
+	// 元数据
+	metaLen, err := readCount("元数据", 1)
+	if err != nil {
+		return nil, err
+	}
+	metaJSON := make([]byte, metaLen)
+	if _, err := io.ReadFull(r, metaJSON); err != nil {
+		return nil, fmt.Errorf("读取元数据失败: %v", err)
+	}
+	sequence := &ExecutionSequence{}
+	if err := json.Unmarshal(metaJSON, &sequence.Meta); err != nil {
+		return nil, fmt.Errorf("解析元数据失败: %v", err)
+	}
+
+	// 字符串池
+	stringCount, err := readCount("字符串", 2)
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, stringCount)
+	for i := range strs {
+		var n uint16
+		if err := read(&n); err != nil {
+			return nil, fmt.Errorf("读取字符串失败: %v", err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("读取字符串失败: %v", err)
+		}
+		strs[i] = string(b)
+	}
+	str := func(i int) (string, error) {
+		if i >= len(strs) {
+			return "", fmt.Errorf("字符串下标 %d 越界", i)
+		}
+		return strs[i], nil
+	}
+
+	// 帧池与帧引用表
+	frameCount, err := readCount("帧", 16)
+	if err != nil {
+		return nil, err
+	}
+	rawFrames := make([]binaryFrame, frameCount)
+	if err := read(rawFrames); err != nil {
+		return nil, fmt.Errorf("读取帧池失败: %v", err)
+	}
+	frames := make([]ExecCANFrame, frameCount)
+	for i, bf := range rawFrames {
+		hand, err := str(int(bf.Hand))
+		if err != nil {
+			return nil, err
+		}
+		id, err := str(int(bf.ID))
+		if err != nil {
+			return nil, err
+		}
+		if bf.DataLen > 8 {
+			return nil, fmt.Errorf("帧%d数据长度 %d 无效", i, bf.DataLen)
+		}
+		frames[i] = ExecCANFrame{Hand: hand, ID: id, Data: append([]byte(nil), bf.Data[:bf.DataLen]...)}
+	}
+
+	refCount, err := readCount("帧引用", 4)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint32, refCount)
+	if err := read(refs); err != nil {
+		return nil, fmt.Errorf("读取帧引用表失败: %v", err)
+	}
+
+	// 事件表（版本1的记录没有小节信息）
+	eventSize := int(binary.Size(binaryEvent{}))
+	if header.Format == 1 {
+		eventSize = int(binary.Size(binaryEventV1{}))
+	}
+	eventCount, err := readCount("事件", eventSize)
+	if err != nil {
+		return nil, err
+	}
+	rawEvents := make([]binaryEvent, eventCount)
+	if header.Format == 1 {
+		v1Events := make([]binaryEventV1, eventCount)
+		if err := read(v1Events); err != nil {
+			return nil, fmt.Errorf("读取事件表失败: %v", err)
+		}
+		for i, be := range v1Events {
+			rawEvents[i].binaryEventV1 = be
+		}
+	} else if err := read(rawEvents); err != nil {
+		return nil, fmt.Errorf("读取事件表失败: %v", err)
+	}
+
+	sequence.Events = make([]ExecutionEvent, eventCount)
+	for i, be := range rawEvents {
+		note, err := str(int(be.Note))
+		if err != nil {
+			return nil, err
+		}
+		serial, err := str(int(be.Serial))
+		if err != nil {
+			return nil, err
+		}
+		marker, err := str(int(be.Marker))
+		if err != nil {
+			return nil, err
+		}
+		event := ExecutionEvent{
+			TimestampMS: be.TimestampMS,
+			DurationMS:  be.DurationMS,
+			Beats:       be.Beats,
+			Note:        note,
+			SerialCmd:   serial,
+			Marker:      marker,
+			Bar:         int(be.Bar),
+			BeatInBar:   be.BeatInBar,
+		}
+		end := int(be.RefStart) + int(be.RefCount)
+		if end > len(refs) {
+			return nil, fmt.Errorf("事件%d帧引用越界", i+1)
+		}
+		if be.RefCount > 0 {
+			event.Frames = make([]ExecCANFrame, 0, be.RefCount)
+			for _, ref := range refs[be.RefStart:end] {
+				if int(ref) >= len(frames) {
+					return nil, fmt.Errorf("事件%d帧下标 %d 越界", i+1, ref)
+				}
+				event.Frames = append(event.Frames, frames[ref])
+			}
+		}
+		sequence.Events[i] = event
+	}
+
+	return sequence, nil
+}
+
+// ConvertExecutionSequence 在JSON与二进制格式之间转换执行序列（按输出文件扩展名决定格式）
+// 转换后打印两种格式的文件大小（加载耗时对比见 exec_binary_test.go 中的基准测试）
+func ConvertExecutionSequence(inputFile, outputFile string) error {
+	sequence, err := loadExecutionSequence(inputFile)
+	if err != nil {
+		return err
+	}
+	if err := saveExecutionSequence(sequence, outputFile); err != nil {
+		return err
+	}
+
+	inputStat, err := os.Stat(inputFile)
+	if err != nil {
+		return err
+	}
+	outputStat, err := os.Stat(outputFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ 转换完成: %s → %s\n", inputFile, outputFile)
+	fmt.Printf("   事件数: %d\n", len(sequence.Events))
+	fmt.Printf("   %-40s %8.1f KB\n", inputFile, float64(inputStat.Size())/1024)
+	fmt.Printf("   %-40s %8.1f KB\n", outputFile, float64(outputStat.Size())/1024)
+	return nil
+}
+
+// isBinaryExecPath 判断输出路径是否应使用二进制格式
+func isBinaryExecPath(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".bin")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkExecSequence 构造与预处理输出结构相同的执行序列（每个音符左右手各一帧并开气，每8个音符一个空拍）
+func benchmarkExecSequence(notes int) *ExecutionSequence {
+	sequence := &ExecutionSequence{
+		Meta: SequenceMeta{
+			SourceFile: "bench.json",
+			Instrument: "sks",
+			BPM:        120,
+			Version:    ExecSchemaVersion,
+		},
+	}
+	t := 0.0
+	for i := 0; i < notes; i++ {
+		value := byte(i % 256)
+		sequence.Events = append(sequence.Events, ExecutionEvent{
+			TimestampMS: t,
+			DurationMS:  250,
+			Note:        "C5",
+			Frames: []ExecCANFrame{
+				{Hand: "left", ID: "0x28", Data: []byte{OpCode, value, 100, 255, 255, 255, 255}},
+				{Hand: "right", ID: "0x27", Data: []byte{OpCode, 255, 100, value, 255, 255, 255}},
+			},
+			SerialCmd: "on",
+			Bar:       i/4 + 1,
+			BeatInBar: float64(i%4 + 1),
+		})
+		t += 250
+		if i%8 == 7 {
+			sequence.Events = append(sequence.Events,
+				ExecutionEvent{TimestampMS: t, DurationMS: 500, Note: "REST", SerialCmd: "off", Marker: MarkerRestStart, Beats: 1},
+				ExecutionEvent{TimestampMS: t + 500, Note: "REST_END", Marker: MarkerRestEnd},
+			)
+			t += 500
+		}
+	}
+	sequence.Meta.TotalEvents = len(sequence.Events)
+	sequence.Meta.TotalDurationMS = t
+	return sequence
+}
+
+// benchmarkLoadExec 保存为指定格式后反复加载（含读取、解析、迁移与校验），并报告文件大小
+func benchmarkLoadExec(b *testing.B, filename string) {
+	path := filepath.Join(b.TempDir(), filename)
+	if err := saveExecutionSequence(benchmarkExecSequence(2000), path); err != nil {
+		b.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := loadExecutionSequence(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(stat.Size()), "file_bytes")
+}
+
+func BenchmarkLoadExecJSON(b *testing.B) {
+	benchmarkLoadExec(b, "bench.exec.json")
+}
+
+func BenchmarkLoadExecBinary(b *testing.B) {
+	benchmarkLoadExec(b, "bench.exec.bin")
+}
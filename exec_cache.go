@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 编译缓存 - 按输入内容哈希判断执行文件是否需要重新生成
+////////////////////////////////////////////////////////////////////////////////
+
+// CompileRequest 编译（预处理）请求
+type CompileRequest struct {
+	SourceFile    string              // 源时间轴文件路径
+	Part          string              // 多声部总谱中的声部名（空表示单声部时间轴）
+	Instrument    string              // 乐器类型
+	BPM           float64             // BPM（<=0 时使用速度图起始速度，再使用配置文件，缺省为60）
+	TonguingDelay int                 // 吐音延迟（毫秒）
+	FingerLeadMS  *int                // 换指提前量覆盖值（nil 表示使用配置文件）
+	SwitchDipMS   *int                // 换指气泵降压覆盖值（nil 表示使用配置文件）
+	Expression    *ExpressionSettings // 表情演奏设置覆盖值（nil 表示使用配置文件）
+	Breath        *BreathConfig       // 换气设置覆盖值（nil 表示使用配置文件）
+	OutputFile    string              // 输出执行文件路径
+}
+
+// CompileResult 编译结果
+type CompileResult struct {
+	ExecFile   string             // 执行文件路径
+	Sequence   *ExecutionSequence // 执行序列
+	Recompiled bool               // 是否重新编译
+	Reasons    []string           // 重新编译的原因，或无法检查时的提示（复用缓存时为空）
+}
+
+// CompileCache 编译缓存
+// 执行文件按设置区分：文件名带有"相关配置字段 + 预处理参数"哈希的前8位，不同换指、表情、换气设置的编译结果各自保存、互不覆盖；
+// 时间轴内容与指法映射的哈希记录在元数据中，变化时在原文件上重新编译，避免用旧的CAN字节演奏
+type CompileCache struct {
+	cfg        Config
+	fileReader *FileReader
+}
+
+// NewCompileCache 创建新的编译缓存
+func NewCompileCache(cfg Config) *CompileCache {
+	return &CompileCache{
+		cfg:        cfg,
+		fileReader: NewFileReader(),
+	}
+}
+
+// execVariantLen 执行文件名中设置哈希的长度
+const execVariantLen = 8
+
+// DefaultPartExecPath 生成声部的执行文件路径
+// 格式：exec/{原文件名}[.{声部}]_{乐器类型}_{BPM}_{吐音延迟}_{设置哈希}.exec.json
+func DefaultPartExecPath(sourceFile, part, instrument string, bpm float64, tonguingDelay int, variant string) string {
+	baseFilename := strings.TrimSuffix(filepath.Base(sourceFile), ".json")
+	if part != "" {
+		baseFilename += "." + part
+	}
+	return filepath.Join("exec", fmt.Sprintf("%s_%s_%.0f_%d_%s.exec.json", baseFilename, instrument, bpm, tonguingDelay, variant))
+}
+
+// RequestFromMeta 根据执行文件元数据还原编译请求（用于检查已有执行文件是否过期）
+func RequestFromMeta(meta SequenceMeta, execFile string) CompileRequest {
+	req := CompileRequest{
+		SourceFile:    meta.SourcePath,
+		Part:          meta.Part,
+		Instrument:    meta.Instrument,
+		BPM:           meta.BPM,
+		TonguingDelay: meta.TonguingDelay,
+		OutputFile:    execFile,
+	}
+	if req.SourceFile == "" {
+		req.SourceFile = filepath.Join("trsmusic", meta.SourceFile)
+	}
+	if meta.TimingOverride {
+		leadMS, dipMS := meta.FingerLeadMS, meta.SwitchDipMS
+		req.FingerLeadMS = &leadMS
+		req.SwitchDipMS = &dipMS
+	}
+	if meta.ExpressionOverride {
+		expression := ExpressionSettings{}
+		if meta.Expression != nil {
+			expression = *meta.Expression
+		}
+		req.Expression = &expression
+	}
+	if meta.BreathOverride != nil {
+		breath := *meta.BreathOverride
+		req.Breath = &breath
+	}
+	return req
+}
+
+// ResolveBPM 解析实际使用的BPM
+// 优先级：指定值 > 时间轴速度图的起始速度 > 配置文件 > 60（与合奏分发声部时的顺序一致）
+// 配置文件的 bpm 只作为没有速度图的时间轴的默认值，不会按比例缩放乐谱自带的速度图
+func (cc *CompileCache) ResolveBPM(bpm float64, sourceFile string) float64 {
+	if bpm > 0 {
+		return bpm
+	}
+	if initialBPM, ok := readTimelineInitialBPM(sourceFile); ok {
+		return initialBPM
+	}
+	if cc.cfg.BPM > 0 {
+		return cc.cfg.BPM
+	}
+	return 60 // 默认BPM
+}
+
+// newPreprocessor 按请求创建预处理器
+func (cc *CompileCache) newPreprocessor(req CompileRequest) (*SequencePreprocessor, error) {
+	bpm := cc.ResolveBPM(req.BPM, req.SourceFile)
+	fingeringMap, err := cc.fileReader.ReadFingeringMapByInstrument(req.Instrument)
+	if err != nil {
+		return nil, err
+	}
+	preprocessor := NewSequencePreprocessor(cc.cfg, fingeringMap, req.Instrument, bpm, req.TonguingDelay)
+	preprocessor.SetPart(req.Part)
+
+	// 请求中指定了换指参数时覆盖配置文件
+	if req.FingerLeadMS != nil || req.SwitchDipMS != nil {
+		timing := cc.cfg.TimingFor(req.Instrument)
+		if req.FingerLeadMS != nil {
+			timing.FingerLeadMS = *req.FingerLeadMS
+		}
+		if req.SwitchDipMS != nil {
+			timing.SwitchDipMS = *req.SwitchDipMS
+		}
+		preprocessor.SetFingerLead(timing.FingerLeadMS, timing.SwitchDipMS)
+	}
+	if req.Expression != nil {
+		preprocessor.SetExpression(*req.Expression)
+	}
+	if req.Breath != nil {
+		preprocessor.SetBreath(*req.Breath)
+	}
+
+	return preprocessor, nil
+}
+
+// ExecPath 请求对应的执行文件路径（文件名带设置哈希，设置不同的编译结果互不覆盖）
+func (cc *CompileCache) ExecPath(req CompileRequest) (string, error) {
+	preprocessor, err := cc.newPreprocessor(req)
+	if err != nil {
+		return "", err
+	}
+	variant := hashJSON(map[string]string{
+		"config": ComputeConfigHash(cc.cfg, req.Instrument),
+		"params": preprocessor.ParamsHash(),
+	})[:execVariantLen]
+	return DefaultPartExecPath(req.SourceFile, req.Part, req.Instrument, preprocessor.bpm, req.TonguingDelay, variant), nil
+}
+
+// Check 检查请求对应的执行文件是否可以复用
+// 返回已有的执行序列（可复用时）和需要重新编译的原因（为空表示可复用）
+func (cc *CompileCache) Check(req CompileRequest) (*ExecutionSequence, []string) {
+	if _, err := os.Stat(req.OutputFile); os.IsNotExist(err) {
+		return nil, []string{"执行文件不存在"}
+	}
+
+	sequence, err := loadExecutionSequence(req.OutputFile)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("执行文件无法加载: %v", err)}
+	}
+	if sequence.Meta.InputHash == "" {
+		return sequence, []string{"执行文件缺少输入哈希（旧版本生成）"}
+	}
+
+	timelineHash, err := hashFile(req.SourceFile)
+	if err != nil {
+		return sequence, []string{fmt.Sprintf("源时间轴文件不可读: %v", err)}
+	}
+
+	preprocessor, err := cc.newPreprocessor(req)
+	if err != nil {
+		return sequence, []string{err.Error()}
+	}
+	var reasons []string
+	if timelineHash != sequence.Meta.TimelineHash {
+		reasons = append(reasons, "时间轴已变更")
+	}
+	if ComputeFingeringHash(preprocessor.fingeringMap) != sequence.Meta.FingeringHash {
+		reasons = append(reasons, "指法映射已变更")
+	}
+	if ComputeConfigHash(cc.cfg, req.Instrument) != sequence.Meta.ConfigHash {
+		reasons = append(reasons, "配置（力度/时序）已变更")
+	}
+	if preprocessor.ParamsHash() != sequence.Meta.ParamsHash {
+		reasons = append(reasons, "预处理参数已变更")
+	}
+	if len(reasons) > 0 {
+		return sequence, reasons
+	}
+	return sequence, nil
+}
+
+// Ensure 确保执行文件为最新：可复用时直接加载，否则重新编译
+// 未指定输出文件时使用按设置区分的执行文件路径（见 ExecPath）
+func (cc *CompileCache) Ensure(req CompileRequest) (*CompileResult, error) {
+	if req.OutputFile == "" {
+		path, err := cc.ExecPath(req)
+		if err != nil {
+			return nil, err
+		}
+		req.OutputFile = path
+	}
+
+	sequence, reasons := cc.Check(req)
+	if len(reasons) == 0 {
+		return &CompileResult{ExecFile: req.OutputFile, Sequence: sequence}, nil
+	}
+
+	if err := cc.Compile(req); err != nil {
+		return nil, err
+	}
+
+	sequence, err := loadExecutionSequence(req.OutputFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取序列文件失败: %v", err)
+	}
+	return &CompileResult{
+		ExecFile:   req.OutputFile,
+		Sequence:   sequence,
+		Recompiled: true,
+		Reasons:    reasons,
+	}, nil
+}
+
+// EnsureExecFile 确保已有执行文件为最新（按其元数据中的源文件和参数检查）
+// 已过期时不改写原文件，改用当前设置对应的执行文件（ExecFile 为实际使用的文件）；
+// 源时间轴文件不存在时无法重新编译，原样返回并附带提示
+func (cc *CompileCache) EnsureExecFile(execFile string) (*CompileResult, error) {
+	sequence, err := loadExecutionSequence(execFile)
+	if err != nil {
+		return nil, err
+	}
+
+	req := RequestFromMeta(sequence.Meta, execFile)
+	if _, err := os.Stat(req.SourceFile); err != nil {
+		return &CompileResult{
+			ExecFile: execFile,
+			Sequence: sequence,
+			Reasons:  []string{fmt.Sprintf("源时间轴文件 %s 不存在，无法检查是否过期", req.SourceFile)},
+		}, nil
+	}
+
+	_, reasons := cc.Check(req)
+	if len(reasons) == 0 {
+		return &CompileResult{ExecFile: execFile, Sequence: sequence}, nil
+	}
+	req.OutputFile = ""
+	result, err := cc.Ensure(req)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Recompiled {
+		result.Reasons = append(reasons, fmt.Sprintf("改用当前设置对应的执行文件 %s", result.ExecFile))
+	}
+	return result, nil
+}
+
+// Compile 无条件编译（预处理）请求对应的执行文件
+func (cc *CompileCache) Compile(req CompileRequest) error {
+	if dir := filepath.Dir(req.OutputFile); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("创建输出目录失败: %v", err)
+		}
+	}
+	preprocessor, err := cc.newPreprocessor(req)
+	if err != nil {
+		return err
+	}
+	return preprocessor.GenerateExecutionSequence(req.SourceFile, req.OutputFile)
+}
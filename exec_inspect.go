@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 执行序列检查与对比工具
+////////////////////////////////////////////////////////////////////////////////
+
+// fingerSlotNames CAN帧各手指位的显示名称（取自 fingerIndex，不含别名）
+var fingerSlotNames = func() [6]string {
+	var names [6]string
+	for _, name := range []string{"Thumb", "Thumb rotation", "Index", "Middle", "Ring", "Little"} {
+		names[fingerIndex[name]] = name
+	}
+	return names
+}()
+
+// diffTimingToleranceMS 时间差小于该值视为未变化（浮点误差）
+const diffTimingToleranceMS = 0.5
+
+// diffAlignToleranceMS 对齐事件时允许的时间差：两个序列中时间戳相差不超过该值的事件视为同一事件
+// （换指提前量、吐音延迟等设置变化只移动几十毫秒；超过该值按删除+新增报告）
+const diffAlignToleranceMS = 50.0
+
+// InspectRow 检查表中的一行（对应一个事件）
+type InspectRow struct {
+	Index       int      `json:"index"`            // 事件序号（从1开始）
+	TimestampMS float64  `json:"t"`                // 时间戳（毫秒）
+	DurationMS  float64  `json:"d"`                // 持续时长（毫秒）
+	Note        string   `json:"note"`             // 音符/事件名
+	Bar         int      `json:"bar,omitempty"`    // 小节（旧文件为0）
+	Beat        float64  `json:"beat,omitempty"`   // 小节内拍位置
+	SerialCmd   string   `json:"serial,omitempty"` // 气泵命令
+	Marker      string   `json:"m,omitempty"`      // 时间标记
+	Left        []string `json:"left,omitempty"`   // 左手按下的手指
+	Right       []string `json:"right,omitempty"`  // 右手按下的手指
+	HasFrames   bool     `json:"has_frames"`       // 是否发送CAN帧
+	LeftBytes   string   `json:"left_bytes,omitempty"`
+	RightBytes  string   `json:"right_bytes,omitempty"`
+}
+
+// ExecDiffEntry 对比结果中的一项差异
+type ExecDiffEntry struct {
+	Kind       string  `json:"kind"`           // timing/frames/serial/added/removed
+	IndexA     int     `json:"index_a"`        // A中的事件序号（0表示不存在）
+	IndexB     int     `json:"index_b"`        // B中的事件序号（0表示不存在）
+	Note       string  `json:"note"`           // 音符/事件名
+	Bar        int     `json:"bar,omitempty"`  // 所在小节（取A中的位置，新增事件取B）
+	TimestampA float64 `json:"t_a"`            // A中的时间戳
+	TimestampB float64 `json:"t_b"`            // B中的时间戳
+	Detail     string  `json:"detail"`         // 差异描述
+	DeltaMS    float64 `json:"delta_ms"`       // 时间差（B-A，仅timing）
+	Hand       string  `json:"hand,omitempty"` // 帧差异所在手（仅frames）
+}
+
+// ExecDiff 两个执行序列的对比结果
+type ExecDiff struct {
+	MetaChanges []string        `json:"meta_changes"` // 元数据差异
+	Entries     []ExecDiffEntry `json:"entries"`      // 事件差异
+	Matched     int             `json:"matched"`      // 对齐的事件数
+	Timing      int             `json:"timing"`       // 时间变化数
+	Frames      int             `json:"frames"`       // 帧字节变化数
+	Serial      int             `json:"serial"`       // 气泵命令变化数
+	Notes       int             `json:"notes"`        // 音符变化数（同一时刻的事件音符不同）
+	Added       int             `json:"added"`        // B新增的事件数
+	Removed     int             `json:"removed"`      // B删除的事件数
+}
+
+// ExecInspector 执行序列检查器
+// 手指位置按当前配置的释放力度解码：与释放值不同的手指位视为按下
+type ExecInspector struct {
+	cfg Config
+}
+
+// NewExecInspector 创建新的执行序列检查器
+func NewExecInspector(cfg Config) *ExecInspector {
+	return &ExecInspector{cfg: cfg}
+}
+
+// Inspect 生成执行序列的检查表
+func (ei *ExecInspector) Inspect(sequence *ExecutionSequence) []InspectRow {
+	instrument := sequence.Meta.Instrument
+	rows := make([]InspectRow, 0, len(sequence.Events))
+
+	for i, event := range sequence.Events {
+		row := InspectRow{
+			Index:       i + 1,
+			TimestampMS: event.TimestampMS,
+			DurationMS:  event.DurationMS,
+			Note:        event.Note,
+			Bar:         event.Bar,
+			Beat:        event.BeatInBar,
+			SerialCmd:   event.SerialCmd,
+			Marker:      event.Marker,
+			HasFrames:   len(event.Frames) > 0,
+		}
+		for _, frame := range event.Frames {
+			fingers := ei.decodeFingers(frame.Hand, instrument, frame.Data)
+			if frame.Hand == "left" {
+				row.Left = fingers
+				row.LeftBytes = formatFrameBytes(frame.Data)
+			} else {
+				row.Right = fingers
+				row.RightBytes = formatFrameBytes(frame.Data)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// decodeFingers 将CAN帧解码为按下的手指名称
+func (ei *ExecInspector) decodeFingers(hand, instrument string, data []byte) []string {
+	if len(data) != 7 {
+		return nil
+	}
+	release := ei.releaseProfile(hand, instrument)
+	fingers := []string{}
+
+	// 唢呐左手拇指位：高音/倍高音拇指使用独立的两字节配置
+	slot := 0
+	if instrument == "sn" && hand == "left" {
+		if thumb := matchSuonaThumb(data[1:3], ei.cfg); thumb != "" {
+			fingers = append(fingers, thumb)
+			slot = 2
+		}
+	}
+
+	for ; slot < 6; slot++ {
+		releaseValue := 255
+		if slot < len(release) {
+			releaseValue = release[slot]
+		}
+		if int(data[slot+1]) != releaseValue {
+			fingers = append(fingers, fingerSlotNames[slot])
+		}
+	}
+	return fingers
+}
+
+// releaseProfile 获取指定手与乐器的释放力度
+func (ei *ExecInspector) releaseProfile(hand, instrument string) []int {
+	switch {
+	case instrument == "sn" && hand == "left":
+		return ei.cfg.SnLeftReleaseProfile
+	case instrument == "sn":
+		return ei.cfg.SnRightReleaseProfile
+	case hand == "left":
+		return ei.cfg.SksLeftReleaseProfile
+	default:
+		return ei.cfg.SksRightReleaseProfile
+	}
+}
+
+// matchSuonaThumb 识别唢呐高音拇指（Thumb1 倍高音 / Thumb2 高音）
+func matchSuonaThumb(thumbBytes []byte, cfg Config) string {
+	matches := func(profile []int) bool {
+		return len(profile) >= 2 && int(thumbBytes[0]) == profile[0] && int(thumbBytes[1]) == profile[1]
+	}
+	if matches(cfg.SnLeftHighProThumb) {
+		return "Thumb1"
+	}
+	if matches(cfg.SnLeftHighThumb) {
+		return "Thumb2"
+	}
+	return ""
+}
+
+// formatFrameBytes 格式化帧字节（十六进制）
+func formatFrameBytes(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, " ")
+}
+
+// PrintInspectTable 打印检查表
+func PrintInspectTable(sequence *ExecutionSequence, rows []InspectRow) {
+	meta := sequence.Meta
+	fmt.Printf("📋 执行序列: %s\n", meta.SourceFile)
+	fmt.Printf("   乐器: %s, BPM: %.1f, 版本: %s, 事件数: %d, 总时长: %.2fs\n",
+		meta.Instrument, meta.BPM, meta.Version, meta.TotalEvents, meta.TotalDurationMS/1000.0)
+	if meta.TimeSignature != "" {
+		fmt.Printf("   拍号: %s, 小节数: %d\n", meta.TimeSignature, meta.TotalBars)
+	}
+	fmt.Printf("\n%5s %10s %9s %8s  %-12s %-4s %-30s %-30s\n", "#", "时间(ms)", "时长(ms)", "小节:拍", "事件", "气泵", "左手", "右手")
+	fmt.Println(strings.Repeat("-", 119))
+
+	for _, row := range rows {
+		left, right := "", ""
+		if row.HasFrames {
+			left = strings.Join(row.Left, "+")
+			right = strings.Join(row.Right, "+")
+			if left == "" {
+				left = "(松开)"
+			}
+			if right == "" {
+				right = "(松开)"
+			}
+		}
+		note := row.Note
+		if row.Marker != "" {
+			note += " [" + row.Marker + "]"
+		}
+		fmt.Printf("%5d %10.1f %9.1f %8s  %-12s %-4s %-30s %-30s\n",
+			row.Index, row.TimestampMS, row.DurationMS, formatBarColumn(row.Bar, row.Beat), note, row.SerialCmd, left, right)
+	}
+}
+
+// formatBarColumn 小节位置列（如 "12:3.5"，旧文件没有小节信息时为 "-"）
+func formatBarColumn(bar int, beat float64) string {
+	if bar <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%s", bar, strconv.FormatFloat(math.Round(beat*100)/100, 'f', -1, 64))
+}
+
+// DiffExecutionSequences 对比两个执行序列
+// 事件按时间对齐：两个序列按时间戳同步向前推进，时间差不超过 diffAlignToleranceMS 的事件配对
+// （同一时刻有多个事件时优先配对音符相同的），对齐后的事件比较音符、时间戳、CAN帧字节与气泵命令，
+// 未对齐的事件报告为新增或删除。BPM 不同的两个序列时间整体伸缩，大部分事件会报告为新增/删除
+func DiffExecutionSequences(a, b *ExecutionSequence) *ExecDiff {
+	diff := &ExecDiff{MetaChanges: diffMeta(a.Meta, b.Meta)}
+
+	eventsA, eventsB := a.Events, b.Events
+	n, m := len(eventsA), len(eventsB)
+	aligned := func(i, j int) bool {
+		return math.Abs(eventsA[i].TimestampMS-eventsB[j].TimestampMS) <= diffAlignToleranceMS
+	}
+	// sameNoteAhead 同一时刻另一侧的下一个事件才是音符相同的那个
+	sameNoteAhead := func(event ExecutionEvent, events []ExecutionEvent, k int) bool {
+		return k < len(events) && events[k].Note == event.Note &&
+			math.Abs(events[k].TimestampMS-event.TimestampMS) <= diffAlignToleranceMS
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && aligned(i, j) &&
+			(eventsA[i].Note == eventsB[j].Note ||
+				!sameNoteAhead(eventsA[i], eventsB, j+1) && !sameNoteAhead(eventsB[j], eventsA, i+1)):
+			diff.compareEvents(i, j, eventsA[i], eventsB[j])
+			diff.Matched++
+			i++
+			j++
+		case j < m && (i >= n || eventsB[j].TimestampMS < eventsA[i].TimestampMS ||
+			aligned(i, j) && sameNoteAhead(eventsA[i], eventsB, j+1)):
+			diff.Added++
+			diff.Entries = append(diff.Entries, ExecDiffEntry{
+				Kind: "added", IndexB: j + 1, Note: eventsB[j].Note, Bar: eventsB[j].Bar,
+				TimestampB: eventsB[j].TimestampMS, Detail: "B中新增",
+			})
+			j++
+		default:
+			diff.Removed++
+			diff.Entries = append(diff.Entries, ExecDiffEntry{
+				Kind: "removed", IndexA: i + 1, Note: eventsA[i].Note, Bar: eventsA[i].Bar,
+				TimestampA: eventsA[i].TimestampMS, Detail: "B中删除",
+			})
+			i++
+		}
+	}
+
+	return diff
+}
+
+// compareEvents 比较一对已对齐的事件
+func (diff *ExecDiff) compareEvents(i, j int, a, b ExecutionEvent) {
+	entry := ExecDiffEntry{
+		IndexA: i + 1, IndexB: j + 1, Note: a.Note, Bar: a.Bar,
+		TimestampA: a.TimestampMS, TimestampB: b.TimestampMS,
+	}
+
+	if a.Note != b.Note {
+		e := entry
+		e.Kind = "note"
+		e.Detail = fmt.Sprintf("音符 %s→%s", a.Note, b.Note)
+		diff.Entries = append(diff.Entries, e)
+		diff.Notes++
+	}
+
+	delta := b.TimestampMS - a.TimestampMS
+	durationDelta := b.DurationMS - a.DurationMS
+	if math.Abs(delta) > diffTimingToleranceMS || math.Abs(durationDelta) > diffTimingToleranceMS {
+		e := entry
+		e.Kind = "timing"
+		e.DeltaMS = delta
+		e.Detail = fmt.Sprintf("时间 %.1f→%.1fms (%+.1f), 时长 %.1f→%.1fms (%+.1f)",
+			a.TimestampMS, b.TimestampMS, delta, a.DurationMS, b.DurationMS, durationDelta)
+		diff.Entries = append(diff.Entries, e)
+		diff.Timing++
+	}
+
+	if a.SerialCmd != b.SerialCmd {
+		e := entry
+		e.Kind = "serial"
+		e.Detail = fmt.Sprintf("气泵命令 %q→%q", a.SerialCmd, b.SerialCmd)
+		diff.Entries = append(diff.Entries, e)
+		diff.Serial++
+	}
+
+	for _, hand := range []string{"left", "right"} {
+		frameA, frameB := findHandFrame(a.Frames, hand), findHandFrame(b.Frames, hand)
+		bytesA, bytesB := "", ""
+		if frameA != nil {
+			bytesA = formatFrameBytes(frameA.Data)
+		}
+		if frameB != nil {
+			bytesB = formatFrameBytes(frameB.Data)
+		}
+		if bytesA == bytesB {
+			continue
+		}
+		e := entry
+		e.Kind = "frames"
+		e.Hand = hand
+		e.Detail = fmt.Sprintf("%s [%s]→[%s]", hand, bytesA, bytesB)
+		diff.Entries = append(diff.Entries, e)
+		diff.Frames++
+	}
+}
+
+// findHandFrame 查找指定手的CAN帧
+func findHandFrame(frames []ExecCANFrame, hand string) *ExecCANFrame {
+	for i := range frames {
+		if frames[i].Hand == hand {
+			return &frames[i]
+		}
+	}
+	return nil
+}
+
+// diffMeta 对比元数据中影响演奏的字段
+func diffMeta(a, b SequenceMeta) []string {
+	var changes []string
+	add := func(name string, va, vb any) {
+		if fmt.Sprint(va) != fmt.Sprint(vb) {
+			changes = append(changes, fmt.Sprintf("%s: %v → %v", name, va, vb))
+		}
+	}
+	add("源文件", a.SourceFile, b.SourceFile)
+	add("乐器", a.Instrument, b.Instrument)
+	add("BPM", a.BPM, b.BPM)
+	add("拍号", a.TimeSignature, b.TimeSignature)
+	add("吐音延迟", a.TonguingDelay, b.TonguingDelay)
+	add("换指提前量", a.FingerLeadMS, b.FingerLeadMS)
+	add("换指降压", a.SwitchDipMS, b.SwitchDipMS)
+	add("版本", a.Version, b.Version)
+	add("总时长(ms)", a.TotalDurationMS, b.TotalDurationMS)
+	add("事件数", a.TotalEvents, b.TotalEvents)
+	add("时间轴哈希", a.TimelineHash, b.TimelineHash)
+	add("指法哈希", a.FingeringHash, b.FingeringHash)
+	add("配置哈希", a.ConfigHash, b.ConfigHash)
+	return changes
+}
+
+// PrintExecDiff 打印对比结果
+func PrintExecDiff(fileA, fileB string, diff *ExecDiff) {
+	fmt.Printf("🔍 对比执行序列\n   A: %s\n   B: %s\n", fileA, fileB)
+
+	if len(diff.MetaChanges) > 0 {
+		fmt.Println("\n元数据差异:")
+		for _, change := range diff.MetaChanges {
+			fmt.Printf("   %s\n", change)
+		}
+	}
+
+	if len(diff.Entries) > 0 {
+		fmt.Println("\n事件差异:")
+		fmt.Printf("%-8s %5s %5s %5s %-12s %s\n", "类型", "A#", "B#", "小节", "事件", "说明")
+		fmt.Println(strings.Repeat("-", 90))
+		for _, e := range diff.Entries {
+			indexA, indexB := "-", "-"
+			if e.IndexA > 0 {
+				indexA = fmt.Sprint(e.IndexA)
+			}
+			if e.IndexB > 0 {
+				indexB = fmt.Sprint(e.IndexB)
+			}
+			detail := e.Detail
+			switch e.Kind {
+			case "added":
+				detail = fmt.Sprintf("%s @ %.1fms", detail, e.TimestampB)
+			case "removed":
+				detail = fmt.Sprintf("%s @ %.1fms", detail, e.TimestampA)
+			}
+			bar := "-"
+			if e.Bar > 0 {
+				bar = fmt.Sprint(e.Bar)
+			}
+			fmt.Printf("%-8s %5s %5s %5s %-12s %s\n", e.Kind, indexA, indexB, bar, e.Note, detail)
+		}
+	}
+
+	fmt.Printf("\n📊 按时间对齐 %d 个事件（容差 %.0fms）: 音符变化 %d, 时间变化 %d, 帧变化 %d, 气泵命令变化 %d, 新增 %d, 删除 %d\n",
+		diff.Matched, diffAlignToleranceMS, diff.Notes, diff.Timing, diff.Frames, diff.Serial, diff.Added, diff.Removed)
+	if len(diff.MetaChanges) == 0 && len(diff.Entries) == 0 {
+		fmt.Println("✅ 两个执行序列完全一致")
+	}
+}
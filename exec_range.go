@@ -0,0 +1,135 @@
+package main
+
+import "fmt"
+
+////////////////////////////////////////////////////////////////////////////////
+// 按小节截取执行序列 - 排练时从指定小节开始、循环演奏某几个小节
+////////////////////////////////////////////////////////////////////////////////
+//
+// 截取 [fromBar, toBar] 内的事件并把时间戳平移到0：
+//   - 开头插入 SEEK 事件，恢复截取起点处的指法与气泵状态（起点可能落在长音或吐音中间）
+//   - 结尾插入 END 事件，关闭气泵并松开手指
+//   - 起点/终点切断的空拍标记去掉，保证 rest_start/rest_end 仍然配对
+
+// ExtractBarRange 截取 [fromBar, toBar] 小节的执行序列（toBar 为0表示到乐曲结尾）
+func ExtractBarRange(sequence *ExecutionSequence, fromBar, toBar int) (*ExecutionSequence, error) {
+	lastBar := 0
+	for _, event := range sequence.Events {
+		if event.Note != "END" {
+			lastBar = max(lastBar, event.Bar)
+		}
+	}
+	if lastBar == 0 {
+		return nil, fmt.Errorf("执行序列没有小节信息（旧版本生成），请重新预处理后再按小节播放")
+	}
+	if fromBar < 1 || fromBar > lastBar {
+		return nil, fmt.Errorf("起始小节 %d 无效（乐曲共%d小节）", fromBar, lastBar)
+	}
+	if toBar == 0 {
+		toBar = lastBar
+	}
+	if toBar < fromBar || toBar > lastBar {
+		return nil, fmt.Errorf("小节范围 %d-%d 无效（乐曲共%d小节）", fromBar, toBar, lastBar)
+	}
+
+	startIndex := -1
+	endIndex := len(sequence.Events)
+	for i, event := range sequence.Events {
+		if startIndex < 0 && event.Bar >= fromBar {
+			startIndex = i
+		}
+		if event.Bar > toBar || event.Note == "END" {
+			endIndex = i
+			break
+		}
+	}
+	if startIndex < 0 || startIndex >= endIndex {
+		return nil, fmt.Errorf("第%d-%d小节没有可演奏的事件", fromBar, toBar)
+	}
+
+	startMS := sequence.Events[startIndex].TimestampMS
+	endMS := sequence.Meta.TotalDurationMS
+	if endIndex < len(sequence.Events) {
+		endMS = sequence.Events[endIndex].TimestampMS
+	}
+
+	// 起点处的指法（每个设备最后一帧）与气泵状态
+	latestFrames := map[string]ExecCANFrame{}
+	var frameOrder []string
+	pumpOn := false
+	for _, event := range sequence.Events[:startIndex] {
+		for _, frame := range event.Frames {
+			key := frame.Hand + "/" + frame.ID
+			if _, ok := latestFrames[key]; !ok {
+				frameOrder = append(frameOrder, key)
+			}
+			latestFrames[key] = frame
+		}
+		switch event.SerialCmd {
+		case "on":
+			pumpOn = true
+		case "off":
+			pumpOn = false
+		}
+	}
+
+	first := sequence.Events[startIndex]
+	seek := ExecutionEvent{
+		TimestampMS: 0,
+		Note:        "SEEK",
+		Bar:         first.Bar,
+		BeatInBar:   first.BeatInBar,
+	}
+	for _, key := range frameOrder {
+		seek.Frames = append(seek.Frames, latestFrames[key])
+	}
+	if pumpOn && first.SerialCmd == "" {
+		seek.SerialCmd = "on"
+	}
+
+	result := &ExecutionSequence{Meta: sequence.Meta}
+	if len(seek.Frames) > 0 || seek.SerialCmd != "" {
+		result.Events = append(result.Events, seek)
+	}
+
+	restOpen := false
+	for _, event := range sequence.Events[startIndex:endIndex] {
+		event.TimestampMS -= startMS
+		switch event.Marker {
+		case MarkerRestStart:
+			restOpen = true
+		case MarkerRestEnd:
+			if !restOpen {
+				event.Marker = "" // 起点落在空拍中间
+			}
+			restOpen = false
+		}
+		result.Events = append(result.Events, event)
+	}
+	if restOpen {
+		// 终点落在空拍中间：去掉最后一个未结束的空拍开始标记
+		for i := len(result.Events) - 1; i >= 0; i-- {
+			if result.Events[i].Marker == MarkerRestStart {
+				result.Events[i].Marker = ""
+				break
+			}
+		}
+	}
+
+	end := ExecutionEvent{
+		TimestampMS: endMS - startMS,
+		Note:        "END",
+		SerialCmd:   "off",
+		Bar:         toBar + 1,
+		BeatInBar:   1,
+	}
+	if last := sequence.Events[len(sequence.Events)-1]; last.Note == "END" {
+		end.Frames = last.Frames
+	}
+	result.Events = append(result.Events, end)
+
+	result.Meta.TotalDurationMS = endMS - startMS
+	result.Meta.TotalEvents = len(result.Events)
+	result.Meta.SourceFile = fmt.Sprintf("%s#%d-%d", sequence.Meta.SourceFile, fromBar, toBar)
+	return result, nil
+}
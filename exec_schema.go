@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 执行序列格式版本、迁移与校验
+////////////////////////////////////////////////////////////////////////////////
+
+// ExecSchemaVersion 当前执行序列格式版本
+// 只有字段含义或必需性改变时才升级版本；新增可选字段（旧文件留空即可）不升级
+// 版本历史：
+//
+//	1.0 - 初始格式
+//	1.1 - 空拍 rest_start/rest_end 标记；元数据记录换指提前量、空拍预切换与显著空拍阈值
+//	1.2 - 串口命令新增 "set N"（颤音PWM），旧程序无法执行
+const ExecSchemaVersion = "1.2"
+
+// maxValidationIssues 校验错误最多列出的条数（避免损坏文件刷屏）
+const maxValidationIssues = 20
+
+// execMigrations 版本迁移表：旧版本 → 升级函数（每次升级一个版本，依次执行到当前版本）
+var execMigrations = map[string]func(*ExecutionSequence){
+	"1.0": migrateExec10To11,
+	"1.1": migrateExec11To12,
+}
+
+// 串口命令词表（空字符串表示不控制气泵；另外接受 "set N" 形式的PWM命令，见 parsePumpSetCommand）
+var execSerialCommands = map[string]bool{
+	"":    true,
+	"on":  true,
+	"off": true,
+}
+
+// MigrateExecutionSequence 将旧版本执行序列升级到当前版本
+// 主版本号不同或版本号比当前程序更新时拒绝加载，提示重新预处理或升级程序
+func MigrateExecutionSequence(sequence *ExecutionSequence) error {
+	version := sequence.Meta.Version
+	if version == "" {
+		return fmt.Errorf("执行序列缺少版本号，无法识别格式，请重新预处理")
+	}
+
+	major, minor, err := parseExecVersion(version)
+	if err != nil {
+		return fmt.Errorf("执行序列版本号 %q 无效: %v", version, err)
+	}
+	curMajor, curMinor, _ := parseExecVersion(ExecSchemaVersion)
+	if major != curMajor || minor > curMinor {
+		return fmt.Errorf("执行序列版本 %s 与当前程序支持的版本 %s 不兼容，请使用当前程序重新预处理", version, ExecSchemaVersion)
+	}
+
+	for sequence.Meta.Version != ExecSchemaVersion {
+		migrate, ok := execMigrations[sequence.Meta.Version]
+		if !ok {
+			return fmt.Errorf("不支持从版本 %s 升级执行序列，请重新预处理", sequence.Meta.Version)
+		}
+		from := sequence.Meta.Version
+		migrate(sequence)
+		fmt.Printf("🔁 执行序列已从版本 %s 升级到 %s\n", from, sequence.Meta.Version)
+	}
+
+	return nil
+}
+
+// parseExecVersion 解析"主版本.次版本"格式的版本号
+func parseExecVersion(version string) (int, int, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("格式应为 主版本.次版本")
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return major, minor, nil
+}
+
+// migrateExec10To11 为1.0版本序列补齐空拍标记
+// 旧版REST事件只覆盖空拍的前80%，空拍实际结束于其后第一个非预切换（PRE_）事件
+func migrateExec10To11(sequence *ExecutionSequence) {
+	msPerBeat := (60.0 / sequence.Meta.BPM) * 1000.0
+	events := make([]ExecutionEvent, 0, len(sequence.Events))
+
+	for i := 0; i < len(sequence.Events); i++ {
+		event := sequence.Events[i]
+		if event.Note != "REST" {
+			events = append(events, event)
+			continue
+		}
+
+		// 查找空拍结束时刻
+		endMS := event.TimestampMS + event.DurationMS
+		j := i + 1
+		for j < len(sequence.Events) && strings.HasPrefix(sequence.Events[j].Note, "PRE_") {
+			j++
+		}
+		if j < len(sequence.Events) {
+			endMS = sequence.Events[j].TimestampMS
+		}
+
+		event.Marker = MarkerRestStart
+		event.Beats = (endMS - event.TimestampMS) / msPerBeat
+		events = append(events, event)
+
+		// 在预切换事件之后插入结束标记，保持时间戳单调
+		events = append(events, sequence.Events[i+1:j]...)
+		events = append(events, ExecutionEvent{
+			TimestampMS: endMS,
+			Note:        "REST_END",
+			Marker:      MarkerRestEnd,
+		})
+		i = j - 1
+	}
+
+	// 旧版固定按最后20%预切换，显著空拍阈值为≥4拍或≥1秒
+	sequence.Events = events
+	sequence.Meta.TotalEvents = len(events)
+	sequence.Meta.RestPreSwitchRatio = 0.2
+	sequence.Meta.SignificantRestBeats = 4.0
+	sequence.Meta.SignificantRestMS = 1000.0
+	sequence.Meta.Version = "1.1"
+}
+
+// migrateExec11To12 1.1 → 1.2：只扩展了串口命令词表，旧文件内容无需改动
+func migrateExec11To12(sequence *ExecutionSequence) {
+	sequence.Meta.Version = "1.2"
+}
+
+// ValidateExecutionSequence 校验执行序列内容
+// 检查项：版本、事件总数、时间戳单调、手部标识、CAN帧格式、串口命令词表、空拍标记配对、小节号
+// 问题描述中带上小节位置（如有），便于对照乐谱定位
+func ValidateExecutionSequence(sequence *ExecutionSequence) error {
+	var issues []string
+	addIssue := func(format string, args ...any) {
+		issues = append(issues, fmt.Sprintf(format, args...))
+	}
+
+	if sequence.Meta.Version != ExecSchemaVersion {
+		addIssue("版本 %s 不是当前版本 %s", sequence.Meta.Version, ExecSchemaVersion)
+	}
+	if sequence.Meta.BPM <= 0 {
+		addIssue("BPM无效: %v", sequence.Meta.BPM)
+	}
+	if len(sequence.Events) == 0 {
+		addIssue("事件列表为空")
+	}
+	if sequence.Meta.TotalEvents != len(sequence.Events) {
+		addIssue("事件总数不一致: 元数据 %d, 实际 %d", sequence.Meta.TotalEvents, len(sequence.Events))
+	}
+
+	lastTimestamp := 0.0
+	restOpen := false
+	for i, event := range sequence.Events {
+		label := fmt.Sprintf("事件%d(%s)", i+1, event.Note)
+		if event.Bar > 0 {
+			label = fmt.Sprintf("事件%d(%s, %s)", i+1, event.Note, FormatBarBeat(event.Bar, event.BeatInBar))
+		}
+
+		if math.IsNaN(event.TimestampMS) || event.TimestampMS < 0 {
+			addIssue("%s 时间戳无效: %v", label, event.TimestampMS)
+		} else if event.TimestampMS < lastTimestamp {
+			addIssue("%s 时间戳倒退: %.3fms < %.3fms", label, event.TimestampMS, lastTimestamp)
+		} else {
+			lastTimestamp = event.TimestampMS
+		}
+		if event.DurationMS < 0 {
+			addIssue("%s 持续时长为负: %.3fms", label, event.DurationMS)
+		}
+		if event.Bar < 0 || (event.Bar > 0 && event.BeatInBar < 1) {
+			addIssue("%s 小节位置无效: 第%d小节第%v拍", label, event.Bar, event.BeatInBar)
+		}
+
+		for j, frame := range event.Frames {
+			if frame.Hand != "left" && frame.Hand != "right" {
+				addIssue("%s 第%d帧手部标识未知: %q", label, j+1, frame.Hand)
+			}
+			var id uint32
+			if _, err := fmt.Sscanf(frame.ID, "0x%X", &id); err != nil {
+				addIssue("%s 第%d帧设备ID无效: %q", label, j+1, frame.ID)
+			}
+			if len(frame.Data) != 7 {
+				addIssue("%s 第%d帧长度应为7字节，实际 %d", label, j+1, len(frame.Data))
+			} else if frame.Data[0] != OpCode {
+				addIssue("%s 第%d帧操作码应为0x%02X，实际 0x%02X", label, j+1, OpCode, frame.Data[0])
+			}
+		}
+
+		if _, isSet := parsePumpSetCommand(event.SerialCmd); !execSerialCommands[event.SerialCmd] && !isSet {
+			addIssue("%s 未知的串口命令: %q", label, event.SerialCmd)
+		}
+
+		switch event.Marker {
+		case "":
+		case MarkerRestStart:
+			if restOpen {
+				addIssue("%s 空拍开始标记前的空拍未结束", label)
+			}
+			restOpen = true
+		case MarkerRestEnd:
+			if !restOpen {
+				addIssue("%s 空拍结束标记没有对应的开始标记", label)
+			}
+			restOpen = false
+		default:
+			addIssue("%s 未知的时间标记: %q", label, event.Marker)
+		}
+	}
+	if restOpen {
+		addIssue("最后一个空拍缺少结束标记")
+	}
+	if len(sequence.Events) > 0 && lastTimestamp > sequence.Meta.TotalDurationMS+1 {
+		addIssue("最后事件时间 %.3fms 超出总时长 %.3fms", lastTimestamp, sequence.Meta.TotalDurationMS)
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+	if len(issues) > maxValidationIssues {
+		more := len(issues) - maxValidationIssues
+		issues = append(issues[:maxValidationIssues], fmt.Sprintf("……另有%d个问题", more))
+	}
+	return fmt.Errorf("执行序列校验失败（%d项）: %s", len(issues), strings.Join(issues, "; "))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// 输入哈希（检测过期的执行文件）
+////////////////////////////////////////////////////////////////////////////////
+
+// ComputeConfigHash 计算影响指定乐器CAN帧与时序的配置字段哈希
+// 只纳入与该乐器相关的字段，修改另一种乐器的力度不会使本乐器的执行文件过期
+func ComputeConfigHash(cfg Config, instrument string) string {
+	relevant := map[string]any{
+		"left_id":  cfg.Hands.Left.ID,
+		"right_id": cfg.Hands.Right.ID,
+		"timing":   cfg.TimingFor(instrument),
+	}
+	// 未启用表情设置时不纳入，保持已有执行文件的哈希不变
+	if cfg.Expression.Enabled() {
+		relevant["expression"] = cfg.Expression
+	}
+	if cfg.Breath != (BreathConfig{}) {
+		relevant["breath"] = cfg.Breath
+	}
+	if instrument == "sn" {
+		relevant["left_press"] = cfg.SnLeftPressProfile
+		relevant["left_release"] = cfg.SnLeftReleaseProfile
+		relevant["right_press"] = cfg.SnRightPressProfile
+		relevant["right_release"] = cfg.SnRightReleaseProfile
+		relevant["high_thumb"] = cfg.SnLeftHighThumb
+		relevant["high_pro_thumb"] = cfg.SnLeftHighProThumb
+	} else {
+		relevant["left_press"] = cfg.SksLeftPressProfile
+		relevant["left_release"] = cfg.SksLeftReleaseProfile
+		relevant["right_press"] = cfg.SksRightPressProfile
+		relevant["right_release"] = cfg.SksRightReleaseProfile
+	}
+	return hashJSON(relevant)
+}
+
+// ComputeFingeringHash 计算指法映射的内容哈希（按音符排序，与YAML书写顺序无关）
+func ComputeFingeringHash(fingeringMap map[string]FingeringEntry) string {
+	notes := make([]string, 0, len(fingeringMap))
+	for note := range fingeringMap {
+		notes = append(notes, note)
+	}
+	sort.Strings(notes)
+
+	entries := make([]FingeringEntry, 0, len(notes))
+	for _, note := range notes {
+		entries = append(entries, fingeringMap[note])
+	}
+	return hashJSON(entries)
+}
+
+// hashJSON 对值的JSON序列化结果计算SHA-256（取前16个十六进制字符）
+// encoding/json 对 map 按键排序输出，结果稳定
+func hashJSON(value any) string {
+	data, _ := json.Marshal(value)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// hashFile 计算文件内容哈希
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("读取文件失败: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// combineInputHashes 组合时间轴、指法、配置、参数四个哈希为编译缓存键
+func combineInputHashes(meta SequenceMeta) string {
+	return hashJSON([]string{meta.TimelineHash, meta.FingeringHash, meta.ConfigHash, meta.ParamsHash})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -22,19 +23,28 @@ type ExecutionEngine struct {
 	cfg         Config
 	httpClient  *http.Client
 	utils       *Utils
-	restTimings []RestTiming // 休止符时间记录
-	actualStart time.Time    // 实际开始时间
-	actualEnd   time.Time    // 实际结束时间
+	restTimings []RestTiming     // 休止符时间记录
+	actualStart time.Time        // 实际开始时间
+	actualEnd   time.Time        // 实际结束时间
+	startAt     time.Time        // 预定开始时刻（零值表示立即开始）
+	fromBar     int              // 按小节截取播放的起始小节（0表示完整播放）
+	toBar       int              // 按小节截取播放的结束小节
+	loop        int              // 循环次数（0或1演奏一遍，-1表示直到停止）
+	played      int              // 本次演奏开始过的遍数（Play 记录，循环播放时用于计算理论时长）
+	execFile    string           // 执行序列文件路径（写入演奏报告）
+	recorder    *SessionRecorder // 演奏报告收集器（会话演奏时创建，为 nil 时不记录）
+	arms        *ArmRoutine      // 手臂编排（为 nil 时只演奏）
 }
 
 // RestTiming 休止符时间记录
 type RestTiming struct {
-	StartTime     time.Time // 休止符开始时间
-	EndTime       time.Time // 休止符结束时间
-	Duration      float64   // 持续时长（秒）
-	DurationMS    float64   // 持续时长（毫秒）
+	StartTime     time.Time // 休止符开始时间（实际）
+	EndTime       time.Time // 休止符结束时间（实际）
+	Duration      float64   // 实际持续时长（秒）
+	StartMS       float64   // 计划开始时间戳（毫秒）
+	DurationMS    float64   // 计划持续时长（毫秒，由 rest_start/rest_end 标记精确得出）
 	Beats         float64   // 拍数
-	IsSignificant bool      // 是否为显著空拍（≥4拍或≥1秒）
+	IsSignificant bool      // 是否为显著空拍（拍数或时长达到序列元数据中的阈值）
 }
 
 // NewExecutionEngine 创建新的执行引擎
@@ -50,9 +60,110 @@ func NewExecutionEngine(sequenceFile string, cfg Config) (*ExecutionEngine, erro
 		cfg:        cfg,
 		httpClient: InitGlobalHTTPClient(),
 		utils:      NewUtils(),
+		execFile:   sequenceFile,
 	}, nil
 }
 
+// SetRange 设置按小节截取与循环播放（排练用）
+// fromBar 为0表示从头开始，toBar 为0表示到结尾；loop 为循环次数，-1表示循环直到停止
+func (ee *ExecutionEngine) SetRange(fromBar, toBar, loop int) error {
+	if loop < -1 {
+		return fmt.Errorf("循环次数无效: %d", loop)
+	}
+	if fromBar > 0 || toBar > 0 {
+		if fromBar == 0 {
+			fromBar = 1
+		}
+		ranged, err := ExtractBarRange(ee.sequence, fromBar, toBar)
+		if err != nil {
+			return err
+		}
+		ee.sequence = ranged
+		ee.fromBar = fromBar
+		ee.toBar = ranged.Events[len(ranged.Events)-1].Bar - 1 // 截取序列的END标注在结束小节的下一小节
+	}
+	ee.loop = loop
+	return nil
+}
+
+// SetArmRoutine 设置手臂编排：演奏前抬臂并下发预姿态，演奏后释放手指并落臂（nil 表示只演奏）
+func (ee *ExecutionEngine) SetArmRoutine(arms *ArmRoutine) {
+	ee.arms = arms
+}
+
+// Perform 首音之前的姿态 → 演奏并关闭气泵 → 末音之后的收尾（after 姿态或预备手势）
+// 设置了手臂编排时在编排中演奏（姿态、释放手指与落臂都在其中完成）
+func (ee *ExecutionEngine) Perform(ctx context.Context) error {
+	instrument := ee.sequence.Meta.Instrument
+	play := func(ctx context.Context) error {
+		err := ee.Play(ctx)
+		// 播放结束处理 - 确保气泵关闭
+		if globalPumpController != nil {
+			GlobalPumpOff()
+		}
+		return err
+	}
+	if ee.arms != nil {
+		return ee.arms.Run(ctx, instrument, play)
+	}
+
+	err := RunPosture(ctx, ee.cfg, instrument, PostureBefore)
+	if err == nil {
+		err = play(ctx)
+	}
+	// 收尾不随会话停止而中断；急停后不再移动手指（保持急停发出的释放状态）
+	if ee.endsWithGesture() && !globalEStop.Latched() {
+		if endErr := NewReadyGestureController().ExecuteEndGesture(ee.cfg, instrument); endErr != nil {
+			fmt.Printf("⚠️  收尾姿态失败: %v\n", endErr)
+		}
+	}
+	return err
+}
+
+// endsWithGesture 演奏结束时是否下发收尾姿态（after 姿态序列、预备手势或手臂编排）
+func (ee *ExecutionEngine) endsWithGesture() bool {
+	return ee.arms != nil || ee.cfg.Ready.Enabled || HasPosture(ee.cfg, ee.sequence.Meta.Instrument, PostureAfter)
+}
+
+// passes 演奏遍数（-1表示直到停止）
+func (ee *ExecutionEngine) passes() int {
+	if ee.loop == 0 {
+		return 1
+	}
+	return ee.loop
+}
+
+// theoreticalDurationSec 本次演奏的理论时长（秒）：每遍时长 × 演奏过的遍数（中途停止时含未演奏完的那一遍）
+func (ee *ExecutionEngine) theoreticalDurationSec() float64 {
+	return ee.sequence.Meta.TotalDurationMS * float64(max(ee.played, 1)) / 1000.0
+}
+
+// SetStartAt 设置预定开始时刻（合奏时由协调者统一下发，为领队时间）
+// 播放前等待到该时刻，之后所有事件按"开始时刻+时间戳"在领队时间轴上调度，逐个换算为本机时刻
+func (ee *ExecutionEngine) SetStartAt(startAt time.Time) {
+	ee.startAt = startAt
+}
+
+// waitForStart 等待到预定开始时刻（可被停止信号中断）
+func (ee *ExecutionEngine) waitForStart(ctx context.Context) error {
+	wait := time.Until(LeaderToLocal(ee.startAt))
+	if wait <= 0 {
+		fmt.Printf("⚠️  预定开始时刻已过 %v，立即开始\n", (-wait).Round(time.Millisecond))
+		return nil
+	}
+
+	fmt.Printf("⏰ 等待预定开始时刻 %s（领队时间，%v后）\n", ee.startAt.Format("15:04:05.000"), wait.Round(time.Millisecond))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		fmt.Println("⏹️  等待开始期间收到停止信号")
+		return playbackCause(ctx)
+	}
+}
+
 // loadExecutionSequence 加载执行序列文件
 func loadExecutionSequence(filepath string) (*ExecutionSequence, error) {
 	data, err := os.ReadFile(filepath)
@@ -60,16 +171,55 @@ func loadExecutionSequence(filepath string) (*ExecutionSequence, error) {
 		return nil, fmt.Errorf("读取文件失败: %v", err)
 	}
 
-	var sequence ExecutionSequence
-	if err := json.Unmarshal(data, &sequence); err != nil {
-		return nil, fmt.Errorf("解析JSON失败: %v", err)
+	// 按魔数自动识别二进制格式，否则按JSON解析
+	var sequence *ExecutionSequence
+	if IsBinaryExecFile(data) {
+		sequence, err = DecodeExecutionSequenceBinary(data)
+		if err != nil {
+			return nil, fmt.Errorf("解析二进制执行序列失败: %v", err)
+		}
+	} else {
+		sequence = &ExecutionSequence{}
+		if err := json.Unmarshal(data, sequence); err != nil {
+			return nil, fmt.Errorf("解析JSON失败: %v", err)
+		}
+	}
+
+	// 旧版本文件升级到当前格式，并校验内容
+	if err := MigrateExecutionSequence(sequence); err != nil {
+		return nil, err
+	}
+	if err := ValidateExecutionSequence(sequence); err != nil {
+		return nil, err
 	}
 
-	return &sequence, nil
+	return sequence, nil
+}
+
+// saveExecutionSequence 保存执行序列到文件
+// 扩展名为 .bin 时使用紧凑二进制格式，否则为格式化JSON
+func saveExecutionSequence(sequence *ExecutionSequence, outputFile string) error {
+	var data []byte
+	var err error
+	if isBinaryExecPath(outputFile) {
+		data, err = EncodeExecutionSequenceBinary(sequence)
+	} else {
+		data, err = json.MarshalIndent(sequence, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("序列化失败: %v", err)
+	}
+
+	if err := os.WriteFile(outputFile, data, 0644); err != nil {
+		return fmt.Errorf("写入文件失败: %v", err)
+	}
+
+	return nil
 }
 
 // Play 执行播放（极简版本，主程序只负责时间控制）
-func (ee *ExecutionEngine) Play() error {
+// ctx 取消时立即返回其原因（ErrUserStopped/ErrPlaybackReplaced），急停时返回 ErrEmergencyStop
+func (ee *ExecutionEngine) Play(ctx context.Context) error {
 	fmt.Printf("🎵 开始执行播放\n")
 	fmt.Printf("   文件: %s\n", ee.sequence.Meta.SourceFile)
 	fmt.Printf("   乐器: %s, BPM: %.1f\n", ee.sequence.Meta.Instrument, ee.sequence.Meta.BPM)
@@ -77,68 +227,100 @@ func (ee *ExecutionEngine) Play() error {
 		ee.sequence.Meta.TotalEvents,
 		ee.sequence.Meta.TotalDurationMS/1000.0)
 
+	ee.played = 0
+
+	// 急停锁定期间拒绝演奏；急停触发时上下文被取消，演奏循环立即退出
+	if err := globalEStop.Check(); err != nil {
+		return err
+	}
+	ctx, cancel := globalEStop.WithEStop(ctx)
+	defer cancel()
+
+	// 合奏模式：等待统一的开始时刻
+	if !ee.startAt.IsZero() {
+		if err := ee.waitForStart(ctx); err != nil {
+			return err
+		}
+	}
+
+	// 合奏模式下时间轴基准为领队时间：以预定时刻为基准（消除唤醒延迟），
+	// 每个事件的计划时刻单独换算为本机时刻，长曲目中两机的时钟漂移也会被补偿
+	leaderTimeline := !ee.startAt.IsZero()
 	startTime := time.Now()
-	ee.actualStart = startTime
-	lastTimestamp := 0.0
-
-	// 计算每拍的毫秒数
-	msPerBeat := (60.0 / ee.sequence.Meta.BPM) * 1000.0
-
-	for i, event := range ee.sequence.Events {
-		// 检查停止信号
-		select {
-		case <-playbackController.stopChan:
-			fmt.Println("⏹️  收到停止信号，正在关闭气泵...")
-			// 立即关闭气泵
-			if globalPumpController != nil {
-				GlobalPumpOff()
-				fmt.Println("🔴 气泵已紧急关闭")
-			}
-			return ErrUserStopped
-		default:
+	if leaderTimeline {
+		startTime = LeaderNow()
+		if ee.startAt.After(startTime.Add(-time.Second)) {
+			startTime = ee.startAt
 		}
+	}
+	ee.actualStart = time.Now()
+	ee.recorder.Begin(ee.actualStart)
+	pumpGuard := globalPumpGuard.Load()
+	pumpGuard.PlaybackStarted()
+	defer pumpGuard.PlaybackStopped()
+	if ee.fromBar > 0 {
+		fmt.Printf("   小节范围: 第%d-%d小节\n", ee.fromBar, ee.toBar)
+	}
 
-		// 更新进度
-		ee.updateProgress(i+1, len(ee.sequence.Events))
+	// 循环播放时每一遍的时间轴依次后移一个区间长度（上一遍的END与下一遍的起点在同一时刻）
+	passDurationMS := ee.sequence.Meta.TotalDurationMS
+	pass := 0
+	for ; ee.passes() < 0 || pass < ee.passes(); pass++ {
+		ee.played = pass + 1
+		if ee.passes() != 1 {
+			ee.updatePass(pass + 1)
+		}
+		offsetMS := float64(pass) * passDurationMS
+		reportPass := 0 // 报告中的遍数（单遍演奏时省略）
+		if ee.passes() != 1 {
+			reportPass = pass + 1
+		}
 
-		// 计算需要等待的时间（相对于上一个事件）
-		waitDuration := time.Duration(event.TimestampMS-lastTimestamp) * time.Millisecond
+		for i, event := range ee.sequence.Events {
+			// 检查停止信号
+			if ctx.Err() != nil {
+				return ee.stopped(ctx)
+			}
 
-		// *** 主程序只负责精确时间控制 ***
-		if waitDuration > 0 {
-			time.Sleep(waitDuration)
-		}
+			// 更新进度
+			ee.updateProgress(i+1, len(ee.sequence.Events), event)
 
-		// *** 所有I/O操作异步执行（不阻塞主程序） ***
-		ee.sendFramesAsync(event)
-
-		// 记录休止符时间
-		if event.Note == "REST" {
-			// 记录休止符开始时间
-			restStart := time.Now()
-			beats := event.DurationMS / msPerBeat
-			ee.restTimings = append(ee.restTimings, RestTiming{
-				StartTime:  restStart,
-				DurationMS: event.DurationMS,
-				Beats:      beats,
-			})
-		} else if len(ee.restTimings) > 0 && ee.restTimings[len(ee.restTimings)-1].EndTime.IsZero() {
-			// 记录休止符结束时间
-			idx := len(ee.restTimings) - 1
-			ee.restTimings[idx].EndTime = time.Now()
-			ee.restTimings[idx].Duration = ee.restTimings[idx].EndTime.Sub(ee.restTimings[idx].StartTime).Seconds()
-
-			// 判断是否为显著空拍（≥4拍 或 ≥1秒）
-			if ee.restTimings[idx].Beats >= 4.0 || ee.restTimings[idx].Duration >= 1.0 {
-				ee.restTimings[idx].IsSignificant = true
+			// 计算需要等待的时间（相对于开始时刻的绝对时间，误差不随事件累积）
+			scheduled := startTime.Add(time.Duration((offsetMS + event.TimestampMS) * float64(time.Millisecond)))
+			if leaderTimeline {
+				scheduled = LeaderToLocal(scheduled)
+			}
+			pumpGuard.Feed(scheduled)
+			waitDuration := time.Until(scheduled)
+
+			// *** 主程序只负责精确时间控制 ***
+			if waitDuration > 0 {
+				timer := time.NewTimer(waitDuration)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ee.stopped(ctx)
+				}
 			}
-		}
 
-		lastTimestamp = event.TimestampMS
+			// 记录实际发送时刻相对计划时刻的延迟
+			ee.recorder.Event(i, reportPass, event, offsetMS+event.TimestampMS, time.Since(scheduled))
+
+			// *** 所有I/O操作异步执行（不阻塞主程序） ***
+			ee.sendFramesAsync(ctx, event)
+
+			// 根据空拍标记记录休止符时间
+			ee.recordRestMarker(event)
+		}
 	}
 
 	ee.actualEnd = time.Now()
-	elapsed := time.Since(startTime)
+
+	// 等最后几帧从发送队列发出，再随 defer 取消演奏上下文
+	globalCanSender.Flush(ctx)
+	elapsed := time.Since(ee.actualStart)
+	theoreticalSec := ee.theoreticalDurationSec()
 
 	// 统计显著空拍
 	significantRests := []RestTiming{}
@@ -149,19 +331,22 @@ func (ee *ExecutionEngine) Play() error {
 	}
 
 	fmt.Printf("✅ 播放完成\n")
-	fmt.Printf("   理论时长: %.2fs\n", ee.sequence.Meta.TotalDurationMS/1000.0)
+	if pass > 1 {
+		fmt.Printf("   循环遍数: %d\n", pass)
+	}
+	fmt.Printf("   理论时长: %.2fs\n", theoreticalSec)
 	fmt.Printf("   实际时长: %.2fs\n", elapsed.Seconds())
 	fmt.Printf("   时间误差: %.3fs (%.2f%%)\n",
-		elapsed.Seconds()-ee.sequence.Meta.TotalDurationMS/1000.0,
-		(elapsed.Seconds()-ee.sequence.Meta.TotalDurationMS/1000.0)/(ee.sequence.Meta.TotalDurationMS/1000.0)*100)
+		elapsed.Seconds()-theoreticalSec,
+		(elapsed.Seconds()-theoreticalSec)/theoreticalSec*100)
 	fmt.Printf("   休止符次数: %d (显著空拍: %d)\n", len(ee.restTimings), len(significantRests))
 
 	// 打印显著空拍详情
 	if len(significantRests) > 0 {
-		fmt.Printf("\n📊 显著空拍详情 (≥4拍或≥1秒):\n")
+		fmt.Printf("\n📊 显著空拍详情 (≥%.0f拍或≥%.0fms):\n", ee.sequence.Meta.SignificantRestBeats, ee.sequence.Meta.SignificantRestMS)
 		for i, rest := range significantRests {
-			startOffset := rest.StartTime.Sub(startTime).Seconds()
-			endOffset := rest.EndTime.Sub(startTime).Seconds()
+			startOffset := rest.StartTime.Sub(ee.actualStart).Seconds()
+			endOffset := rest.EndTime.Sub(ee.actualStart).Seconds()
 			fmt.Printf("   空拍%d: 起始%.2fs, 结束%.2fs, 持续%.2fs (%.1f拍)\n",
 				i+1, startOffset, endOffset, rest.Duration, rest.Beats)
 		}
@@ -170,26 +355,77 @@ func (ee *ExecutionEngine) Play() error {
 	return nil
 }
 
-// sendFramesAsync 异步发送所有CAN帧和串口命令
-func (ee *ExecutionEngine) sendFramesAsync(event ExecutionEvent) {
+// recordRestMarker 根据 rest_start/rest_end 标记记录空拍的实际时间
+// 计划时长直接由两个标记的时间戳相减得出，不再从预切换时刻反推
+func (ee *ExecutionEngine) recordRestMarker(event ExecutionEvent) {
+	switch event.Marker {
+	case MarkerRestStart:
+		ee.restTimings = append(ee.restTimings, RestTiming{
+			StartTime: time.Now(),
+			StartMS:   event.TimestampMS,
+			Beats:     event.Beats,
+		})
+	case MarkerRestEnd:
+		if len(ee.restTimings) == 0 || !ee.restTimings[len(ee.restTimings)-1].EndTime.IsZero() {
+			return
+		}
+		rest := &ee.restTimings[len(ee.restTimings)-1]
+		rest.EndTime = time.Now()
+		rest.Duration = rest.EndTime.Sub(rest.StartTime).Seconds()
+		rest.DurationMS = event.TimestampMS - rest.StartMS
+		if rest.Beats <= 0 {
+			rest.Beats = rest.DurationMS / ((60.0 / ee.sequence.Meta.BPM) * 1000.0)
+		}
+
+		// 判断是否为显著空拍（阈值来自序列元数据，旧文件使用默认值）
+		beatsThreshold := ee.sequence.Meta.SignificantRestBeats
+		if beatsThreshold <= 0 {
+			beatsThreshold = 4.0
+		}
+		msThreshold := ee.sequence.Meta.SignificantRestMS
+		if msThreshold <= 0 {
+			msThreshold = 1000.0
+		}
+		rest.IsSignificant = rest.Beats >= beatsThreshold || rest.DurationMS >= msThreshold
+	}
+}
+
+// stopped 演奏被取消：立即关闭气泵并返回取消原因
+func (ee *ExecutionEngine) stopped(ctx context.Context) error {
+	cause := playbackCause(ctx)
+	fmt.Printf("⏹️  收到停止信号（%v），正在关闭气泵...\n", cause)
+	if globalPumpController != nil {
+		GlobalPumpOff()
+		fmt.Println("🔴 气泵已紧急关闭")
+	}
+	return cause
+}
+
+// sendFramesAsync 异步发送所有CAN帧和串口命令（ctx 取消后不再发出）
+func (ee *ExecutionEngine) sendFramesAsync(ctx context.Context, event ExecutionEvent) {
 	// 异步执行串口气泵控制
 	if event.SerialCmd != "" {
-		ee.sendSerialCmd(event.SerialCmd)
+		ee.sendSerialCmd(ctx, event.SerialCmd)
 	}
 
-	// 异步发送所有CAN帧（指法）
+	// 发送所有CAN帧（指法）：同一事件的左右手帧一起入队，桥接服务支持批量发送时在一个请求中到达
 	// len(nil) 返回 0，所以不需要显式检查 nil
+	if ee.cfg.DryRun || len(event.Frames) == 0 {
+		return
+	}
+	msgs := make([]CanMessage, 0, len(event.Frames))
 	for _, frame := range event.Frames {
-		go ee.sendSingleFrame(frame)
+		if msg, ok := ee.frameMessage(frame); ok {
+			msgs = append(msgs, msg)
+		}
 	}
+	ee.utils.SendCanFramesAsync(ctx, ee.cfg, msgs, func(msg CanMessage, err error) {
+		ee.recorder.CanFailure(msg.Interface, msg.Id, err)
+	})
 }
 
-// sendSingleFrame 发送单个CAN帧
-func (ee *ExecutionEngine) sendSingleFrame(frame ExecCANFrame) {
-	if ee.cfg.DryRun {
-		return
-	}
-
+// frameMessage 把执行序列中的CAN帧转换为发往桥接服务的消息
+func (ee *ExecutionEngine) frameMessage(frame ExecCANFrame) (CanMessage, bool) {
 	// 根据逻辑标识（left/right）映射到实际CAN接口
 	var canInterface string
 	switch frame.Hand {
@@ -199,124 +435,132 @@ func (ee *ExecutionEngine) sendSingleFrame(frame ExecCANFrame) {
 		canInterface = ee.cfg.Hands.Right.Interface
 	default:
 		fmt.Printf("⚠️  警告: 未知的手部标识: %s\n", frame.Hand)
-		return
+		return CanMessage{}, false
 	}
 
 	// 解析ID
 	var id uint32
 	fmt.Sscanf(frame.ID, "0x%X", &id)
 
-	// 使用异步发送
-	ee.utils.SendCanFrameAsync(ee.cfg, canInterface, id, frame.Data)
+	return CanMessage{Interface: canInterface, Id: id, Data: frame.Data}, true
 }
 
-// sendSerialCmd 发送串口命令
-func (ee *ExecutionEngine) sendSerialCmd(cmd string) {
+// sendSerialCmd 发送串口命令（ctx 取消后只允许关闭气泵）
+func (ee *ExecutionEngine) sendSerialCmd(ctx context.Context, cmd string) {
 	if globalPumpController == nil {
 		return
 	}
+
+	// 颤音PWM命令 "set N" 每秒几十条，不逐条打印
+	if _, ok := parsePumpSetCommand(cmd); ok {
+		ee.recorder.PumpCommand(cmd, GlobalPumpSendContext(ctx, cmd))
+		return
+	}
 	fmt.Println("给气泵发送命令: ", cmd)
 
 	switch cmd {
-	case "on":
-		GlobalPumpOn()
-	case "off":
-		GlobalPumpOff()
+	case "on", "off":
+		ee.recorder.PumpCommand(cmd, GlobalPumpSendContext(ctx, cmd))
 	}
 }
 
-// updateProgress 更新播放进度
-func (ee *ExecutionEngine) updateProgress(current, total int) {
+// updateProgress 更新播放进度（含当前小节与拍位置）
+func (ee *ExecutionEngine) updateProgress(current, total int, event ExecutionEvent) {
 	playbackController.mutex.Lock()
 	playbackController.status.CurrentNote = current
+	if event.Bar > 0 {
+		playbackController.status.CurrentBar = event.Bar
+		playbackController.status.CurrentBeat = event.BeatInBar
+	}
 	playbackController.status.Progress = float64(current) / float64(total) * 100
 	playbackController.status.ElapsedTime = time.Since(playbackController.startTime).Round(time.Second).String()
 	playbackController.mutex.Unlock()
 }
 
-// PlayAsync 异步执行播放（用于Web API）
-func (ee *ExecutionEngine) PlayAsync() error {
-	// 初始化演奏状态
+// updatePass 更新循环播放的当前遍数
+func (ee *ExecutionEngine) updatePass(pass int) {
 	playbackController.mutex.Lock()
-	playbackController.isRunning = true
-	playbackController.startTime = time.Now()
-	playbackController.instrument = ee.sequence.Meta.Instrument // 设置乐器类型
-	playbackController.config = ee.cfg                          // 设置配置
-	playbackController.status = PlaybackStatus{
-		IsPlaying:   true,
-		CurrentFile: ee.sequence.Meta.SourceFile,
-		CurrentNote: 0,
-		TotalNotes:  ee.sequence.Meta.TotalEvents,
-		Progress:    0,
-	}
+	playbackController.status.Pass = pass
 	playbackController.mutex.Unlock()
+}
 
-	// 开始播放
-	go func() {
-		defer func() {
-			// 确保播放结束时发送完成信号
-			select {
-			case playbackController.doneChan <- true:
-				fmt.Println("📢 播放goroutine: 已发送完成信号")
-			default:
-				fmt.Println("⚠️  播放goroutine: 完成信号通道已满")
-			}
-		}()
-
-		err := ee.Play()
+// PlayAsync 在新的演奏会话中异步播放（用于Web API）：先停止并等待当前会话退出，再开始
+func (ee *ExecutionEngine) PlayAsync(parent context.Context) (*PlaybackSession, error) {
+	return playbackController.Start(parent, ee)
+}
 
-		// 播放结束处理 - 确保气泵关闭
-		if globalPumpController != nil {
-			GlobalPumpOff()
+// runSession 执行演奏会话：播放、关闭气泵、预备手势、汇总结果，最后关闭会话的退出信号
+func (ee *ExecutionEngine) runSession(session *PlaybackSession) {
+	defer close(session.done)
+	defer session.cancel(nil)
+
+	// 启用录制时每个会话一个录制文件（包含收尾的关闭气泵和预备手势）
+	captureFile := ""
+	if ee.cfg.Capture.Enabled {
+		path := sessionCapturePath(ee.cfg, session.ID)
+		if err := globalCapture.Start(path, session.ID, ee.cfg); err != nil {
+			fmt.Printf("⚠️  硬件I/O录制未启动: %v\n", err)
+		} else {
+			captureFile = path
 		}
+	}
 
-		// 执行预备手势（松开手指）
-		if playbackController.config.Ready.Enabled {
-			readyController := NewReadyGestureController()
-			readyController.ExecuteReadyGesture(playbackController.config, ee.sequence.Meta.Instrument)
-		}
+	// 演奏（含首音之前的姿态与末音之后的收尾）
+	ee.recorder = NewSessionRecorder()
+	err := ee.Perform(session.ctx)
+	session.err = err
 
-		// 计算实际播放时长
-		actualDuration := ee.actualEnd.Sub(ee.actualStart).Seconds()
-		theoreticalDuration := ee.sequence.Meta.TotalDurationMS / 1000.0
-
-		// 统计显著空拍
-		significantRests := []RestTimingResponse{}
-		for _, rest := range ee.restTimings {
-			if rest.IsSignificant {
-				startOffset := rest.StartTime.Sub(ee.actualStart).Seconds()
-				// 修正结束时间：因为记录的是预切换时刻（80%处），需要除以0.8得到实际结束时间
-				endOffset := rest.EndTime.Sub(ee.actualStart).Seconds() / 0.8
-				significantRests = append(significantRests, RestTimingResponse{
-					StartOffset: startOffset,
-					EndOffset:   endOffset,
-					Duration:    rest.Duration / 0.8, //修正时长：因为记录的是预切换时刻（80%处），需要除以0.8得到实际时长
-					Beats:       rest.Beats / 0.8,    //修正拍数：因为记录的是预切换时刻（80%处），需要除以0.8得到实际拍数
-				})
-			}
-		}
+	if captureFile != "" {
+		globalCapture.Stop()
+	}
 
-		// 更新播放状态（包含空拍信息）
-		playbackController.mutex.Lock()
-		playbackController.isRunning = false
-		playbackController.status.IsPlaying = false
-		playbackController.status.Progress = 100
-		playbackController.status.TheoreticalDuration = theoreticalDuration
-		playbackController.status.ActualDuration = actualDuration
-		playbackController.status.SignificantRests = significantRests
-		// 保留 CurrentFile、CurrentNote、TotalNotes 以便前端显示
-		playbackController.mutex.Unlock()
+	// 计算实际播放时长
+	actualDuration := ee.actualEnd.Sub(ee.actualStart).Seconds()
+	theoreticalDuration := ee.theoreticalDurationSec()
 
-		if err != nil {
-			if errors.Is(err, ErrUserStopped) {
-				fmt.Printf("⏹️  播放已被用户停止\n")
-			} else {
-				fmt.Printf("❌ 播放出错: %v\n", err)
-			}
-		} else {
-			fmt.Printf("✅ 播放完成，气泵已关闭\n")
+	// 统计显著空拍
+	significantRests := []RestTimingResponse{}
+	for _, rest := range ee.restTimings {
+		if rest.IsSignificant {
+			significantRests = append(significantRests, RestTimingResponse{
+				StartOffset: rest.StartTime.Sub(ee.actualStart).Seconds(),
+				EndOffset:   rest.EndTime.Sub(ee.actualStart).Seconds(),
+				Duration:    rest.Duration,
+				Beats:       rest.Beats,
+			})
 		}
-	}()
+	}
 
-	return nil
+	// 更新播放状态（包含空拍信息）
+	playbackController.mutex.Lock()
+	playbackController.status.IsPlaying = false
+	playbackController.status.Progress = 100
+	playbackController.status.TheoreticalDuration = theoreticalDuration
+	playbackController.status.ActualDuration = actualDuration
+	playbackController.status.SignificantRests = significantRests
+	// 保留 CurrentFile、CurrentNote、TotalNotes 以便前端显示
+	playbackController.mutex.Unlock()
+
+	// 保存演奏报告
+	report := ee.buildSessionReport(session, significantRests)
+	report.CaptureFile = captureFile
+	if err := globalSessionStore.Save(report); err != nil {
+		fmt.Printf("⚠️  保存演奏报告失败: %v\n", err)
+	} else {
+		fmt.Printf("📝 演奏报告已保存: %s（%s，平均延迟%.2fms，CAN失败%d次）\n",
+			report.ID, report.StopReason, report.Lateness.MeanMS, report.CanFailures)
+	}
+
+	switch {
+	case err == nil:
+		fmt.Printf("✅ 播放完成，气泵已关闭（会话 %s）\n", session.ID)
+	case errors.Is(err, ErrUserStopped):
+		fmt.Printf("⏹️  播放已被用户停止（会话 %s）\n", session.ID)
+	case errors.Is(err, ErrPlaybackReplaced):
+		fmt.Printf("⏹️  播放已被新的演奏替换（会话 %s）\n", session.ID)
+	case errors.Is(err, ErrEmergencyStop):
+		fmt.Printf("🚨 播放已被急停中断（会话 %s）\n", session.ID)
+	default:
+		fmt.Printf("❌ 播放出错: %v（会话 %s）\n", err, session.ID)
+	}
 }
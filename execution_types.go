@@ -16,14 +16,35 @@ type ExecutionSequence struct {
 
 // SequenceMeta 执行序列元数据
 type SequenceMeta struct {
-	SourceFile      string    `json:"source_file"`       // 源音乐文件
-	Instrument      string    `json:"instrument"`        // 乐器类型
-	BPM             float64   `json:"bpm"`               // BPM
-	TonguingDelay   int       `json:"tonguing_delay_ms"` // 吐音延迟（毫秒）
-	TotalDurationMS float64   `json:"total_duration_ms"` // 总时长（毫秒）
-	TotalEvents     int       `json:"total_events"`      // 事件总数
-	GeneratedAt     time.Time `json:"generated_at"`      // 生成时间
-	Version         string    `json:"version"`           // 版本号
+	SourceFile           string              `json:"source_file"`                   // 源音乐文件
+	SourcePath           string              `json:"source_path"`                   // 源音乐文件路径（重新编译时使用）
+	Part                 string              `json:"part,omitempty"`                // 多声部总谱中的声部名（单声部为空）
+	Instrument           string              `json:"instrument"`                    // 乐器类型
+	BPM                  float64             `json:"bpm"`                           // BPM（有速度图时为起始速度）
+	TempoMap             []TempoPoint        `json:"tempo_map,omitempty"`           // 实际使用的速度图（已按BPM缩放，匀速时省略）
+	TimeSignature        string              `json:"time_signature,omitempty"`      // 拍号（如 "3/4"）
+	TotalBars            int                 `json:"total_bars,omitempty"`          // 小节总数
+	TonguingDelay        int                 `json:"tonguing_delay_ms"`             // 吐音延迟（毫秒）
+	FingerLeadMS         int                 `json:"finger_lead_ms"`                // 换指提前量（毫秒）
+	SwitchDipMS          int                 `json:"switch_dip_ms"`                 // 换指气泵短暂关闭时长（毫秒）
+	RestPreSwitchMS      int                 `json:"rest_pre_switch_ms"`            // 空拍固定预切换提前量（毫秒，0表示按比例）
+	RestPreSwitchRatio   float64             `json:"rest_pre_switch_ratio"`         // 空拍预切换比例
+	SignificantRestBeats float64             `json:"significant_rest_beats"`        // 显著空拍拍数阈值
+	SignificantRestMS    float64             `json:"significant_rest_ms"`           // 显著空拍时长阈值（毫秒）
+	TotalDurationMS      float64             `json:"total_duration_ms"`             // 总时长（毫秒）
+	TotalEvents          int                 `json:"total_events"`                  // 事件总数
+	GeneratedAt          time.Time           `json:"generated_at"`                  // 生成时间
+	Version              string              `json:"version"`                       // 格式版本号（见 ExecSchemaVersion）
+	ConfigHash           string              `json:"config_hash"`                   // 生成时相关配置字段的哈希
+	FingeringHash        string              `json:"fingering_hash"`                // 生成时指法映射的哈希
+	TimelineHash         string              `json:"timeline_hash"`                 // 源时间轴文件内容哈希
+	ParamsHash           string              `json:"params_hash"`                   // 预处理参数哈希
+	InputHash            string              `json:"input_hash"`                    // 全部输入的组合哈希（编译缓存键）
+	TimingOverride       bool                `json:"timing_override"`               // 换指参数是否为调用方覆盖值
+	Expression           *ExpressionSettings `json:"expression,omitempty"`          // 实际使用的表情演奏设置（未启用时省略）
+	ExpressionOverride   bool                `json:"expression_override,omitempty"` // 表情设置是否为调用方覆盖值
+	Breaths              []BreathPoint       `json:"breaths,omitempty"`             // 换气点（手动标记与自动规划）
+	BreathOverride       *BreathConfig       `json:"breath_override,omitempty"`     // 调用方覆盖的换气设置（未覆盖时省略）
 }
 
 // ExecutionEvent 执行事件（简化版）
@@ -32,9 +53,19 @@ type ExecutionEvent struct {
 	DurationMS  float64        `json:"d"`                // 持续时长（毫秒）
 	Note        string         `json:"n"`                // 音符名称（调试用）
 	Frames      []ExecCANFrame `json:"frames,omitempty"` // CAN帧数组（为空时省略）
-	SerialCmd   string         `json:"serial,omitempty"` // 串口命令（"on"/"off"）
+	SerialCmd   string         `json:"serial,omitempty"` // 串口命令（"on"/"off"/"set N"）
+	Marker      string         `json:"m,omitempty"`      // 时间标记（rest_start/rest_end，用于精确统计空拍）
+	Beats       float64        `json:"beats,omitempty"`  // 拍数（空拍开始标记上记录整个空拍的拍数）
+	Bar         int            `json:"bar,omitempty"`    // 所属音符的小节（从1开始，旧文件为0）
+	BeatInBar   float64        `json:"beat,omitempty"`   // 所属音符的小节内拍位置（从1开始）
 }
 
+// 执行事件时间标记
+const (
+	MarkerRestStart = "rest_start" // 空拍开始
+	MarkerRestEnd   = "rest_end"   // 空拍结束（下一个事件的起点）
+)
+
 // ExecCANFrame 执行用CAN帧（简化版）
 type ExecCANFrame struct {
 	Hand string `json:"hand"` // 手部标识：left/right（逻辑标识，执行时映射到实际接口）
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 表情演奏 - 微小时间抖动、乐句尾延长、摇摆节奏、颤音
+////////////////////////////////////////////////////////////////////////////////
+//
+// 严格按谱面时值演奏听起来很机械。以下设置均为可选，全部为0时与原来的机械演奏完全一致：
+//   - 时间抖动：每个音符起点随机前后偏移（只移动音符之间的分界，总时长不变），
+//     随机数由 seed 决定，同一 seed 每次生成的执行文件完全相同
+//   - 乐句尾延长：空拍前和全曲最后一个音符按比例延长（后续音符整体后移）
+//   - 摇摆：位于拍头的一对八分音符按 swing 比例分配一拍（0.5为平均，0.667为三连音感）
+//   - 颤音：长音在起音后按 PWM 正弦起伏（串口命令 "set N"），结束时恢复基准PWM
+//
+// 实际使用的设置写入执行序列元数据，便于复现。
+
+const (
+	defaultVibratoBasePWM = 200   // 默认基准PWM
+	defaultVibratoMinMS   = 600.0 // 默认触发颤音的最短音符时长（毫秒）
+	defaultVibratoDelayMS = 200.0 // 默认起音后多久开始颤音（毫秒）
+	vibratoStepsPerCycle  = 8     // 每个颤音周期的PWM采样点数
+	maxJitterRatio        = 0.25  // 抖动最多占相邻音符时长的比例（保证音符不会被挤没）
+)
+
+// ExpressionSettings 表情演奏设置（配置文件 expression 段，或预处理请求中覆盖）
+type ExpressionSettings struct {
+	Seed             int64   `yaml:"seed" json:"seed"`                             // 随机种子（决定抖动）
+	JitterMS         float64 `yaml:"jitter_ms" json:"jitter_ms"`                   // 音符起点最大随机偏移（毫秒）
+	PhraseEndStretch float64 `yaml:"phrase_end_stretch" json:"phrase_end_stretch"` // 乐句尾延长比例（0.1表示延长10%）
+	Swing            float64 `yaml:"swing" json:"swing"`                           // 八分音符摇摆比例（0或0.5表示不摇摆）
+	VibratoRateHz    float64 `yaml:"vibrato_rate_hz" json:"vibrato_rate_hz"`       // 颤音频率（赫兹，0表示不启用）
+	VibratoDepth     int     `yaml:"vibrato_depth" json:"vibrato_depth"`           // 颤音幅度（PWM值上下起伏量）
+	VibratoBasePWM   int     `yaml:"vibrato_base_pwm" json:"vibrato_base_pwm"`     // 基准PWM（颤音围绕该值起伏，结束后恢复）
+	VibratoMinMS     float64 `yaml:"vibrato_min_ms" json:"vibrato_min_ms"`         // 触发颤音的最短音符时长（毫秒）
+	VibratoDelayMS   float64 `yaml:"vibrato_delay_ms" json:"vibrato_delay_ms"`     // 起音后多久开始颤音（毫秒）
+}
+
+// Enabled 是否启用了任何表情设置
+func (es ExpressionSettings) Enabled() bool {
+	return es.JitterMS > 0 || es.PhraseEndStretch > 0 || es.swingEnabled() || es.vibratoEnabled()
+}
+
+// swingEnabled 是否启用摇摆
+func (es ExpressionSettings) swingEnabled() bool {
+	return es.Swing > 0 && es.Swing != 0.5
+}
+
+// vibratoEnabled 是否启用颤音
+func (es ExpressionSettings) vibratoEnabled() bool {
+	return es.VibratoRateHz > 0 && es.VibratoDepth > 0
+}
+
+// Normalized 校验设置并补全颤音默认值
+func (es ExpressionSettings) Normalized() (ExpressionSettings, error) {
+	if es.JitterMS < 0 {
+		return es, fmt.Errorf("jitter_ms 不能为负: %v", es.JitterMS)
+	}
+	if es.PhraseEndStretch < 0 || es.PhraseEndStretch > 1 {
+		return es, fmt.Errorf("phrase_end_stretch 应在 0~1 之间: %v", es.PhraseEndStretch)
+	}
+	if es.Swing != 0 && (es.Swing < 0.5 || es.Swing >= 0.9) {
+		return es, fmt.Errorf("swing 应在 0.5~0.9 之间: %v", es.Swing)
+	}
+	if es.VibratoRateHz < 0 || es.VibratoRateHz > 20 {
+		return es, fmt.Errorf("vibrato_rate_hz 应在 0~20 之间: %v", es.VibratoRateHz)
+	}
+	if !es.vibratoEnabled() {
+		return es, nil
+	}
+	if es.VibratoBasePWM <= 0 {
+		es.VibratoBasePWM = defaultVibratoBasePWM
+	}
+	if es.VibratoMinMS <= 0 {
+		es.VibratoMinMS = defaultVibratoMinMS
+	}
+	if es.VibratoDelayMS <= 0 {
+		es.VibratoDelayMS = defaultVibratoDelayMS
+	}
+	if es.VibratoBasePWM-es.VibratoDepth < 0 || es.VibratoBasePWM+es.VibratoDepth > 255 {
+		return es, fmt.Errorf("颤音PWM范围 %d±%d 超出 0~255", es.VibratoBasePWM, es.VibratoDepth)
+	}
+	return es, nil
+}
+
+// String 设置摘要（用于日志）
+func (es ExpressionSettings) String() string {
+	var parts []string
+	if es.JitterMS > 0 {
+		parts = append(parts, fmt.Sprintf("抖动±%.0fms(seed=%d)", es.JitterMS, es.Seed))
+	}
+	if es.PhraseEndStretch > 0 {
+		parts = append(parts, fmt.Sprintf("乐句尾延长%.0f%%", es.PhraseEndStretch*100))
+	}
+	if es.swingEnabled() {
+		parts = append(parts, fmt.Sprintf("摇摆%.2f", es.Swing))
+	}
+	if es.vibratoEnabled() {
+		parts = append(parts, fmt.Sprintf("颤音%.1fHz PWM %d±%d", es.VibratoRateHz, es.VibratoBasePWM, es.VibratoDepth))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// noteDurationsMS 计算每个音符的实际时长（毫秒）：速度图积分、延长记号，再叠加表情设置
+func (sp *SequencePreprocessor) noteDurationsMS(events []NoteEvent) []float64 {
+	beats := sp.swungBeats(events)
+	durations := make([]float64, len(events))
+	position := 0.0
+	for i, event := range events {
+		// 按速度图对时值积分得到时长；延长记号只拉长该音符，不影响后续拍位置
+		durations[i] = sp.tempoMap.DurationMS(position, beats[i])
+		if event.Fermata > 0 {
+			durations[i] *= event.Fermata
+		}
+		position += beats[i]
+	}
+
+	if stretch := sp.expression.PhraseEndStretch; stretch > 0 {
+		for i, event := range events {
+			if event.Note == "NO" {
+				continue
+			}
+			if i == len(events)-1 || events[i+1].Note == "NO" {
+				durations[i] *= 1 + stretch
+			}
+		}
+	}
+
+	if sp.expression.JitterMS > 0 {
+		rng := rand.New(rand.NewPCG(uint64(sp.expression.Seed), 0))
+		for i := 1; i < len(events); i++ {
+			offset := (rng.Float64()*2 - 1) * sp.expression.JitterMS
+			limit := maxJitterRatio * math.Min(durations[i-1], durations[i])
+			offset = math.Max(-limit, math.Min(limit, offset))
+			// 只移动两个音符之间的分界，总时长不变
+			durations[i-1] += offset
+			durations[i] -= offset
+		}
+	}
+
+	return durations
+}
+
+// swungBeats 按摇摆比例调整拍头八分音符对的时值（一对音符合计仍为1拍，不影响后续拍位置）
+func (sp *SequencePreprocessor) swungBeats(events []NoteEvent) []float64 {
+	beats := make([]float64, len(events))
+	for i, event := range events {
+		beats[i] = event.Duration
+	}
+	if !sp.expression.swingEnabled() {
+		return beats
+	}
+
+	position := 0.0
+	for i := 0; i < len(events); i++ {
+		onBeat := math.Abs(position-math.Round(position)) < 1e-6
+		if onBeat && i+1 < len(events) && events[i].Duration == 0.5 && events[i+1].Duration == 0.5 {
+			beats[i] = sp.expression.Swing
+			beats[i+1] = 1 - sp.expression.Swing
+			position += 1
+			i++
+			continue
+		}
+		position += events[i].Duration
+	}
+	return beats
+}
+
+// applyVibrato 为长音插入颤音事件（PWM按正弦起伏，结束时恢复基准值）
+// 在换指提前之后执行，此时各音符的发声时长已经确定
+func (sp *SequencePreprocessor) applyVibrato(events []ExecutionEvent) []ExecutionEvent {
+	es := sp.expression
+	if !es.vibratoEnabled() {
+		return events
+	}
+
+	stepMS := 1000.0 / es.VibratoRateHz / vibratoStepsPerCycle
+	result := make([]ExecutionEvent, 0, len(events))
+	for _, event := range events {
+		result = append(result, event)
+		if !isSoundingEvent(event) || event.DurationMS < es.VibratoMinMS {
+			continue
+		}
+
+		start := event.TimestampMS + es.VibratoDelayMS
+		end := event.TimestampMS + event.DurationMS
+		t := start
+		for ; t+stepMS <= end; t += stepMS {
+			phase := 2 * math.Pi * es.VibratoRateHz * (t - start) / 1000.0
+			pwm := es.VibratoBasePWM + int(math.Round(float64(es.VibratoDepth)*math.Sin(phase)))
+			result = append(result, vibratoEvent(t, stepMS, pwm, event))
+		}
+		if t > start {
+			result = append(result, vibratoEvent(t, 0, es.VibratoBasePWM, event))
+		}
+	}
+	return result
+}
+
+// vibratoEvent 生成一个颤音PWM事件
+func vibratoEvent(timestampMS, durationMS float64, pwm int, note ExecutionEvent) ExecutionEvent {
+	return ExecutionEvent{
+		TimestampMS: timestampMS,
+		DurationMS:  durationMS,
+		Note:        "VIB",
+		SerialCmd:   fmt.Sprintf("set %d", pwm),
+		Bar:         note.Bar,
+		BeatInBar:   note.BeatInBar,
+	}
+}
+
+// parsePumpSetCommand 解析 "set N" 形式的PWM串口命令
+func parsePumpSetCommand(cmd string) (int, bool) {
+	value, ok := strings.CutPrefix(cmd, "set ")
+	if !ok {
+		return 0, false
+	}
+	pwm, err := strconv.Atoi(value)
+	if err != nil || pwm < 0 || pwm > 255 {
+		return 0, false
+	}
+	return pwm, true
+}
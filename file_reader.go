@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -48,40 +50,111 @@ func (fr *FileReader) LoadConfig(path string) Config {
 	return cfg
 }
 
-// LoadTimeline 加载时间轴文件
+// defaultRestPreSwitchRatio 未配置 rest_pre_switch_ratio 时的空拍预切换比例
+const defaultRestPreSwitchRatio = 0.2
+
+// TimingFor 获取指定乐器的时序配置（未配置的字段填充默认值：不提前换指、空拍最后20%预切换、≥4拍或≥1秒为显著空拍）
+// rest_pre_switch_ratio 为0时不按比例预切换；负数或大于1视为无效，使用默认值
+func (cfg Config) TimingFor(instrument string) InstrumentTiming {
+	timing := cfg.Timing[instrument]
+	if timing.FingerLeadMS < 0 {
+		timing.FingerLeadMS = 0
+	}
+	if timing.SwitchDipMS < 0 {
+		timing.SwitchDipMS = 0
+	}
+	if timing.RestPreSwitchMS < 0 {
+		timing.RestPreSwitchMS = 0
+	}
+	if timing.RestPreSwitchRatio == nil || *timing.RestPreSwitchRatio < 0 || *timing.RestPreSwitchRatio > 1 {
+		ratio := defaultRestPreSwitchRatio
+		timing.RestPreSwitchRatio = &ratio
+	}
+	if timing.SignificantRestBeats <= 0 {
+		timing.SignificantRestBeats = 4.0
+	}
+	if timing.SignificantRestMS <= 0 {
+		timing.SignificantRestMS = 1000.0
+	}
+	return timing
+}
+
+// LoadTimeline 加载时间轴文件（失败时退出程序，用于命令行）
 func (fr *FileReader) LoadTimeline(path string) TimelineFile {
-	data, err := os.ReadFile(path)
+	timeline, err := fr.ReadTimeline(path)
 	if err != nil {
-		fmt.Printf("❌ 错误: 无法读取时间轴文件 %s: %v\n", path, err)
+		fmt.Printf("❌ 错误: %v\n", err)
 		os.Exit(1)
 	}
+	return timeline
+}
 
+// ReadTimeline 读取时间轴文件（返回错误，用于Web服务与编译缓存）
+func (fr *FileReader) ReadTimeline(path string) (TimelineFile, error) {
 	var timeline TimelineFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return timeline, fmt.Errorf("无法读取时间轴文件 %s: %v", path, err)
+	}
 	if err := json.Unmarshal(data, &timeline); err != nil {
-		fmt.Printf("❌ 错误: 时间轴文件格式错误 %s: %v\n", path, err)
-		os.Exit(1)
+		return timeline, fmt.Errorf("时间轴文件格式错误 %s: %v", path, err)
 	}
+	if len(timeline.Timeline) == 0 && len(timeline.Parts) == 0 {
+		return timeline, fmt.Errorf("时间轴文件为空 %s", path)
+	}
+	return timeline, nil
+}
 
-	if len(timeline.Timeline) == 0 {
-		fmt.Printf("❌ 错误: 时间轴文件为空 %s\n", path)
-		os.Exit(1)
+// PartNames 返回总谱中的声部名（按名称排序）
+func (tf TimelineFile) PartNames() []string {
+	names := make([]string, 0, len(tf.Parts))
+	for name := range tf.Parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PartTimeline 获取指定声部的时间轴
+// part 为空时使用单声部的 timeline；文件只有 parts 且只有一个声部时使用该声部
+func (tf TimelineFile) PartTimeline(part string) ([][]any, error) {
+	if part != "" {
+		items, ok := tf.Parts[part]
+		if !ok {
+			return nil, fmt.Errorf("总谱中没有声部 %q（可用声部: %s）", part, strings.Join(tf.PartNames(), ", "))
+		}
+		return items, nil
 	}
 
-	return timeline
+	if len(tf.Timeline) > 0 {
+		return tf.Timeline, nil
+	}
+	if len(tf.Parts) == 1 {
+		return tf.Parts[tf.PartNames()[0]], nil
+	}
+	return nil, fmt.Errorf("总谱包含多个声部，请指定声部（可用声部: %s）", strings.Join(tf.PartNames(), ", "))
 }
 
-// LoadFingeringMap 加载指法映射文件
+// LoadFingeringMap 加载指法映射文件（失败时退出程序，用于命令行）
 func (fr *FileReader) LoadFingeringMap(path string) map[string]FingeringEntry {
-	data, err := os.ReadFile(path)
+	fingeringMap, err := fr.ReadFingeringMap(path)
 	if err != nil {
-		fmt.Printf("❌ 错误: 无法读取指法映射文件 %s: %v\n", path, err)
+		fmt.Printf("❌ 错误: %v\n", err)
 		os.Exit(1)
 	}
+	return fingeringMap
+}
+
+// ReadFingeringMap 读取指法映射文件（返回错误，用于Web服务与编译缓存）
+func (fr *FileReader) ReadFingeringMap(path string) (map[string]FingeringEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取指法映射文件 %s: %v", path, err)
+	}
 
 	var cfg FingeringConfig
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		fmt.Printf("❌ 错误: 指法映射文件格式错误 %s: %v\n", path, err)
-		os.Exit(1)
+		return nil, fmt.Errorf("指法映射文件格式错误 %s: %v", path, err)
 	}
 
 	// 转换为map便于查找
@@ -90,18 +163,25 @@ func (fr *FileReader) LoadFingeringMap(path string) map[string]FingeringEntry {
 		fingeringMap[entry.Note] = entry
 	}
 
-	return fingeringMap
+	return fingeringMap, nil
 }
 
-// LoadFingeringMapByInstrument 根据乐器类型加载指法映射
-func (fr *FileReader) LoadFingeringMapByInstrument(instrument string) map[string]FingeringEntry {
-	var fingeringPath string
+// fingeringPathFor 乐器对应的指法映射文件
+func fingeringPathFor(instrument string) string {
 	if instrument == "sn" {
-		fingeringPath = "config/snFinger.yaml"
-	} else {
-		fingeringPath = "config/sksFinger.yaml"
+		return "config/snFinger.yaml"
 	}
-	return fr.LoadFingeringMap(fingeringPath)
+	return "config/sksFinger.yaml"
+}
+
+// LoadFingeringMapByInstrument 根据乐器类型加载指法映射（失败时退出程序）
+func (fr *FileReader) LoadFingeringMapByInstrument(instrument string) map[string]FingeringEntry {
+	return fr.LoadFingeringMap(fingeringPathFor(instrument))
+}
+
+// ReadFingeringMapByInstrument 根据乐器类型读取指法映射（返回错误）
+func (fr *FileReader) ReadFingeringMapByInstrument(instrument string) (map[string]FingeringEntry, error) {
+	return fr.ReadFingeringMap(fingeringPathFor(instrument))
 }
 
 // CheckFileExists 检查文件是否存在
@@ -111,24 +191,3 @@ func (fr *FileReader) CheckFileExists(path string) error {
 	}
 	return nil
 }
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
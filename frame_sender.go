@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 按接口有序发送CAN帧 - 每个CAN接口一个队列、一个发送goroutine，待发的旧帧被新帧合并
+////////////////////////////////////////////////////////////////////////////////
+//
+// 以前每个帧一个goroutine并发发往桥接服务，同一只手两次快速换指时请求可能乱序到达，
+// 旧指法后到反而生效。现在：
+//   - 同一接口的帧串行发送：上一个请求返回（或超时）后才发下一个
+//   - 待发队列中同一设备ID只保留最新的一帧（位置不变，内容替换为新帧），过时的中间指法直接丢弃
+//   - 同步发送（单个指法、预备手势、急停释放）也进入同一队列并等待结果，不会被在途的异步帧覆盖；
+//     有等待者的帧不会被后来的帧合并，总是用调用方自己的上下文发出（演奏停止不会让它被丢弃）
+//   - 桥接服务支持批量发送时（见 can_batch.go），同一桥接服务的所有接口共用一个队列，
+//     每次取出全部待发帧在一个请求中发送，同一事件的左右手帧总是一起到达
+//   - 切换批量模式时旧队列停用，待发帧按原顺序转入新队列；新队列等旧队列在途的请求结束后才开始发送
+// 异步帧入队时占用急停的在途计数，发送、合并或丢弃后释放；上下文已取消的帧出队时直接丢弃，
+// 所以演奏正常结束时先 Flush 等待本次演奏（同一上下文）入队的帧发完，再取消演奏上下文。
+
+// canSendItem 一个待发送的CAN帧
+type canSendItem struct {
+	ctx     context.Context
+	url     string
+	msg     CanMessage
+	onError func(error) // 异步帧的失败回调（可为 nil）
+	guarded bool        // 是否占用急停的在途计数（异步帧）
+	done    chan error  // 同步发送的等待者（异步帧为 nil）
+	session *canSession // 帧所属的发送会话（同一上下文）
+}
+
+// canSession 同一上下文入队的帧（一次演奏），全部发送、合并或丢弃后关闭 done
+type canSession struct {
+	pending int
+	done    chan struct{}
+}
+
+// canFrameKey 合并待发帧的键（同一接口的同一设备）
+type canFrameKey struct {
+	iface string
+	id    uint32
+}
+
+// canQueueKey 发送队列的键：单帧模式每个接口一个队列；批量模式每个桥接服务一个队列（iface 为空）
+type canQueueKey struct {
+	url   string
+	iface string
+}
+
+// canSendQueue 一个发送队列
+type canSendQueue struct {
+	batch  bool                         // 批量模式：一次取出全部待发帧，在一个请求中发送
+	order  []*canSendItem               // 待发帧（按入队顺序，合并的帧占用被替换帧的位置）
+	latest map[canFrameKey]*canSendItem // 每个设备最新的、还可以被合并的待发异步帧
+	wake   chan struct{}
+
+	retired bool            // 已停用（批量模式切换），发送goroutine结束在途请求后退出
+	stopped chan struct{}   // 发送goroutine退出时关闭
+	after   []*canSendQueue // 开始发送前需等待退出的旧队列
+}
+
+// OrderedCanSender 按接口有序发送CAN帧
+type OrderedCanSender struct {
+	mutex    sync.Mutex
+	queues   map[canQueueKey]*canSendQueue
+	batch    map[string]bool                 // 各桥接服务是否支持批量发送（见 DetectBridgeCapabilities）
+	sessions map[context.Context]*canSession // 各上下文已入队但尚未发送完成的帧（含正在发送的）
+	retired  map[string][]*canSendQueue      // 各桥接服务切换模式时停用、可能仍有在途请求的旧队列
+}
+
+// NewOrderedCanSender 创建有序发送器（各队列的发送goroutine在首次使用时启动）
+func NewOrderedCanSender() *OrderedCanSender {
+	return &OrderedCanSender{
+		queues:   make(map[canQueueKey]*canSendQueue),
+		batch:    make(map[string]bool),
+		sessions: make(map[context.Context]*canSession),
+		retired:  make(map[string][]*canSendQueue),
+	}
+}
+
+// 全局有序发送器
+var globalCanSender = NewOrderedCanSender()
+
+// SetBatchSupported 设置桥接服务是否支持批量发送
+// 模式改变时停用该桥接服务的旧队列，待发帧按原顺序转入新模式的队列；
+// 新队列等旧队列在途的请求结束后才开始发送，同一接口的帧不会因切换而乱序
+func (s *OrderedCanSender) SetBatchSupported(canBridgeURL string, supported bool) {
+	s.mutex.Lock()
+	if s.batch[canBridgeURL] == supported {
+		s.mutex.Unlock()
+		return
+	}
+	s.batch[canBridgeURL] = supported
+
+	var pending []*canSendItem
+	for key, q := range s.queues {
+		if key.url != canBridgeURL {
+			continue
+		}
+		delete(s.queues, key)
+		q.retired = true
+		pending = append(pending, q.order...)
+		q.order = nil
+		q.latest = make(map[canFrameKey]*canSendItem)
+		s.retired[canBridgeURL] = append(s.retired[canBridgeURL], q)
+		wakeQueue(q) // 空闲的发送goroutine醒来后退出
+	}
+	woken := make(map[*canSendQueue]bool)
+	for _, item := range pending {
+		q := s.queueLocked(item)
+		s.enqueueLocked(q, item)
+		woken[q] = true
+	}
+	s.mutex.Unlock()
+
+	for q := range woken {
+		wakeQueue(q)
+	}
+	if supported {
+		fmt.Printf("📦 CAN桥接服务 %s 支持批量发送，左右手帧合并为一个请求\n", canBridgeURL)
+	} else {
+		fmt.Printf("📦 CAN桥接服务 %s 不支持批量发送，逐帧发送\n", canBridgeURL)
+	}
+}
+
+// BatchSupported 桥接服务是否支持批量发送
+func (s *OrderedCanSender) BatchSupported(canBridgeURL string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.batch[canBridgeURL]
+}
+
+// enqueue 一组帧在同一把锁下入队（同一事件的左右手帧进入批量队列时不会被拆开）
+func (s *OrderedCanSender) enqueue(items ...*canSendItem) {
+	s.mutex.Lock()
+	woken := make(map[*canSendQueue]bool)
+	for _, item := range items {
+		q := s.queueLocked(item)
+		s.enqueueLocked(q, item)
+		woken[q] = true
+	}
+	s.mutex.Unlock()
+
+	for q := range woken {
+		wakeQueue(q)
+	}
+}
+
+// wakeQueue 唤醒队列的发送goroutine（已有未处理的唤醒时不重复）
+func wakeQueue(q *canSendQueue) {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queueLocked 帧所属的发送队列（不存在时创建并启动发送goroutine，调用方持有锁）
+func (s *OrderedCanSender) queueLocked(item *canSendItem) *canSendQueue {
+	key := canQueueKey{url: item.url, iface: item.msg.Interface}
+	batch := s.batch[item.url]
+	if batch {
+		key.iface = ""
+	}
+	q := s.queues[key]
+	if q == nil {
+		q = &canSendQueue{
+			batch:   batch,
+			latest:  make(map[canFrameKey]*canSendItem),
+			wake:    make(chan struct{}, 1),
+			stopped: make(chan struct{}),
+		}
+		// 模式切换后新建的队列等旧队列的在途请求结束（已退出的旧队列不再记录）
+		var running []*canSendQueue
+		for _, old := range s.retired[item.url] {
+			select {
+			case <-old.stopped:
+			default:
+				running = append(running, old)
+			}
+		}
+		if len(running) > 0 {
+			s.retired[item.url] = running
+		} else {
+			delete(s.retired, item.url)
+		}
+		q.after = running
+		s.queues[key] = q
+		go s.run(q)
+	}
+	return q
+}
+
+// enqueueLocked 帧入队；同一设备已有待发的异步帧时合并（新帧替换旧帧，占用其位置）
+// 同步帧有等待者，不会被替换：之后同一设备的帧排在它后面
+func (s *OrderedCanSender) enqueueLocked(q *canSendQueue, item *canSendItem) {
+	key := canFrameKey{iface: item.msg.Interface, id: item.msg.Id}
+	if old := q.latest[key]; old != nil {
+		for i, queued := range q.order {
+			if queued == old {
+				q.order[i] = item
+				break
+			}
+		}
+		if old.guarded {
+			globalEStop.releaseSend()
+		}
+		s.doneLocked(old)
+		recordCanCoalesced(item.msg.Interface)
+	} else {
+		q.order = append(q.order, item)
+	}
+	s.trackLocked(item)
+	if item.done == nil {
+		q.latest[key] = item
+	} else {
+		delete(q.latest, key)
+	}
+}
+
+// trackLocked 帧计入所属上下文的发送会话（调用方持有锁；模式切换时转入新队列的帧已计入）
+func (s *OrderedCanSender) trackLocked(item *canSendItem) {
+	if item.session != nil {
+		return
+	}
+	session := s.sessions[item.ctx]
+	if session == nil {
+		session = &canSession{done: make(chan struct{})}
+		s.sessions[item.ctx] = session
+	}
+	session.pending++
+	item.session = session
+}
+
+// doneLocked 帧发送结束（或被合并、丢弃），会话中的帧全部结束时关闭 done（调用方持有锁）
+func (s *OrderedCanSender) doneLocked(item *canSendItem) {
+	session := item.session
+	session.pending--
+	if session.pending == 0 {
+		close(session.done)
+		if s.sessions[item.ctx] == session {
+			delete(s.sessions, item.ctx)
+		}
+	}
+}
+
+// next 取出待发帧：单帧模式取队首一帧，批量模式取出全部（队列为空时返回 nil）
+func (s *OrderedCanSender) next(q *canSendQueue) []*canSendItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := len(q.order)
+	if n == 0 {
+		return nil
+	}
+	if !q.batch {
+		n = 1
+	}
+	items := append([]*canSendItem(nil), q.order[:n]...)
+	for _, item := range items {
+		key := canFrameKey{iface: item.msg.Interface, id: item.msg.Id}
+		if q.latest[key] == item {
+			delete(q.latest, key)
+		}
+	}
+	q.order = q.order[n:]
+	return items
+}
+
+// run 队列的发送循环：依次发送待发帧，每次等上一个请求结束；队列停用后退出
+func (s *OrderedCanSender) run(q *canSendQueue) {
+	defer close(q.stopped)
+	for _, old := range q.after {
+		<-old.stopped
+	}
+
+	for range q.wake {
+		for items := s.next(q); items != nil; items = s.next(q) {
+			if len(items) == 1 {
+				s.deliver(items[0])
+			} else {
+				s.deliverBatch(items)
+			}
+			s.mutex.Lock()
+			for _, item := range items {
+				s.doneLocked(item)
+			}
+			s.mutex.Unlock()
+		}
+
+		s.mutex.Lock()
+		retired := q.retired
+		s.mutex.Unlock()
+		if retired {
+			return
+		}
+	}
+}
+
+// deliver 发送一帧并通知等待者（上下文已取消时不发送）
+func (s *OrderedCanSender) deliver(item *canSendItem) {
+	if item.guarded {
+		defer globalEStop.releaseSend()
+	}
+
+	var err error
+	if err = item.ctx.Err(); err == nil {
+		err = postCanMessage(item.ctx, item.url, item.msg)
+	}
+	item.finish(err)
+}
+
+// deliverBatch 在一个请求中发送多帧；桥接服务不支持批量时退回逐帧发送
+func (s *OrderedCanSender) deliverBatch(items []*canSendItem) {
+	var live []*canSendItem
+	for _, item := range items {
+		if err := item.ctx.Err(); err != nil {
+			item.finish(err)
+			if item.guarded {
+				globalEStop.releaseSend()
+			}
+			continue
+		}
+		live = append(live, item)
+	}
+	defer func() {
+		for _, item := range live {
+			if item.guarded {
+				globalEStop.releaseSend()
+			}
+		}
+	}()
+	if len(live) == 0 {
+		return
+	}
+
+	errs, err := postCanBatch(batchContext(live), live[0].url, live)
+	if errors.Is(err, errBatchUnsupported) {
+		s.SetBatchSupported(live[0].url, false)
+		for _, item := range live {
+			if err := item.ctx.Err(); err != nil {
+				item.finish(err)
+				continue
+			}
+			item.finish(postCanMessage(item.ctx, item.url, item.msg))
+		}
+		return
+	}
+	for i, item := range live {
+		if err != nil {
+			item.finish(err)
+		} else {
+			item.finish(errs[i])
+		}
+	}
+}
+
+// finish 发送结束：失败时回调（上下文取消导致的除外），并通知同步等待者
+func (item *canSendItem) finish(err error) {
+	if err != nil && item.onError != nil && item.ctx.Err() == nil {
+		item.onError(err)
+	}
+	if item.done != nil {
+		item.done <- err
+	}
+}
+
+// batchContext 批量请求使用的上下文：各帧属于同一个演奏上下文时沿用它（停止/急停时中断请求），否则不中断
+func batchContext(items []*canSendItem) context.Context {
+	for _, item := range items[1:] {
+		if item.ctx != items[0].ctx {
+			return context.Background()
+		}
+	}
+	return items[0].ctx
+}
+
+// Flush 等待以 ctx 入队的帧全部发送完成（ctx 取消时提前返回）
+// 演奏正常结束时调用，避免最后几帧随演奏上下文一起被取消；不等待其他演奏或同步发送的帧
+func (s *OrderedCanSender) Flush(ctx context.Context) {
+	s.mutex.Lock()
+	session := s.sessions[ctx]
+	s.mutex.Unlock()
+	if session == nil {
+		return
+	}
+	select {
+	case <-session.done:
+	case <-ctx.Done():
+	}
+}
+
+// Send 同步发送：一组帧同时入队，等待它们全部发送完成，返回第一个错误
+func (s *OrderedCanSender) Send(canBridgeURL string, msgs ...CanMessage) error {
+	done := make(chan error, len(msgs))
+	items := make([]*canSendItem, len(msgs))
+	for i, msg := range msgs {
+		items[i] = &canSendItem{ctx: context.Background(), url: canBridgeURL, msg: msg, done: done}
+	}
+	s.enqueue(items...)
+
+	var first error
+	for range msgs {
+		if err := <-done; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SendAsync 异步发送：一组帧同时入队后立即返回；ctx 已取消或急停锁定时丢弃
+// onError 可为 nil，对每个失败的帧各调用一次（参数为该帧和错误）
+func (s *OrderedCanSender) SendAsync(ctx context.Context, canBridgeURL string, msgs []CanMessage, onError func(CanMessage, error)) {
+	items := make([]*canSendItem, 0, len(msgs))
+	for _, msg := range msgs {
+		if ctx.Err() != nil || !globalEStop.acquireSend() {
+			break
+		}
+		item := &canSendItem{ctx: ctx, url: canBridgeURL, msg: msg, guarded: true}
+		if onError != nil {
+			msg := msg
+			item.onError = func(err error) { onError(msg, err) }
+		}
+		items = append(items, item)
+	}
+	s.enqueue(items...)
+}
+
+// postCanMessage 向桥接服务发送一帧并记录结果（统计与录制）
+func postCanMessage(ctx context.Context, canBridgeURL string, msg CanMessage) error {
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("消息序列化失败: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, canBridgeURL+"/api/can", bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// 使用全局HTTP客户端（连接池复用）
+	client := InitGlobalHTTPClient()
+	sentAt := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		recordCanDelivery(sentAt, msg, 0, err)
+		return fmt.Errorf("发送到CAN服务失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body) // 读取body以释放连接
+		err := fmt.Errorf("CAN服务错误: %s", strings.TrimSpace(string(body)))
+		recordCanDelivery(sentAt, msg, resp.StatusCode, err)
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	recordCanDelivery(sentAt, msg, resp.StatusCode, nil)
+	return nil
+}
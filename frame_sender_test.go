@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCanBridge 模拟CAN桥接服务：每个请求随机延迟后返回，按接口记录收到的帧
+type fakeCanBridge struct {
+	mutex    sync.Mutex
+	received map[string][]CanMessage
+	gate     chan struct{} // 非 nil 时第一个请求在此阻塞，直到测试关闭它
+	gated    bool
+	maxDelay time.Duration
+}
+
+func newFakeCanBridge(t *testing.T, maxDelay time.Duration) (*fakeCanBridge, string) {
+	bridge := &fakeCanBridge{received: make(map[string][]CanMessage), maxDelay: maxDelay}
+	server := httptest.NewServer(http.HandlerFunc(bridge.handle))
+	t.Cleanup(server.Close)
+	return bridge, server.URL
+}
+
+func (b *fakeCanBridge) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/can" {
+		// 不支持批量发送的旧版桥接服务
+		time.Sleep(time.Duration(rand.Int63n(int64(b.maxDelay) + 1)))
+		http.NotFound(w, r)
+		return
+	}
+	var msg CanMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.mutex.Lock()
+	gate := b.gate
+	if gate != nil && !b.gated {
+		b.gated = true
+	} else {
+		gate = nil
+	}
+	b.mutex.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	if b.maxDelay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(b.maxDelay))))
+	}
+
+	b.mutex.Lock()
+	b.received[msg.Interface] = append(b.received[msg.Interface], msg)
+	b.mutex.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (b *fakeCanBridge) frames(iface string) []CanMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]CanMessage(nil), b.received[iface]...)
+}
+
+// TestOrderedCanSenderKeepsOrderPerInterface 左右手帧交替异步发送，桥接服务随机延迟：
+// 每个接口收到的帧保持发送顺序（中间帧可被合并），最后一帧是最后发送的那一帧
+func TestOrderedCanSenderKeepsOrderPerInterface(t *testing.T) {
+	bridge, url := newFakeCanBridge(t, 5*time.Millisecond)
+	sender := NewOrderedCanSender()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const frames = 200
+	for i := 0; i < frames; i++ {
+		sender.SendAsync(ctx, url, []CanMessage{
+			{Interface: "can0", Id: 0x28, Data: []byte{OpCode, byte(i)}},
+			{Interface: "can1", Id: 0x27, Data: []byte{OpCode, byte(i)}},
+		}, func(msg CanMessage, err error) {
+			t.Errorf("发送 %s 失败: %v", msg.Interface, err)
+		})
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	flushed := make(chan struct{})
+	go func() {
+		sender.Flush(ctx)
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush 超时")
+	}
+
+	for _, iface := range []string{"can0", "can1"} {
+		received := bridge.frames(iface)
+		if len(received) == 0 {
+			t.Fatalf("%s 没有收到帧", iface)
+		}
+		for i := 1; i < len(received); i++ {
+			if received[i].Data[1] <= received[i-1].Data[1] {
+				t.Fatalf("%s 的帧乱序: 第%d帧 %d 在 %d 之后到达", iface, i, received[i].Data[1], received[i-1].Data[1])
+			}
+		}
+		if last := received[len(received)-1].Data[1]; last != frames-1 {
+			t.Errorf("%s 最后生效的帧是 %d，应为最后发送的 %d", iface, last, frames-1)
+		}
+	}
+}
+
+// TestOrderedCanSenderKeepsOrderAcrossBatchFallback 先按批量模式排队，桥接服务不支持批量时中途切换为逐帧发送：
+// 切换前后每个接口的帧仍然按发送顺序到达
+func TestOrderedCanSenderKeepsOrderAcrossBatchFallback(t *testing.T) {
+	bridge, url := newFakeCanBridge(t, 5*time.Millisecond)
+	sender := NewOrderedCanSender()
+	sender.SetBatchSupported(url, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const frames = 200
+	for i := 0; i < frames; i++ {
+		sender.SendAsync(ctx, url, []CanMessage{
+			{Interface: "can0", Id: 0x28, Data: []byte{OpCode, byte(i)}},
+			{Interface: "can1", Id: 0x27, Data: []byte{OpCode, byte(i)}},
+		}, nil)
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	flushed := make(chan struct{})
+	go func() {
+		sender.Flush(ctx)
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush 超时")
+	}
+	if sender.BatchSupported(url) {
+		t.Fatal("桥接服务不支持批量发送，应已切换为逐帧发送")
+	}
+
+	for _, iface := range []string{"can0", "can1"} {
+		received := bridge.frames(iface)
+		for i := 1; i < len(received); i++ {
+			if received[i].Data[1] <= received[i-1].Data[1] {
+				t.Fatalf("%s 的帧乱序: 第%d帧 %d 在 %d 之后到达", iface, i, received[i].Data[1], received[i-1].Data[1])
+			}
+		}
+		if len(received) == 0 || received[len(received)-1].Data[1] != frames-1 {
+			t.Errorf("%s 最后生效的帧应为最后发送的 %d: %v", iface, frames-1, received)
+		}
+	}
+}
+
+// TestOrderedCanSenderSyncFrameSurvivesCanceledPlayback 同步帧排队时，同一设备随后的异步帧不会合并它：
+// 演奏上下文取消后，同步帧仍然发出并返回成功
+func TestOrderedCanSenderSyncFrameSurvivesCanceledPlayback(t *testing.T) {
+	bridge, url := newFakeCanBridge(t, 0)
+	bridge.gate = make(chan struct{})
+	sender := NewOrderedCanSender()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// 第一帧在桥接服务阻塞，之后的帧留在队列中
+	sender.SendAsync(ctx, url, []CanMessage{{Interface: "can0", Id: 0x28, Data: []byte{OpCode, 1}}}, nil)
+	done := make(chan error, 1)
+	sender.enqueue(&canSendItem{
+		ctx:  context.Background(),
+		url:  url,
+		msg:  CanMessage{Interface: "can0", Id: 0x28, Data: []byte{OpCode, 2}},
+		done: done,
+	})
+	sender.SendAsync(ctx, url, []CanMessage{{Interface: "can0", Id: 0x28, Data: []byte{OpCode, 3}}}, nil)
+	cancel()
+	close(bridge.gate)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("同步帧发送失败: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("同步帧没有发送结果")
+	}
+	received := bridge.frames("can0")
+	if len(received) == 0 || received[len(received)-1].Data[1] != 2 {
+		t.Fatalf("同步帧没有到达桥接服务: %v", received)
+	}
+}
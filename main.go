@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -15,14 +16,24 @@ import (
 ////////////////////////////////////////////////////////////////////////////////
 
 func main() {
-	// 设置信号处理，确保程序退出时正确关闭气泵控制器
+	// 设置信号处理：SIGUSR1 触发急停（进程继续运行，故障锁定）；
+	// SIGINT/SIGTERM 退出前同样走急停流程，确保气泵关闭、手指释放，再关闭气泵控制器
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 	go func() {
-		<-sigChan
-		fmt.Println("\n🛑 收到退出信号，正在关闭气泵控制器...")
-		CloseGlobalPumpController()
-		os.Exit(0)
+		for sig := range sigChan {
+			if sig == syscall.SIGUSR1 {
+				globalEStop.Trigger("signal", sig.String())
+				continue
+			}
+			fmt.Println("\n🛑 收到退出信号，正在关闭气泵控制器...")
+			if globalEStop.Armed() {
+				globalEStop.Trigger("signal", sig.String())
+			}
+			CloseGlobalPumpController()
+			globalCapture.Stop()
+			os.Exit(0)
+		}
 	}()
 
 	// 定义命令行参数
@@ -30,13 +41,30 @@ func main() {
 		inputFile     = flag.String("in", "", "输入音乐文件路径 (例: trsmusic/test.json)")
 		instrument    = flag.String("instrument", "sks", "乐器类型: sks(萨克斯) 或 sn(唢呐)")
 		configFile    = flag.String("config", "config.yaml", "配置文件路径")
-		bpmOverride   = flag.Float64("bpm", 0, "覆盖BPM设置 (0表示使用配置文件或JSON文件中的值)")
+		bpmOverride   = flag.Float64("bpm", 0, "覆盖BPM设置 (0表示使用时间轴速度图的起始速度，没有速度图时使用配置文件)")
 		tonguingDelay = flag.Int("tongue", 30, "吐音延迟时间（毫秒）")
+		partName      = flag.String("part", "", "多声部总谱中要编译/演奏的声部名（单声部时间轴留空）")
 		help          = flag.Bool("help", false, "显示帮助信息")
 		preprocess    = flag.Bool("preprocess", false, "预处理模式：生成执行序列文件")
 		outputFile    = flag.String("out", "", "预处理输出文件路径 (例: trsmusic/test.exec.json)")
 		execFile      = flag.String("exec", "", "执行预计算的序列文件 (例: exec/test.exec.json)")
 		jsonFile      = flag.String("json", "", "执行预计算的序列文件 (例: exec/test.exec.json) [-json 等同于 -exec]")
+		migrateFile   = flag.String("migrate", "", "将旧版本执行序列文件升级到当前格式（原地改写）")
+		inspectFile   = flag.String("inspect", "", "以表格形式查看执行序列（时间、音符、气泵命令、各手按下的手指）")
+		diffFile      = flag.String("diff", "", "对比两个执行序列: -diff a.exec.json b.exec.json")
+		coordinator   = flag.Bool("coordinator", false, "合奏协调者模式：让多台机器人在统一时刻开始演奏（配合 -exec 与 -peers）")
+		scoreFile     = flag.String("score", "", "合奏协调者模式：多声部总谱，按配置 ensemble.assignments 分发声部（代替 -exec）")
+		peerList      = flag.String("peers", "", "合奏成员列表，逗号分隔的 host:port（留空使用配置文件 ensemble.peers）")
+		fromBar       = flag.Int("from-bar", 0, "从第几小节开始演奏（排练用，0表示从头）")
+		toBar         = flag.Int("to-bar", 0, "演奏到第几小节结束（0表示到结尾）")
+		loopCount     = flag.Int("loop", 0, "循环演奏次数（-1表示循环直到中断，常与 -from-bar/-to-bar 配合）")
+		convertFile   = flag.String("convert", "", "在JSON与二进制格式之间转换执行序列文件（-out 指定输出，扩展名 .bin 为二进制）")
+		captureFile   = flag.String("capture", "", "把实际发出的CAN消息和气泵串口命令录制到文件（配合 -exec/-in/-replay）")
+		replayFile    = flag.String("replay", "", "按原时序回放硬件I/O录制文件（不需要源时间轴）")
+		withArms      = flag.Bool("arms", false, "演奏前抬臂并下发防撞预姿态，演奏后释放手指并落臂（配置 arm_routine.enabled 时默认开启）")
+		postureCheck  = flag.String("posture", "", "检查并打印乐器的演奏前后姿态序列（sks/sn，不需要硬件）")
+		armSequence   = flag.String("arm", "", "执行一个手臂动作序列后退出 (例: -arm hlsup)")
+		bridgeMode    = flag.Bool("bridge", false, "内置CAN桥接服务模式：接收 POST /api/can 并写入 SocketCAN（代替独立的桥接服务）")
 	)
 
 	flag.Parse()
@@ -56,6 +84,66 @@ func main() {
 	fileReader := NewFileReader()
 	cfg := fileReader.LoadConfig(*configFile)
 
+	// === 执行序列升级模式 ===
+	if *migrateFile != "" {
+		sequence, err := loadExecutionSequence(*migrateFile)
+		if err != nil {
+			fmt.Printf("❌ 升级失败: %v\n", err)
+			os.Exit(1)
+		}
+		if err := saveExecutionSequence(sequence, *migrateFile); err != nil {
+			fmt.Printf("❌ 保存失败: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("✅ 已升级到版本 %s: %s\n", sequence.Meta.Version, *migrateFile)
+		return
+	}
+
+	// === 执行序列检查模式 ===
+	if *inspectFile != "" {
+		sequence, err := loadExecutionSequence(*inspectFile)
+		if err != nil {
+			fmt.Printf("❌ 加载失败: %v\n", err)
+			os.Exit(1)
+		}
+		PrintInspectTable(sequence, NewExecInspector(cfg).Inspect(sequence))
+		return
+	}
+
+	// === 执行序列对比模式 ===
+	if *diffFile != "" {
+		if flag.NArg() < 1 {
+			fmt.Println("❌ 错误: 对比模式需要两个文件: -diff a.exec.json b.exec.json")
+			os.Exit(1)
+		}
+		fileB := flag.Arg(0)
+		sequenceA, err := loadExecutionSequence(*diffFile)
+		if err != nil {
+			fmt.Printf("❌ 加载 %s 失败: %v\n", *diffFile, err)
+			os.Exit(1)
+		}
+		sequenceB, err := loadExecutionSequence(fileB)
+		if err != nil {
+			fmt.Printf("❌ 加载 %s 失败: %v\n", fileB, err)
+			os.Exit(1)
+		}
+		PrintExecDiff(*diffFile, fileB, DiffExecutionSequences(sequenceA, sequenceB))
+		return
+	}
+
+	// === 执行序列格式转换模式 ===
+	if *convertFile != "" {
+		output := *outputFile
+		if output == "" {
+			output = defaultConvertPath(*convertFile)
+		}
+		if err := ConvertExecutionSequence(*convertFile, output); err != nil {
+			fmt.Printf("❌ 转换失败: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// === 预处理模式 ===
 	if *preprocess {
 		if *inputFile == "" {
@@ -63,49 +151,113 @@ func main() {
 			os.Exit(1)
 		}
 
-		// 加载指法映射
-		fingeringMap := fileReader.LoadFingeringMapByInstrument(*instrument)
-
-		// 获取BPM
-		bpm := *bpmOverride
-		if bpm <= 0 {
-			bpm = cfg.BPM
-			if bpm <= 0 {
-				bpm = 60 // 默认BPM
-			}
+		compileCache := NewCompileCache(cfg)
+		compileRequest := CompileRequest{
+			SourceFile:    *inputFile,
+			Part:          *partName,
+			Instrument:    *instrument,
+			BPM:           compileCache.ResolveBPM(*bpmOverride, *inputFile),
+			TonguingDelay: *tonguingDelay,
+			OutputFile:    *outputFile,
 		}
 
 		// 自动生成输出文件名（如果未指定）
-		if *outputFile == "" {
-			// 确保 exec 目录存在
-			if err := os.MkdirAll("exec", 0755); err != nil {
-				fmt.Printf("❌ 错误: 创建 exec 目录失败: %v\n", err)
+		// 格式：原文件名_乐器类型_BPM_吐音延迟_设置哈希.exec.json，例如：青花瓷-葫芦丝-4min-108_sn_108_30_1a2b3c4d.exec.json
+		if compileRequest.OutputFile == "" {
+			path, err := compileCache.ExecPath(compileRequest)
+			if err != nil {
+				fmt.Printf("❌ 预处理失败: %v\n", err)
 				os.Exit(1)
 			}
+			compileRequest.OutputFile = path
+			fmt.Printf("📝 自动生成输出文件名: %s\n", path)
+		}
 
-			// 从输入文件路径提取基础文件名（去掉路径和.json扩展名）
-			baseFilename := filepath.Base(*inputFile)
-			baseFilename = baseFilename[:len(baseFilename)-5] // 移除 .json
-
-			// 生成格式：原文件名_乐器类型_BPM_吐音延迟.exec.json
-			// 例如：青花瓷-葫芦丝-4min-108_sn_108_30.exec.json
-			*outputFile = fmt.Sprintf("exec/%s_%s_%.0f_%d.exec.json",
-				baseFilename, *instrument, bpm, *tonguingDelay)
+		// 生成执行序列（预处理模式总是重新生成）
+		if err := compileCache.Compile(compileRequest); err != nil {
+			fmt.Printf("❌ 预处理失败: %v\n", err)
+			os.Exit(1)
+		}
 
-			fmt.Printf("📝 自动生成输出文件名: %s\n", *outputFile)
+		return
+	}
+	// === 内置CAN桥接服务模式（不需要气泵） ===
+	if *bridgeMode {
+		if err := RunCanBridge(cfg); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		// 创建预处理器
-		preprocessor := NewSequencePreprocessor(cfg, fingeringMap, *instrument, bpm, *tonguingDelay)
+	// === 姿态序列检查模式（不需要硬件） ===
+	if *postureCheck != "" {
+		ok := true
+		for _, phase := range []string{PostureBefore, PostureAfter} {
+			plan, err := PlanPosture(cfg, *postureCheck, phase)
+			if plan != nil {
+				PrintPosturePlan(plan)
+			}
+			if err != nil {
+				if plan == nil {
+					fmt.Printf("❌ %v\n", err)
+				}
+				ok = false
+			}
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
 
-		// 生成执行序列
-		if err := preprocessor.GenerateExecutionSequence(*inputFile, *outputFile); err != nil {
-			fmt.Printf("❌ 预处理失败: %v\n", err)
+	// === 手臂动作序列模式（不需要气泵） ===
+	if *armSequence != "" {
+		seq, err := LoadArmSequence(cfg, *armSequence)
+		if err == nil {
+			err = RunArmSequence(context.Background(), cfg, seq)
+		}
+		if err != nil {
+			fmt.Printf("❌ 手臂动作失败: %v\n", err)
 			os.Exit(1)
 		}
+		fmt.Printf("✅ 手臂动作 %s 完成\n", *armSequence)
+		return
+	}
 
+	// === 合奏协调者模式（协调者本身不需要气泵） ===
+	if *coordinator {
+		peers := cfg.Ensemble.Peers
+		if *peerList != "" {
+			peers = ParsePeerList(*peerList)
+		}
+		if *scoreFile == "" && len(peers) == 0 {
+			fmt.Println("❌ 错误: 协调者模式需要成员列表 (-peers 或配置文件 ensemble.peers)")
+			os.Exit(1)
+		}
+		if *scoreFile == "" && *execFile == "" {
+			fmt.Println("❌ 错误: 协调者模式需要指定执行文件 (-exec，成员在各自的exec目录中查找同名文件) 或多声部总谱 (-score)")
+			os.Exit(1)
+		}
+		// 协调者不是领队时，先与领队同步时钟再计算开始时刻
+		StartGlobalClockSync(cfg)
+		if globalClockSync != nil && !globalClockSync.WaitSynced(3*time.Second) {
+			fmt.Println("⚠️  时钟同步尚未完成，开始时刻可能存在偏差")
+		}
+		coordinator := NewEnsembleCoordinator(cfg, peers)
+		if *scoreFile != "" {
+			if _, err := coordinator.DistributeParts(*scoreFile, cfg.Ensemble.Assignments, *bpmOverride, *tonguingDelay); err != nil {
+				fmt.Printf("❌ 分发声部失败: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err := coordinator.Run(*execFile); err != nil {
+			fmt.Printf("❌ 合奏失败: %v\n", err)
+			os.Exit(1)
+		}
 		return
 	}
+
 	start := time.Now()
 	// 初始化气泵控制器（串口）
 	if cfg.Pump.PortName != "" {
@@ -113,31 +265,85 @@ func main() {
 		if err := InitGlobalPumpController(cfg.Pump.PortName); err != nil {
 			fmt.Printf("❌ 气泵控制器初始化失败: %v\n", err)
 			//os.Exit(1)
+		} else {
+			StartGlobalPumpGuard(cfg.Pump.Guard)
+			if warning := cfg.Pump.Guard.CheckBreath(cfg.Breath); warning != "" {
+				fmt.Printf("⚠️  气泵保护: %s\n", warning)
+			}
 		}
 	} else {
 		fmt.Println("❌ 错误: 配置文件中未指定气泵串口")
 		os.Exit(1)
 	}
+	StartGlobalEStop(cfg)
+	globalSessionStore = NewSessionStore(cfg.Sessions.Dir)
 	end := time.Now()
 	fmt.Printf("气泵控制器初始化时间: %v\n", end.Sub(start))
+	// === 硬件I/O录制 ===
+	if *captureFile != "" {
+		source := *execFile
+		if *replayFile != "" {
+			source = *replayFile
+		} else if *inputFile != "" {
+			source = *inputFile
+		}
+		if err := globalCapture.Start(*captureFile, source, cfg); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// === 录制回放模式 ===
+	if *replayFile != "" {
+		if err := ReplayCapture(context.Background(), cfg, *replayFile); err != nil {
+			fmt.Printf("❌ 回放失败: %v\n", err)
+			globalCapture.Stop()
+			os.Exit(1)
+		}
+		CloseGlobalPumpController()
+		globalCapture.Stop()
+		return
+	}
+
 	// === 执行预计算序列模式 ===
 	if *execFile != "" {
 
-		// 创建执行引擎
-		engine, err := NewExecutionEngine(*execFile, cfg)
+		// 输入（时间轴/指法/配置）变化时自动重新编译
+		result, err := NewCompileCache(cfg).EnsureExecFile(*execFile)
+		if err != nil {
+			fmt.Printf("❌ 加载执行序列失败: %v\n", err)
+			os.Exit(1)
+		}
+		printCompileResult(result)
+
+		// 创建执行引擎（已过期时使用当前设置对应的执行文件）
+		engine, err := NewExecutionEngine(result.ExecFile, cfg)
 		if err != nil {
 			fmt.Printf("❌ 创建执行引擎失败: %v\n", err)
 			os.Exit(1)
 		}
 
-		// 执行播放
-		if err := engine.Play(); err != nil {
+		if err := engine.SetRange(*fromBar, *toBar, *loopCount); err != nil {
+			fmt.Printf("❌ 设置演奏范围失败: %v\n", err)
+			os.Exit(1)
+		}
+		preparePerformance(engine, cfg, *withArms)
+
+		// 执行播放（桥接服务不可达或过慢时不开始）
+		if err := CanBridgePreflight(cfg); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			globalCapture.Stop()
+			os.Exit(1)
+		}
+		if err := engine.Perform(context.Background()); err != nil {
 			fmt.Printf("❌ 播放失败: %v\n", err)
+			globalCapture.Stop()
 			os.Exit(1)
 		}
 
 		// 演奏结束后关闭气泵控制器
 		CloseGlobalPumpController()
+		globalCapture.Stop()
 		return
 	}
 
@@ -146,37 +352,23 @@ func main() {
 	if *inputFile != "" {
 		fmt.Println("🔄 检测到输入文件，自动进入预处理+执行模式...")
 
-		// 加载指法映射
-		fingeringMap := fileReader.LoadFingeringMapByInstrument(*instrument)
-
-		// 获取BPM
-		bpm := *bpmOverride
-		if bpm <= 0 {
-			bpm = cfg.BPM
-			if bpm <= 0 {
-				bpm = 60 // 默认BPM
-			}
-		}
-
-		// 生成临时执行文件
-		if err := os.MkdirAll("exec", 0755); err != nil {
-			fmt.Printf("❌ 错误: 创建 exec 目录失败: %v\n", err)
-			os.Exit(1)
-		}
-
-		baseFilename := filepath.Base(*inputFile)
-		baseFilename = baseFilename[:len(baseFilename)-5] // 移除 .json
-		tempExecFile := fmt.Sprintf("exec/%s_%s_%.0f_%d.exec.json",
-			baseFilename, *instrument, bpm, *tonguingDelay)
-
-		fmt.Printf("📝 第1步: 预处理生成执行序列 -> %s\n", tempExecFile)
-
-		// 步骤1: 预处理
-		preprocessor := NewSequencePreprocessor(cfg, fingeringMap, *instrument, bpm, *tonguingDelay)
-		if err := preprocessor.GenerateExecutionSequence(*inputFile, tempExecFile); err != nil {
+		compileCache := NewCompileCache(cfg)
+		fmt.Println("📝 第1步: 预处理生成执行序列")
+
+		// 步骤1: 预处理（输入未变化时复用已有执行文件）
+		result, err := compileCache.Ensure(CompileRequest{
+			SourceFile:    *inputFile,
+			Part:          *partName,
+			Instrument:    *instrument,
+			BPM:           compileCache.ResolveBPM(*bpmOverride, *inputFile),
+			TonguingDelay: *tonguingDelay,
+		})
+		if err != nil {
 			fmt.Printf("❌ 预处理失败: %v\n", err)
 			os.Exit(1)
 		}
+		printCompileResult(result)
+		tempExecFile := result.ExecFile
 
 		fmt.Println("✅ 预处理完成")
 		fmt.Println("🎵 第2步: 开始执行演奏...")
@@ -187,20 +379,70 @@ func main() {
 			fmt.Printf("❌ 创建执行引擎失败: %v\n", err)
 			os.Exit(1)
 		}
+		if err := engine.SetRange(*fromBar, *toBar, *loopCount); err != nil {
+			fmt.Printf("❌ 设置演奏范围失败: %v\n", err)
+			os.Exit(1)
+		}
+		preparePerformance(engine, cfg, *withArms)
 
-		if err := engine.Play(); err != nil {
+		if err := CanBridgePreflight(cfg); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			globalCapture.Stop()
+			os.Exit(1)
+		}
+		if err := engine.Perform(context.Background()); err != nil {
 			fmt.Printf("❌ 播放失败: %v\n", err)
+			globalCapture.Stop()
 			os.Exit(1)
 		}
 
 		// 演奏结束后关闭气泵控制器
 		CloseGlobalPumpController()
+		globalCapture.Stop()
 		fmt.Println("✅ 演奏完成")
 		return
 	}
 
 	// === Web服务模式 ===
-	// 否则启动Web服务
+	// 否则启动Web服务（配置了领队时后台同步时钟，合奏按领队时间调度）
+	StartGlobalClockSync(cfg)
 	webServer := NewWebServer()
 	webServer.StartWebServer()
 }
+
+// preparePerformance 检查演奏前后姿态序列，需要时（-arms 或 arm_routine.enabled）设置手臂编排；无效时退出
+func preparePerformance(engine *ExecutionEngine, cfg Config, withArms bool) {
+	if err := ValidatePostures(cfg, engine.sequence.Meta.Instrument); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	if !withArms && !cfg.ArmRoutine.Enabled {
+		return
+	}
+	arms, err := NewArmRoutine(cfg)
+	if err != nil {
+		fmt.Printf("❌ 手臂编排不可用: %v\n", err)
+		os.Exit(1)
+	}
+	engine.SetArmRoutine(arms)
+}
+
+// printCompileResult 打印编译缓存结果（是否重新编译及原因）
+func printCompileResult(result *CompileResult) {
+	switch {
+	case result.Recompiled:
+		fmt.Printf("🔁 已重新编译 %s，原因: %s\n", result.ExecFile, strings.Join(result.Reasons, "；"))
+	case len(result.Reasons) > 0:
+		fmt.Printf("⚠️  %s\n", strings.Join(result.Reasons, "；"))
+	default:
+		fmt.Printf("♻️  输入未变化，复用执行文件: %s\n", result.ExecFile)
+	}
+}
+
+// defaultConvertPath 转换模式的默认输出路径：JSON ↔ 二进制互换扩展名
+func defaultConvertPath(inputFile string) string {
+	if isBinaryExecPath(inputFile) {
+		return strings.TrimSuffix(inputFile, ExecBinaryExt) + ".exec.json"
+	}
+	return strings.TrimSuffix(inputFile, ".exec.json") + ExecBinaryExt
+}
@@ -97,11 +97,17 @@ func (mfs *MusicFileScanner) ExtractMusicFileInfo(fpath string) *MusicFileInfo {
 		}
 	}
 
+	// 多声部总谱按最长声部统计
+	duration := len(timeline.Timeline)
+	for _, items := range timeline.Parts {
+		duration = max(duration, len(items))
+	}
+
 	return &MusicFileInfo{
 		Filename:   filepath.Base(fpath),
 		Title:      title,
 		BPM:        bpm,
-		Duration:   len(timeline.Timeline),
+		Duration:   duration,
 		FilePath:   fpath,
 		FileSize:   stat.Size(),
 		ModifiedAt: stat.ModTime().Format("2006-01-02 15:04:05"),
@@ -131,7 +137,7 @@ func (mfs *MusicFileScanner) ValidateMusicFile(fpath string) error {
 		return fmt.Errorf("文件格式错误: %v", err)
 	}
 
-	if len(timeline.Timeline) == 0 {
+	if len(timeline.Timeline) == 0 && len(timeline.Parts) == 0 {
 		return fmt.Errorf("时间轴为空")
 	}
 
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 装饰音展开 - 颤音（trill）、倚音（grace）、波音（mordent）、回音（turn）、连音（slur）
+////////////////////////////////////////////////////////////////////////////////
+//
+// 装饰音写在音符的选项对象中，解析时间轴时展开为若干短音符：
+//
+//	["C5", 2, {"trill": "D5"}]                                 C5与D5交替，默认每拍8个音
+//	["C5", 2, {"trill": {"note": "D5", "speed": 6}}]           每拍6个音
+//	["C5", 1, {"grace": "B4"}]                                 前倚音，从主音开头借时值
+//	["C5", 1, {"grace": {"notes": ["A4", "B4"], "position": "after", "beats": 0.125}}]  后倚音，从主音结尾借时值
+//	["C5", 1, {"mordent": "D5"}]                               主音-辅助音-主音
+//	["C5", 1, {"turn": ["D5", "B4"]}]                          上方音-主音-下方音-主音
+//	["C5", 1, {"trill": "D5", "slur": true}]                   展开的音符之间及与下一个音符之间不吐音
+//
+// 辅助音直接写音名（调性不同，上下方音无法从主音推算）。倚音可以与其它一种装饰音组合。
+
+const (
+	defaultTrillSpeed   = 8.0   // 颤音默认速度（每拍音符数）
+	defaultGraceBeats   = 0.125 // 倚音默认时值（拍，即三十二分音符）
+	ornamentNoteBeats   = 0.125 // 波音、回音中短音的时值上限（拍）
+	maxGraceStealRatio  = 0.5   // 倚音最多占用主音时值的比例
+	minTrillAlternation = 3     // 颤音最少音符数（主-辅-主）
+)
+
+// Ornament 装饰音设置
+type Ornament struct {
+	Trill      string   // 颤音辅助音
+	TrillSpeed float64  // 颤音速度（每拍音符数）
+	Grace      []string // 倚音
+	GraceAfter bool     // 是否为后倚音
+	GraceBeats float64  // 每个倚音的时值（拍）
+	Mordent    string   // 波音辅助音
+	Turn       []string // 回音的上方音、下方音
+}
+
+// parseOrnamentOption 解析装饰音选项（key 为 trill/grace/mordent/turn）
+func parseOrnamentOption(event *NoteEvent, key string, value any) error {
+	if event.Note == "NO" {
+		return fmt.Errorf("空拍不能添加装饰音 %s", key)
+	}
+	if event.Ornament == nil {
+		event.Ornament = &Ornament{}
+	}
+	ornament := event.Ornament
+	utils := NewUtils()
+
+	switch key {
+	case "trill":
+		ornament.TrillSpeed = defaultTrillSpeed
+		switch v := value.(type) {
+		case string:
+			ornament.Trill = v
+		case map[string]any:
+			note, _ := v["note"].(string)
+			ornament.Trill = note
+			if speed, ok := v["speed"]; ok {
+				s, ok := utils.ConvertToFloat(speed)
+				if !ok || s <= 0 {
+					return fmt.Errorf("trill.speed 应为正数（每拍音符数）")
+				}
+				ornament.TrillSpeed = s
+			}
+		}
+		if ornament.Trill == "" {
+			return fmt.Errorf("trill 应为辅助音名或 {\"note\": 音名, \"speed\": 每拍音符数}")
+		}
+
+	case "grace":
+		ornament.GraceBeats = defaultGraceBeats
+		switch v := value.(type) {
+		case string, []any:
+			notes, err := ornamentNotes(v)
+			if err != nil {
+				return fmt.Errorf("grace %v", err)
+			}
+			ornament.Grace = notes
+		case map[string]any:
+			notes, err := ornamentNotes(v["notes"])
+			if err != nil {
+				return fmt.Errorf("grace.notes %v", err)
+			}
+			ornament.Grace = notes
+			switch v["position"] {
+			case nil, "before":
+			case "after":
+				ornament.GraceAfter = true
+			default:
+				return fmt.Errorf("grace.position 应为 before 或 after")
+			}
+			if beats, ok := v["beats"]; ok {
+				b, ok := utils.ConvertToFloat(beats)
+				if !ok || b <= 0 {
+					return fmt.Errorf("grace.beats 应为正数")
+				}
+				ornament.GraceBeats = b
+			}
+		default:
+			return fmt.Errorf("grace 应为音名、音名数组或对象")
+		}
+
+	case "mordent":
+		note, ok := value.(string)
+		if !ok || note == "" {
+			return fmt.Errorf("mordent 应为辅助音名")
+		}
+		ornament.Mordent = note
+
+	case "turn":
+		notes, err := ornamentNotes(value)
+		if err != nil || len(notes) != 2 {
+			return fmt.Errorf("turn 应为 [上方音, 下方音]")
+		}
+		ornament.Turn = notes
+	}
+
+	kinds := 0
+	for _, set := range []bool{ornament.Trill != "", ornament.Mordent != "", ornament.Turn != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return fmt.Errorf("trill、mordent、turn 不能同时使用")
+	}
+	return nil
+}
+
+// ornamentNotes 解析音名或音名数组
+func ornamentNotes(value any) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			return []string{v}, nil
+		}
+	case []any:
+		notes := make([]string, 0, len(v))
+		for _, item := range v {
+			note, ok := item.(string)
+			if !ok || note == "" {
+				return nil, fmt.Errorf("应为音名数组")
+			}
+			notes = append(notes, note)
+		}
+		if len(notes) > 0 {
+			return notes, nil
+		}
+	}
+	return nil, fmt.Errorf("应为音名或音名数组")
+}
+
+// expandOrnament 将带装饰音的音符展开为若干短音符（时值合计不变）
+// 展开的音符沿用原音符的序号、延长记号与连音标记；slur 时展开的音符全部连奏
+func expandOrnament(event NoteEvent) []NoteEvent {
+	ornament := event.Ornament
+	if ornament == nil {
+		return []NoteEvent{event}
+	}
+
+	sub := func(note string, beats float64) NoteEvent {
+		n := event
+		n.Note = note
+		n.Duration = beats
+		n.Ornament = nil
+		n.Breath = false // 换气标记只保留在最后一个展开的音符上
+		return n
+	}
+
+	// 倚音从主音借时值（最多一半，超出时按比例压缩）
+	principalBeats := event.Duration
+	var graceNotes []NoteEvent
+	if len(ornament.Grace) > 0 {
+		graceBeats := ornament.GraceBeats
+		if total := graceBeats * float64(len(ornament.Grace)); total > event.Duration*maxGraceStealRatio {
+			graceBeats = event.Duration * maxGraceStealRatio / float64(len(ornament.Grace))
+		}
+		for _, note := range ornament.Grace {
+			graceNotes = append(graceNotes, sub(note, graceBeats))
+		}
+		principalBeats -= graceBeats * float64(len(ornament.Grace))
+	}
+
+	var body []NoteEvent
+	switch {
+	case ornament.Trill != "":
+		// 主音开始、主音结束，音符数取奇数
+		count := int(math.Round(principalBeats * ornament.TrillSpeed))
+		if count%2 == 0 {
+			count--
+		}
+		count = max(count, minTrillAlternation)
+		each := principalBeats / float64(count)
+		for i := 0; i < count; i++ {
+			note := event.Note
+			if i%2 == 1 {
+				note = ornament.Trill
+			}
+			body = append(body, sub(note, each))
+		}
+
+	case ornament.Mordent != "":
+		short := math.Min(ornamentNoteBeats, principalBeats/4)
+		body = []NoteEvent{
+			sub(event.Note, short),
+			sub(ornament.Mordent, short),
+			sub(event.Note, principalBeats-2*short),
+		}
+
+	case ornament.Turn != nil:
+		short := math.Min(ornamentNoteBeats, principalBeats/5)
+		body = []NoteEvent{
+			sub(ornament.Turn[0], short),
+			sub(event.Note, short),
+			sub(ornament.Turn[1], short),
+			sub(event.Note, principalBeats-3*short),
+		}
+
+	default:
+		body = []NoteEvent{sub(event.Note, principalBeats)}
+	}
+
+	var expanded []NoteEvent
+	if ornament.GraceAfter {
+		expanded = append(body, graceNotes...)
+	} else {
+		expanded = append(graceNotes, body...)
+	}
+	expanded[len(expanded)-1].Breath = event.Breath
+	return expanded
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 演奏会话 - 每次播放一个独立的会话（ID + 可取消的上下文 + 退出信号）
+////////////////////////////////////////////////////////////////////////////////
+//
+// 开始、停止、替换都由 PlaybackController 串行处理（开始前先做急停检查、姿态序列检查和CAN桥接服务预检）：
+//   - 停止：以 ErrUserStopped 为原因取消会话上下文，等待会话完全退出（气泵关闭、收尾完成）
+//   - 开始：先以 ErrPlaybackReplaced 停止当前会话并等待其退出，再创建新会话
+// 演奏时会话上下文再挂到急停上下文之下（见 EmergencyStop.WithEStop），急停时以 ErrEmergencyStop 取消。
+// 演奏循环、CAN帧转发、气泵命令都检查该上下文，不再需要共享的停止/完成通道和等待延时。
+
+// ErrPlaybackReplaced 演奏被新的演奏替换
+var ErrPlaybackReplaced = errors.New("playback replaced by a new session")
+
+// 会话序号（同一秒内开始的会话用序号区分）
+var playbackSessionSeq atomic.Int64
+
+// PlaybackSession 一次演奏会话
+type PlaybackSession struct {
+	ID        string
+	StartedAt time.Time
+	engine    *ExecutionEngine
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	done      chan struct{} // 会话完全退出后关闭
+	err       error         // 演奏结果（done 关闭后有效）
+}
+
+// newPlaybackSession 创建演奏会话
+func newPlaybackSession(parent context.Context, engine *ExecutionEngine) *PlaybackSession {
+	now := time.Now()
+	ctx, cancel := context.WithCancelCause(parent)
+	return &PlaybackSession{
+		ID:        fmt.Sprintf("%s-%03d", now.Format("20060102-150405"), playbackSessionSeq.Add(1)%1000),
+		StartedAt: now,
+		engine:    engine,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Done 会话完全退出后关闭的通道
+func (s *PlaybackSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Finished 会话是否已经退出
+func (s *PlaybackSession) Finished() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err 演奏结果（会话退出前为 nil）
+func (s *PlaybackSession) Err() error {
+	if !s.Finished() {
+		return nil
+	}
+	return s.err
+}
+
+// playbackCause 上下文被取消的原因（未指定原因时视为用户停止）
+func playbackCause(ctx context.Context) error {
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	return ErrUserStopped
+}
+
+// Current 当前会话（没有演奏过时为 nil）
+func (pc *PlaybackController) Current() *PlaybackSession {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+	return pc.session
+}
+
+// Running 是否有正在进行的演奏
+func (pc *PlaybackController) Running() bool {
+	session := pc.Current()
+	return session != nil && !session.Finished()
+}
+
+// Start 停止并等待当前会话退出，然后在新会话中异步播放
+func (pc *PlaybackController) Start(parent context.Context, engine *ExecutionEngine) (*PlaybackSession, error) {
+	pc.sessionMutex.Lock()
+	defer pc.sessionMutex.Unlock()
+
+	if err := globalEStop.Check(); err != nil {
+		return nil, err
+	}
+	// 演奏前后姿态序列违反顺序约束时拒绝开始
+	if err := ValidatePostures(engine.cfg, engine.sequence.Meta.Instrument); err != nil {
+		return nil, err
+	}
+	// 桥接服务不可达或过慢时拒绝开始（不影响正在进行的演奏）
+	if err := CanBridgePreflight(engine.cfg); err != nil {
+		return nil, err
+	}
+	pc.stopLocked(ErrPlaybackReplaced)
+	sessionCanStats.Reset()
+
+	session := newPlaybackSession(parent, engine)
+	meta := engine.sequence.Meta
+	pc.mutex.Lock()
+	pc.session = session
+	pc.startTime = session.StartedAt
+	pc.instrument = meta.Instrument
+	pc.config = engine.cfg
+	pc.status = PlaybackStatus{
+		IsPlaying:   true,
+		SessionID:   session.ID,
+		CurrentFile: meta.SourceFile,
+		TotalNotes:  meta.TotalEvents,
+		FromBar:     engine.fromBar,
+		ToBar:       engine.toBar,
+		Loop:        engine.loop,
+	}
+	if !engine.startAt.IsZero() {
+		pc.status.ScheduledStartMS = engine.startAt.UnixMilli()
+	}
+	pc.mutex.Unlock()
+
+	fmt.Printf("🎬 演奏会话 %s 开始\n", session.ID)
+	go engine.runSession(session)
+	return session, nil
+}
+
+// Stop 以指定原因停止当前会话并等待其完全退出（没有正在进行的演奏时返回 nil）
+func (pc *PlaybackController) Stop(cause error) *PlaybackSession {
+	pc.sessionMutex.Lock()
+	defer pc.sessionMutex.Unlock()
+	return pc.stopLocked(cause)
+}
+
+// stopLocked 停止当前会话（调用方持有 sessionMutex）
+func (pc *PlaybackController) stopLocked(cause error) *PlaybackSession {
+	session := pc.Current()
+	if session == nil || session.Finished() {
+		return nil
+	}
+	fmt.Printf("⏹️  停止演奏会话 %s（%v）...\n", session.ID, cause)
+	session.cancel(cause)
+	<-session.done
+	fmt.Printf("✅ 演奏会话 %s 已退出\n", session.ID)
+	return session
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 演奏前后姿态序列 - 首音之前、末音之后按步骤下发手指姿态，避免手撞击管身
+////////////////////////////////////////////////////////////////////////////////
+//
+// 配置（按乐器区分，键为 sks/sn）：
+//   posture:
+//     sn:
+//       before: [{left: [151, 100, 255, 255, 255, 255], hold_ms: 200}, {left: [255, 100, ...], hold_ms: 200}]
+//       after:  [...]
+//       order_before: [{first: Thumb rotation, then: Thumb}]
+// 每一步给出左/右手6个手指值（顺序同 release_profile，省略的手保持不动），下发后保持 hold_ms。
+// 顺序约束：同一只手上 first 的所有动作必须在 then 的任何动作之前的步骤完成（同一步同时动作也算违反）。
+// 未配置时 before 默认"拇指旋转先于拇指弯曲"，after 默认相反。动作以前一步的姿态为准判断，
+// 第一步之前的姿态：before 为该乐器的释放姿态（release_profile），after 为按压姿态（press_profile，最坏情况）。
+// 违反约束时拒绝演奏；-posture sn 或 GET /api/posture?instrument=sn 可在没有硬件时检查，dry_run 时打印每一步的帧。
+
+// ErrInvalidPosture 姿态序列配置无效或违反顺序约束（Web API 返回 400）
+var ErrInvalidPosture = errors.New("演奏前后姿态序列无效")
+
+// 姿态阶段
+const (
+	PostureBefore = "before" // 首音之前
+	PostureAfter  = "after"  // 末音之后
+)
+
+// postureFingerNames 帧中6个手指的名称（与 fingerIndex 一致）
+var postureFingerNames = []string{"Thumb", "Thumb rotation", "Index", "Middle", "Ring", "Little"}
+
+// PostureStep 姿态序列中的一步
+type PostureStep struct {
+	Left   []int `yaml:"left" json:"left,omitempty"`   // 左手6个手指值（省略表示不动）
+	Right  []int `yaml:"right" json:"right,omitempty"` // 右手6个手指值
+	HoldMS int   `yaml:"hold_ms" json:"hold_ms"`       // 下发后保持时间（毫秒）
+}
+
+// PostureOrder 顺序约束：first 的动作全部完成后 then 才能动作
+type PostureOrder struct {
+	First string `yaml:"first" json:"first"`
+	Then  string `yaml:"then" json:"then"`
+}
+
+// InstrumentPosture 一种乐器的演奏前后姿态序列
+type InstrumentPosture struct {
+	Before      []PostureStep  `yaml:"before"`
+	After       []PostureStep  `yaml:"after"`
+	OrderBefore []PostureOrder `yaml:"order_before"` // 留空使用默认约束
+	OrderAfter  []PostureOrder `yaml:"order_after"`
+}
+
+// defaultPostureOrder 默认顺序约束：进入姿态时先旋转拇指再弯曲，退出时相反
+func defaultPostureOrder(phase string) []PostureOrder {
+	if phase == PostureAfter {
+		return []PostureOrder{{First: "Thumb", Then: "Thumb rotation"}}
+	}
+	return []PostureOrder{{First: "Thumb rotation", Then: "Thumb"}}
+}
+
+// PlannedPostureStep 校验后的一步（含每只手的完整姿态与本步动作的手指）
+type PlannedPostureStep struct {
+	Step        int      `json:"step"`
+	Left        []int    `json:"left,omitempty"`
+	Right       []int    `json:"right,omitempty"`
+	LeftMoving  []string `json:"left_moving,omitempty"`
+	RightMoving []string `json:"right_moving,omitempty"`
+	HoldMS      int      `json:"hold_ms"`
+	leftMoves   []bool
+	rightMoves  []bool
+}
+
+// PosturePlan 一个阶段的姿态序列校验结果
+type PosturePlan struct {
+	Instrument string               `json:"instrument"`
+	Phase      string               `json:"phase"`
+	Order      []PostureOrder       `json:"order"`
+	Steps      []PlannedPostureStep `json:"steps"`
+	Violations []string             `json:"violations,omitempty"`
+}
+
+// instrumentProfiles 乐器的按压/释放姿态（左、右）
+func instrumentProfiles(cfg Config, instrument string) (leftPress, leftRelease, rightPress, rightRelease []int) {
+	if instrument == "sn" {
+		return cfg.SnLeftPressProfile, cfg.SnLeftReleaseProfile, cfg.SnRightPressProfile, cfg.SnRightReleaseProfile
+	}
+	return cfg.SksLeftPressProfile, cfg.SksLeftReleaseProfile, cfg.SksRightPressProfile, cfg.SksRightReleaseProfile
+}
+
+// fullPosture 补全为6个手指值（缺少的手指视为释放255）
+func fullPosture(values []int) []int {
+	full := make([]int, len(postureFingerNames))
+	for i := range full {
+		full[i] = 255
+		if i < len(values) {
+			full[i] = values[i]
+		}
+	}
+	return full
+}
+
+// HasPosture 乐器是否配置了该阶段的姿态序列
+func HasPosture(cfg Config, instrument, phase string) bool {
+	posture := cfg.Posture[instrument]
+	if phase == PostureAfter {
+		return len(posture.After) > 0
+	}
+	return len(posture.Before) > 0
+}
+
+// PlanPosture 校验姿态序列（数值范围、顺序约束）并计算每一步动作的手指
+// 数值或约束配置无效时只返回错误；违反顺序约束时同时返回结果（含 Violations）和错误
+func PlanPosture(cfg Config, instrument, phase string) (*PosturePlan, error) {
+	posture := cfg.Posture[instrument]
+	steps, order := posture.Before, posture.OrderBefore
+	leftPress, leftRelease, rightPress, rightRelease := instrumentProfiles(cfg, instrument)
+	left, right := fullPosture(leftRelease), fullPosture(rightRelease)
+	if phase == PostureAfter {
+		steps, order = posture.After, posture.OrderAfter
+		left, right = fullPosture(leftPress), fullPosture(rightPress)
+	}
+	if len(order) == 0 {
+		order = defaultPostureOrder(phase)
+	}
+
+	plan := &PosturePlan{Instrument: instrument, Phase: phase, Order: order, Steps: []PlannedPostureStep{}}
+	for i, step := range steps {
+		if step.HoldMS < 0 {
+			return nil, fmt.Errorf("%s姿态第%d步: hold_ms 不能为负数", phase, i+1)
+		}
+		if len(step.Left) == 0 && len(step.Right) == 0 {
+			return nil, fmt.Errorf("%s姿态第%d步: 没有指定任何一只手", phase, i+1)
+		}
+		planned := PlannedPostureStep{Step: i + 1, HoldMS: step.HoldMS}
+		var err error
+		if len(step.Left) > 0 {
+			if planned.leftMoves, err = movePosture(left, step.Left); err != nil {
+				return nil, fmt.Errorf("%s姿态第%d步左手: %v", phase, i+1, err)
+			}
+			planned.Left = append([]int(nil), left...)
+			planned.LeftMoving = movingFingers(planned.leftMoves)
+		}
+		if len(step.Right) > 0 {
+			if planned.rightMoves, err = movePosture(right, step.Right); err != nil {
+				return nil, fmt.Errorf("%s姿态第%d步右手: %v", phase, i+1, err)
+			}
+			planned.Right = append([]int(nil), right...)
+			planned.RightMoving = movingFingers(planned.rightMoves)
+		}
+		plan.Steps = append(plan.Steps, planned)
+	}
+
+	for _, o := range order {
+		first := NewFingeringBuilder().getFingerIndex(o.First)
+		then := NewFingeringBuilder().getFingerIndex(o.Then)
+		if first < 0 || then < 0 || first == then {
+			return nil, fmt.Errorf("无效的顺序约束: %s → %s", o.First, o.Then)
+		}
+		plan.Violations = append(plan.Violations, checkPostureOrder(plan.Steps, "左手", first, then, func(s PlannedPostureStep) []bool { return s.leftMoves })...)
+		plan.Violations = append(plan.Violations, checkPostureOrder(plan.Steps, "右手", first, then, func(s PlannedPostureStep) []bool { return s.rightMoves })...)
+	}
+	if len(plan.Violations) > 0 {
+		return plan, fmt.Errorf("%s %s姿态违反顺序约束: %s", instrument, phase, strings.Join(plan.Violations, "；"))
+	}
+	return plan, nil
+}
+
+// movePosture 把一只手从当前姿态移到目标姿态（原地更新），返回每个手指是否动作
+func movePosture(current, target []int) ([]bool, error) {
+	if len(target) != len(postureFingerNames) {
+		return nil, fmt.Errorf("需要%d个手指值，实际%d个", len(postureFingerNames), len(target))
+	}
+	moving := make([]bool, len(target))
+	for i, v := range target {
+		if v < 0 || v > 255 {
+			return nil, fmt.Errorf("%s 的值%d超出0~255", postureFingerNames[i], v)
+		}
+		moving[i] = current[i] != v
+		current[i] = v
+	}
+	return moving, nil
+}
+
+// movingFingers 动作的手指名称
+func movingFingers(moving []bool) []string {
+	var names []string
+	for i, m := range moving {
+		if m {
+			names = append(names, postureFingerNames[i])
+		}
+	}
+	return names
+}
+
+// describeMoving 动作手指的显示文本
+func describeMoving(names []string) string {
+	if len(names) == 0 {
+		return "无"
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkPostureOrder 检查一只手上 first 的最后一次动作是否早于 then 的第一次动作
+func checkPostureOrder(steps []PlannedPostureStep, hand string, first, then int, moving func(PlannedPostureStep) []bool) []string {
+	lastFirst, firstThen := 0, 0
+	for _, step := range steps {
+		m := moving(step)
+		if m == nil {
+			continue
+		}
+		if m[first] {
+			lastFirst = step.Step
+		}
+		if m[then] && firstThen == 0 {
+			firstThen = step.Step
+		}
+	}
+	if lastFirst == 0 || firstThen == 0 || lastFirst < firstThen {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s %s 在第%d步动作，但 %s 在第%d步已开始动作",
+		hand, postureFingerNames[first], lastFirst, postureFingerNames[then], firstThen)}
+}
+
+// ValidatePostures 检查乐器的演奏前后姿态序列（演奏开始前调用）
+func ValidatePostures(cfg Config, instrument string) error {
+	var errs []error
+	for _, phase := range []string{PostureBefore, PostureAfter} {
+		if _, err := PlanPosture(cfg, instrument, phase); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidPosture, errors.Join(errs...))
+	}
+	return nil
+}
+
+// RunPosture 按步骤下发姿态序列（未配置时直接返回；ctx 取消或急停时在步骤之间停止）
+func RunPosture(ctx context.Context, cfg Config, instrument, phase string) error {
+	if !HasPosture(cfg, instrument, phase) {
+		return nil
+	}
+	plan, err := PlanPosture(cfg, instrument, phase)
+	if err != nil {
+		return err
+	}
+	if err := globalEStop.Check(); err != nil {
+		return err
+	}
+	ctx, cancel := globalEStop.WithEStop(ctx)
+	defer cancel()
+
+	utils := NewUtils()
+	builder := NewFingeringBuilder()
+	fmt.Printf("✋ 下发%s姿态（%s，%d步）\n", phase, instrument, len(plan.Steps))
+	for _, step := range plan.Steps {
+		if ctx.Err() != nil {
+			return playbackCause(ctx)
+		}
+		var msgs []CanMessage
+		if step.Left != nil {
+			msgs = append(msgs, CanMessage{
+				Interface: cfg.Hands.Left.Interface,
+				Id:        utils.ParseCanID(cfg.Hands.Left.ID),
+				Data:      builder.BuildReleaseFrame(step.Left),
+			})
+		}
+		if step.Right != nil {
+			msgs = append(msgs, CanMessage{
+				Interface: cfg.Hands.Right.Interface,
+				Id:        utils.ParseCanID(cfg.Hands.Right.ID),
+				Data:      builder.BuildReleaseFrame(step.Right),
+			})
+		}
+		if cfg.DryRun {
+			for _, msg := range msgs {
+				fmt.Printf("   [dry_run] 第%d步 %s 0x%X % X，保持%dms\n", step.Step, msg.Interface, msg.Id, msg.Data, step.HoldMS)
+			}
+		}
+		if err := utils.SendCanFrames(cfg, msgs...); err != nil {
+			return fmt.Errorf("%s姿态第%d步发送失败: %v", phase, step.Step, err)
+		}
+		if err := sleepContext(ctx, time.Duration(step.HoldMS)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintPosturePlan 打印姿态序列的每一步与约束检查结果（-posture 模式）
+func PrintPosturePlan(plan *PosturePlan) {
+	fmt.Printf("\n=== %s %s姿态（%d步）===\n", plan.Instrument, plan.Phase, len(plan.Steps))
+	var rules []string
+	for _, o := range plan.Order {
+		rules = append(rules, fmt.Sprintf("%s → %s", o.First, o.Then))
+	}
+	fmt.Printf("顺序约束: %s\n", strings.Join(rules, "，"))
+	if len(plan.Steps) == 0 {
+		fmt.Println("（未配置）")
+	}
+	for _, step := range plan.Steps {
+		fmt.Printf("第%d步（保持%dms）\n", step.Step, step.HoldMS)
+		if step.Left != nil {
+			fmt.Printf("   左手 %v  动作: %s\n", step.Left, describeMoving(step.LeftMoving))
+		}
+		if step.Right != nil {
+			fmt.Printf("   右手 %v  动作: %s\n", step.Right, describeMoving(step.RightMoving))
+		}
+	}
+	for _, v := range plan.Violations {
+		fmt.Printf("❌ %s\n", v)
+	}
+	if len(plan.Violations) == 0 {
+		fmt.Println("✅ 顺序约束检查通过")
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
+	"math"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -19,35 +19,124 @@ type SequencePreprocessor struct {
 	instrument     string
 	bpm            float64
 	tonguingDelay  int
-	secondsPerBeat float64
+	tempoMap       *TempoMap        // 速度图（生成序列时由时间轴元数据确定，缺省为匀速）
+	timeSignature  TimeSignature    // 拍号（由时间轴元数据确定，缺省4/4）
+	fingerLeadMS   int              // 换指提前量（毫秒）
+	switchDipMS    int              // 换指气泵短暂关闭时长（毫秒）
+	timing         InstrumentTiming // 乐器时序配置（空拍预切换、显著空拍阈值）
+	timingOverride bool             // 换指参数是否由调用方覆盖（重新编译时需沿用）
+	part           string           // 多声部总谱中要编译的声部（空表示单声部时间轴）
+
+	expression         ExpressionSettings // 表情演奏设置（缺省取配置文件 expression 段）
+	expressionOverride bool               // 表情设置是否由调用方覆盖（重新编译时需沿用）
+	breath             BreathConfig       // 换气规划设置（缺省取配置文件 breath 段）
+	breathOverride     bool               // 换气设置是否由调用方覆盖（重新编译时需沿用）
 }
 
 // NewSequencePreprocessor 创建新的序列预处理器
+// 换指提前量与气泵降压默认取自配置文件中该乐器的 timing 配置，可通过 SetFingerLead 覆盖
 func NewSequencePreprocessor(cfg Config, fingeringMap map[string]FingeringEntry, instrument string, bpm float64, tonguingDelay int) *SequencePreprocessor {
+	timing := cfg.TimingFor(instrument)
 	return &SequencePreprocessor{
-		cfg:            cfg,
-		fingeringMap:   fingeringMap,
-		instrument:     instrument,
-		bpm:            bpm,
-		tonguingDelay:  tonguingDelay,
-		secondsPerBeat: 60.0 / bpm,
+		cfg:           cfg,
+		fingeringMap:  fingeringMap,
+		instrument:    instrument,
+		bpm:           bpm,
+		tonguingDelay: tonguingDelay,
+		tempoMap:      NewConstantTempoMap(bpm),
+		timeSignature: DefaultTimeSignature,
+		expression:    cfg.Expression,
+		breath:        cfg.Breath,
+		fingerLeadMS:  timing.FingerLeadMS,
+		switchDipMS:   timing.SwitchDipMS,
+		timing:        timing,
 	}
 }
 
+// SetFingerLead 覆盖换指提前量和换指气泵降压时长（毫秒，负数按0处理）
+func (sp *SequencePreprocessor) SetFingerLead(leadMS, dipMS int) {
+	sp.fingerLeadMS = max(leadMS, 0)
+	sp.switchDipMS = max(dipMS, 0)
+	sp.timingOverride = true
+}
+
+// SetPart 指定要编译的声部（多声部总谱）
+func (sp *SequencePreprocessor) SetPart(part string) {
+	sp.part = part
+}
+
+// SetExpression 覆盖表情演奏设置
+func (sp *SequencePreprocessor) SetExpression(settings ExpressionSettings) {
+	sp.expression = settings
+	sp.expressionOverride = true
+}
+
+// SetBreath 覆盖换气规划设置
+func (sp *SequencePreprocessor) SetBreath(settings BreathConfig) {
+	sp.breath = settings
+	sp.breathOverride = true
+}
+
+// ParamsHash 计算预处理参数哈希（乐器、BPM、吐音延迟、换指参数、声部、表情与换气设置）
+func (sp *SequencePreprocessor) ParamsHash() string {
+	params := map[string]any{
+		"instrument":      sp.instrument,
+		"bpm":             sp.bpm,
+		"tonguing_delay":  sp.tonguingDelay,
+		"finger_lead_ms":  sp.fingerLeadMS,
+		"switch_dip_ms":   sp.switchDipMS,
+		"timing_override": sp.timingOverride,
+	}
+	// 单声部不纳入，保持已有执行文件的哈希不变
+	if sp.part != "" {
+		params["part"] = sp.part
+	}
+	// 按补全默认值后的设置计算，与生成时写入元数据的设置一致（设置无效时生成会失败，这里忽略错误）
+	if expression, _ := sp.expression.Normalized(); expression.Enabled() {
+		params["expression"] = expression
+	}
+	if sp.expressionOverride {
+		params["expression_override"] = true
+	}
+	if sp.breathOverride {
+		params["breath_override"] = sp.breath
+	}
+	return hashJSON(params)
+}
+
 // GenerateExecutionSequence 生成执行序列文件
 func (sp *SequencePreprocessor) GenerateExecutionSequence(musicFile string, outputFile string) error {
 	fmt.Printf("🔄 开始预处理: %s\n", musicFile)
+	if sp.part != "" {
+		fmt.Printf("   声部: %s\n", sp.part)
+	}
 	fmt.Printf("   乐器: %s, BPM: %.1f, 吐音延迟: %dms\n", sp.instrument, sp.bpm, sp.tonguingDelay)
+	if sp.fingerLeadMS > 0 || sp.switchDipMS > 0 {
+		fmt.Printf("   换指提前: %dms, 换指降压: %dms\n", sp.fingerLeadMS, sp.switchDipMS)
+	}
+	expression, err := sp.expression.Normalized()
+	if err != nil {
+		return fmt.Errorf("表情设置无效: %v", err)
+	}
+	sp.expression = expression
+	if expression.Enabled() {
+		fmt.Printf("   表情: %s\n", expression)
+	}
 
 	// 1. 加载时间轴文件
-	fileReader := NewFileReader()
-	timeline := fileReader.LoadTimeline(musicFile)
+	timeline, err := NewFileReader().ReadTimeline(musicFile)
+	if err != nil {
+		return err
+	}
 
-	// 2. 解析为音符事件
+	// 2. 解析为音符事件与速度图
 	events, err := sp.parseTimeline(timeline)
 	if err != nil {
 		return fmt.Errorf("解析时间轴失败: %v", err)
 	}
+	if err := sp.applyTempoMap(timeline.Meta); err != nil {
+		return fmt.Errorf("解析速度图失败: %v", err)
+	}
 
 	fmt.Printf("   音符总数: %d\n", len(events))
 
@@ -57,6 +146,32 @@ func (sp *SequencePreprocessor) GenerateExecutionSequence(musicFile string, outp
 		return fmt.Errorf("生成执行序列失败: %v", err)
 	}
 
+	// 记录输入哈希，供编译缓存判断执行文件是否过期
+	timelineHash, err := hashFile(musicFile)
+	if err != nil {
+		return err
+	}
+	execSequence.Meta.SourcePath = musicFile
+	execSequence.Meta.Part = sp.part
+	execSequence.Meta.TimingOverride = sp.timingOverride
+	execSequence.Meta.ExpressionOverride = sp.expressionOverride
+	if sp.breathOverride {
+		breath := sp.breath
+		execSequence.Meta.BreathOverride = &breath
+	}
+	execSequence.Meta.TimelineHash = timelineHash
+	execSequence.Meta.ParamsHash = sp.ParamsHash()
+	execSequence.Meta.InputHash = combineInputHashes(execSequence.Meta)
+
+	// 保存前按正式格式校验，避免写出无法加载的文件
+	if err := ValidateExecutionSequence(execSequence); err != nil {
+		return err
+	}
+
+	printBreathPoints(execSequence.Meta.Breaths)
+	for _, warning := range sp.cfg.Pump.Guard.CheckSequence(execSequence) {
+		fmt.Printf("⚠️  气泵保护: %s\n", warning)
+	}
 	fmt.Printf("   执行事件数: %d\n", len(execSequence.Events))
 	fmt.Printf("   总时长: %.2f秒\n", execSequence.Meta.TotalDurationMS/1000.0)
 
@@ -69,35 +184,138 @@ func (sp *SequencePreprocessor) GenerateExecutionSequence(musicFile string, outp
 	return nil
 }
 
-// parseTimeline 解析时间轴为音符事件
+// applyTempoMap 根据时间轴元数据设置速度图
+// 速度图按 BPM / 起始速度 整体缩放：BPM 与起始速度相同（未覆盖）时按谱面速度演奏，-bpm 覆盖时保持速度关系
+func (sp *SequencePreprocessor) applyTempoMap(meta map[string]any) error {
+	tempoMap, err := ParseTempoMap(meta)
+	if err != nil {
+		return err
+	}
+	if tempoMap == nil {
+		sp.tempoMap = NewConstantTempoMap(sp.bpm)
+		return nil
+	}
+
+	sp.tempoMap = tempoMap.Scaled(sp.bpm / tempoMap.InitialBPM())
+	if !sp.tempoMap.IsConstant() {
+		fmt.Printf("   速度图: %d个速度点（起始 %.1f BPM）\n", len(sp.tempoMap.points), sp.bpm)
+	}
+	return nil
+}
+
+// parseNoteOptions 解析音符的第三个元素（选项对象），如 {"fermata": 1.5}、{"trill": "D5", "slur": true}
+// 装饰音的写法见 ornaments.go
+func parseNoteOptions(event *NoteEvent, raw any) error {
+	options, ok := raw.(map[string]any)
+	if !ok {
+		return fmt.Errorf("选项应为对象")
+	}
+	utils := NewUtils()
+	for key, value := range options {
+		switch key {
+		case "fermata":
+			factor, ok := utils.ConvertToFloat(value)
+			if !ok || factor <= 0 {
+				return fmt.Errorf("fermata 应为正数倍数")
+			}
+			event.Fermata = factor
+		case "breath":
+			breath, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("breath 应为 true 或 false")
+			}
+			event.Breath = breath
+		case "slur":
+			slur, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("slur 应为 true 或 false")
+			}
+			event.Slur = slur
+		case "trill", "grace", "mordent", "turn":
+			if err := parseOrnamentOption(event, key, value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("未知的选项 %q", key)
+		}
+	}
+	return nil
+}
+
+// parseTimeline 解析时间轴为音符事件（同时按拍号计算每个音符的小节与拍位置）
 func (sp *SequencePreprocessor) parseTimeline(timeline TimelineFile) ([]NoteEvent, error) {
 	var events []NoteEvent
 	utils := NewUtils()
 
-	for i, item := range timeline.Timeline {
+	timeSignature, err := ParseTimeSignature(timeline.Meta)
+	if err != nil {
+		return nil, err
+	}
+	sp.timeSignature = timeSignature
+
+	items, err := timeline.PartTimeline(sp.part)
+	if err != nil {
+		return nil, err
+	}
+
+	beatPosition := 0.0
+	for i, item := range items {
+		bar, beat := timeSignature.Position(beatPosition)
+		location := noteLocation(i+1, bar, beat)
+
 		if len(item) < 2 {
-			return nil, fmt.Errorf("第%d个音符数据不完整", i+1)
+			return nil, fmt.Errorf("%s数据不完整", location)
 		}
 
 		note, ok := item[0].(string)
 		if !ok {
-			return nil, fmt.Errorf("第%d个音符名称无效", i+1)
+			return nil, fmt.Errorf("%s名称无效", location)
 		}
 
 		duration, ok := utils.ConvertToFloat(item[1])
 		if !ok || duration <= 0 {
-			return nil, fmt.Errorf("第%d个音符持续时间无效", i+1)
+			return nil, fmt.Errorf("%s持续时间无效", location)
 		}
 
-		events = append(events, NoteEvent{
+		event := NoteEvent{
 			Note:     note,
 			Duration: duration,
 			Index:    i + 1,
-		})
+			Bar:      bar,
+			Beat:     beat,
+		}
+		if len(item) >= 3 && item[2] != nil {
+			if err := parseNoteOptions(&event, item[2]); err != nil {
+				return nil, fmt.Errorf("%s%v", location, err)
+			}
+		}
+
+		// 装饰音展开为若干短音符，各自标注小节位置
+		for _, expanded := range expandOrnament(event) {
+			expanded.Bar, expanded.Beat = timeSignature.Position(beatPosition)
+			events = append(events, expanded)
+			beatPosition += expanded.Duration
+		}
 	}
 	return events, nil
 }
 
+// noteLocation 音符位置描述（用于错误信息），如 "第12个音符（第3小节第2拍）"
+func noteLocation(index, bar int, beat float64) string {
+	if bar <= 0 {
+		return fmt.Sprintf("第%d个音符", index)
+	}
+	return fmt.Sprintf("第%d个音符（%s）", index, FormatBarBeat(bar, beat))
+}
+
+// stampBarBeat 为音符生成的执行事件标注小节与拍位置
+func stampBarBeat(events []ExecutionEvent, event NoteEvent) {
+	for i := range events {
+		events[i].Bar = event.Bar
+		events[i].BeatInBar = event.Beat
+	}
+}
+
 // generateSequence 生成执行序列
 func (sp *SequencePreprocessor) generateSequence(events []NoteEvent, sourceFile string) (*ExecutionSequence, error) {
 	sequence := &ExecutionSequence{
@@ -106,8 +324,20 @@ func (sp *SequencePreprocessor) generateSequence(events []NoteEvent, sourceFile
 			Instrument:    sp.instrument,
 			BPM:           sp.bpm,
 			TonguingDelay: sp.tonguingDelay,
+			FingerLeadMS:  sp.fingerLeadMS,
+			SwitchDipMS:   sp.switchDipMS,
+
+			RestPreSwitchMS:      sp.timing.RestPreSwitchMS,
+			RestPreSwitchRatio:   *sp.timing.RestPreSwitchRatio,
+			SignificantRestBeats: sp.timing.SignificantRestBeats,
+			SignificantRestMS:    sp.timing.SignificantRestMS,
+
+			TimeSignature: sp.timeSignature.String(),
+
 			GeneratedAt:   time.Now(),
-			Version:       "1.0",
+			Version:       ExecSchemaVersion,
+			ConfigHash:    ComputeConfigHash(sp.cfg, sp.instrument),
+			FingeringHash: ComputeFingeringHash(sp.fingeringMap),
 		},
 		Events: []ExecutionEvent{},
 	}
@@ -116,15 +346,26 @@ func (sp *SequencePreprocessor) generateSequence(events []NoteEvent, sourceFile
 	rightCompensation := 0.0 // 从上一个音符继承的右侧补偿
 	isFirstNote := true      // 标记是否为第一个音符（需要开启气泵）
 
+	durations := sp.noteDurationsMS(events)
+
+	// 换气规划：按音符下标索引换气点
+	breaths := sp.planBreaths(events, durations)
+	breathAt := map[int]BreathPoint{}
+	for _, point := range breaths {
+		breathAt[point.noteIndex] = point
+	}
+	beatPosition := 0.0 // 当前拍位置（用于标注结束位置）
 	for i, event := range events {
-		baseDurationMS := sp.secondsPerBeat * event.Duration * 1000.0
+		baseDurationMS := durations[i]
+		beatPosition += event.Duration
+		firstEvent := len(sequence.Events)
 
 		// 根据音符类型生成不同的执行事件
 		if event.Note == "NO" {
 			// 空拍处理
 			execEvents, err := sp.generateRestEvents(currentTimeMS, baseDurationMS, i, events)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%s: %v", noteLocation(event.Index, event.Bar, event.Beat), err)
 			}
 			sequence.Events = append(sequence.Events, execEvents...)
 			currentTimeMS += baseDurationMS
@@ -136,13 +377,20 @@ func (sp *SequencePreprocessor) generateSequence(events []NoteEvent, sourceFile
 			prevIndex := i - 1
 			nextIndex := i + 1
 
+			// 连音（slur）连接到下一个音符时不吐音；换气后重新起音，也不算吐音
+			breath, breathAfter := breathAt[i]
+			_, breathBefore := breathAt[prevIndex]
+			if breathAfter {
+				baseDurationMS -= breath.GapMS
+			}
+
 			prevIsSame := false
-			if prevIndex >= 0 && events[prevIndex].Note == event.Note && events[prevIndex].Note != "NO" {
+			if prevIndex >= 0 && events[prevIndex].Note == event.Note && events[prevIndex].Note != "NO" && !events[prevIndex].Slur && !breathBefore {
 				prevIsSame = true
 			}
 
 			nextIsSame := false
-			if nextIndex < len(events) && events[nextIndex].Note == event.Note && events[nextIndex].Note != "NO" {
+			if nextIndex < len(events) && events[nextIndex].Note == event.Note && events[nextIndex].Note != "NO" && !event.Slur && !breathAfter {
 				nextIsSame = true
 			}
 
@@ -175,7 +423,7 @@ func (sp *SequencePreprocessor) generateSequence(events []NoteEvent, sourceFile
 				// 与上一个音符相同（吐音续接）
 				execEvents, err := sp.generateTonguingContinuation(currentTimeMS, playDurationMS, event, nextIsSame)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("%s: %v", noteLocation(event.Index, event.Bar, event.Beat), err)
 				}
 				sequence.Events = append(sequence.Events, execEvents...)
 				// 只有当下一个还是相同音符时，才加上吐音延迟
@@ -191,7 +439,7 @@ func (sp *SequencePreprocessor) generateSequence(events []NoteEvent, sourceFile
 					// 下一个相同，生成吐音开始
 					execEvents, err := sp.generateTonguingStart(currentTimeMS, playDurationMS, event, nextIsSame, isFirstNote)
 					if err != nil {
-						return nil, err
+						return nil, fmt.Errorf("%s: %v", noteLocation(event.Index, event.Bar, event.Beat), err)
 					}
 					sequence.Events = append(sequence.Events, execEvents...)
 					currentTimeMS += playDurationMS + float64(sp.tonguingDelay)
@@ -200,22 +448,48 @@ func (sp *SequencePreprocessor) generateSequence(events []NoteEvent, sourceFile
 					// 普通音符（不同音符切换）
 					execEvent, err := sp.generateNormalEvent(currentTimeMS, playDurationMS, event, isFirstNote)
 					if err != nil {
-						return nil, err
+						return nil, fmt.Errorf("%s: %v", noteLocation(event.Index, event.Bar, event.Beat), err)
 					}
 					sequence.Events = append(sequence.Events, execEvent)
 					currentTimeMS += playDurationMS
 					isFirstNote = false // 已开启气泵
 				}
 			}
+
+			// 换气：关闭气泵，下一个音符重新开启
+			if breathAfter {
+				sequence.Events = append(sequence.Events, sp.generateBreathEvent(currentTimeMS, breath.GapMS, events[nextIndex]))
+				currentTimeMS += breath.GapMS
+				rightCompensation = 0.0
+				isFirstNote = true
+			}
 		}
+		stampBarBeat(sequence.Events[firstEvent:], event)
 	}
 
-	// 演奏结束：关闭气泵和松开手指
-	sequence.Events = append(sequence.Events, sp.generateEndEvent(currentTimeMS))
+	// 换指提前：把相邻不同音符之间的CAN帧前移
+	sequence.Events = sp.applyFingerLead(sequence.Events)
+
+	// 颤音：长音上按PWM起伏
+	sequence.Events = sp.applyVibrato(sequence.Events)
+
+	// 演奏结束：关闭气泵和松开手指（标注在乐曲结束位置）
+	endEvent := sp.generateEndEvent(currentTimeMS)
+	endEvent.Bar, endEvent.BeatInBar = sp.timeSignature.Position(beatPosition)
+	sequence.Events = append(sequence.Events, endEvent)
 
-	// 更新元数据
+	// 更新元数据（匀速时不记录速度图）
+	if !sp.tempoMap.IsConstant() {
+		sequence.Meta.TempoMap = sp.tempoMap.Points()
+	}
+	if sp.expression.Enabled() {
+		expression := sp.expression
+		sequence.Meta.Expression = &expression
+	}
+	sequence.Meta.Breaths = breaths
 	sequence.Meta.TotalDurationMS = currentTimeMS
 	sequence.Meta.TotalEvents = len(sequence.Events)
+	sequence.Meta.TotalBars = int(math.Ceil(beatPosition/sp.timeSignature.BeatsPerBar() - 1e-9))
 
 	return sequence, nil
 }
@@ -313,29 +587,44 @@ func (sp *SequencePreprocessor) generateTonguingContinuation(timestampMS, playDu
 }
 
 // generateRestEvents 生成空拍事件
+// 空拍开始时关闭气泵并释放手指，在空拍结束前按配置（固定毫秒或比例）预切换下一个音符的指法；
+// 同时输出 rest_start/rest_end 标记，执行引擎据此精确统计空拍时长
 func (sp *SequencePreprocessor) generateRestEvents(timestampMS, durationMS float64, currentIndex int, allEvents []NoteEvent) ([]ExecutionEvent, error) {
 	events := []ExecutionEvent{}
 
-	// 事件1: 关闭气泵 + 释放手指
+	// 计算预切换提前量（固定毫秒优先，不超过空拍时长）
+	preSwitchMS := durationMS * *sp.timing.RestPreSwitchRatio
+	if sp.timing.RestPreSwitchMS > 0 {
+		preSwitchMS = math.Min(float64(sp.timing.RestPreSwitchMS), durationMS)
+	}
+
+	// 下一个事件不是音符（空拍或结束）时无需预切换，整个空拍保持释放状态
+	nextIndex := currentIndex + 1
+	hasNextNote := nextIndex < len(allEvents) && allEvents[nextIndex].Note != "NO"
+	if !hasNextNote {
+		preSwitchMS = 0
+	}
+
+	// 事件1: 关闭气泵 + 释放手指（空拍开始标记）
 	releaseFrames := sp.buildReleaseFrames()
 
 	events = append(events, ExecutionEvent{
 		TimestampMS: timestampMS,
-		DurationMS:  durationMS * 0.8, // 80%时间
+		DurationMS:  durationMS - preSwitchMS,
 		Note:        "REST",
 		Frames:      releaseFrames,
 		SerialCmd:   "off",
+		Marker:      MarkerRestStart,
+		Beats:       allEvents[currentIndex].Duration,
 	})
 
-	// 检查是否需要预切换下一个音符的指法
-	nextIndex := currentIndex + 1
-	if nextIndex < len(allEvents) && allEvents[nextIndex].Note != "NO" {
-		// 事件2: 在空拍结束前20%时预切换指法
+	// 事件2: 在空拍结束前预切换下一个音符的指法
+	if hasNextNote && preSwitchMS > 0 {
 		nextFingeringFrames, err := sp.buildFingeringFrames(allEvents[nextIndex].Note)
 		if err == nil {
 			events = append(events, ExecutionEvent{
-				TimestampMS: timestampMS + durationMS*0.8,
-				DurationMS:  durationMS * 0.2, // 剩余20%时间
+				TimestampMS: timestampMS + durationMS - preSwitchMS,
+				DurationMS:  preSwitchMS,
 				Note:        fmt.Sprintf("PRE_%s", allEvents[nextIndex].Note),
 				Frames:      nextFingeringFrames,
 				SerialCmd:   "",
@@ -343,9 +632,94 @@ func (sp *SequencePreprocessor) generateRestEvents(timestampMS, durationMS float
 		}
 	}
 
+	// 事件3: 空拍结束标记（不发送任何指令）
+	events = append(events, ExecutionEvent{
+		TimestampMS: timestampMS + durationMS,
+		DurationMS:  0,
+		Note:        "REST_END",
+		Marker:      MarkerRestEnd,
+	})
+
 	return events, nil
 }
 
+// applyFingerLead 为气泵持续开启时的换指添加提前量
+// 相邻不同音符之间CAN帧与气流几乎同时到达，手指仍在运动时气流已经进入，会产生杂音。
+// 这里把换指帧提前 fingerLeadMS 发送，占用上一个音符的尾部；
+// 若配置了 switchDipMS，则在换指时刻前短暂关闭气泵，并在音符起点重新开启。
+// 空拍后的首音已由 generateRestEvents 预切换，这里只处理气泵已开启的换指（有CAN帧且无串口命令）。
+func (sp *SequencePreprocessor) applyFingerLead(events []ExecutionEvent) []ExecutionEvent {
+	if sp.fingerLeadMS <= 0 && sp.switchDipMS <= 0 {
+		return events
+	}
+
+	result := make([]ExecutionEvent, 0, len(events))
+	for _, event := range events {
+		if len(result) == 0 || len(event.Frames) == 0 || event.SerialCmd != "" || !isSoundingEvent(result[len(result)-1]) {
+			result = append(result, event)
+			continue
+		}
+
+		// 最多占用上一个音符时长的一半，保证上一个音符仍能完整发声
+		prev := &result[len(result)-1]
+		maxSteal := prev.DurationMS / 2
+		leadMS := math.Min(float64(sp.fingerLeadMS), maxSteal)
+		dipMS := math.Min(float64(sp.switchDipMS), maxSteal)
+		prev.DurationMS -= math.Max(leadMS, dipMS)
+
+		var leadEvent, dipEvent *ExecutionEvent
+		if leadMS > 0 {
+			leadEvent = &ExecutionEvent{
+				TimestampMS: event.TimestampMS - leadMS,
+				DurationMS:  leadMS,
+				Note:        fmt.Sprintf("LEAD_%s", event.Note),
+				Frames:      event.Frames,
+				Bar:         event.Bar,
+				BeatInBar:   event.BeatInBar,
+			}
+			event.Frames = nil // 指法帧已前移
+		}
+		if dipMS > 0 {
+			dipEvent = &ExecutionEvent{
+				TimestampMS: event.TimestampMS - dipMS,
+				DurationMS:  dipMS,
+				Note:        "DIP",
+				SerialCmd:   "off",
+				Bar:         event.Bar,
+				BeatInBar:   event.BeatInBar,
+			}
+			event.SerialCmd = "on" // 音符起点重新开启气泵
+		}
+
+		// 按时间先后插入（降压时长可能大于提前量）
+		switch {
+		case leadEvent != nil && dipEvent != nil && dipEvent.TimestampMS < leadEvent.TimestampMS:
+			result = append(result, *dipEvent, *leadEvent)
+		case leadEvent != nil && dipEvent != nil:
+			result = append(result, *leadEvent, *dipEvent)
+		case leadEvent != nil:
+			result = append(result, *leadEvent)
+		case dipEvent != nil:
+			result = append(result, *dipEvent)
+		}
+		result = append(result, event)
+	}
+
+	return result
+}
+
+// isSoundingEvent 判断事件是否为正在发声的音符（气泵开启且非辅助事件）
+func isSoundingEvent(event ExecutionEvent) bool {
+	if event.SerialCmd == "off" {
+		return false
+	}
+	switch event.Note {
+	case "REST", "REST_END", "TONGUE", "END", "DIP", "VIB", "SEEK", "BREATH":
+		return false
+	}
+	return !strings.HasPrefix(event.Note, "PRE_") && !strings.HasPrefix(event.Note, "LEAD_")
+}
+
 // generateEndEvent 生成演奏结束事件
 func (sp *SequencePreprocessor) generateEndEvent(timestampMS float64) ExecutionEvent {
 	releaseFrames := sp.buildReleaseFrames()
@@ -441,14 +815,5 @@ func (sp *SequencePreprocessor) buildReleaseFrames() []ExecCANFrame {
 
 // saveSequence 保存执行序列到文件
 func (sp *SequencePreprocessor) saveSequence(sequence *ExecutionSequence, outputFile string) error {
-	data, err := json.MarshalIndent(sequence, "", "  ")
-	if err != nil {
-		return fmt.Errorf("序列化失败: %v", err)
-	}
-
-	if err := os.WriteFile(outputFile, data, 0644); err != nil {
-		return fmt.Errorf("写入文件失败: %v", err)
-	}
-
-	return nil
+	return saveExecutionSequence(sequence, outputFile)
 }
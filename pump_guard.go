@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 气泵保护 - 连续开启时长、占空比、状态不一致与看门狗
+////////////////////////////////////////////////////////////////////////////////
+//
+// 演奏进程在 GlobalPumpOn 与 GlobalPumpOff 之间崩溃或卡住时，气泵会一直开着。
+// 保护器跟踪所有经过 GlobalPumpSend/GlobalPumpSendSync 的 on/off 命令，后台定时检查：
+//   - 连续开启超过 max_on_ms：强制关闭
+//   - 最近 duty_window_ms 内开启时间占比超过 max_duty_ratio：强制关闭，
+//     并拒绝新的 on 命令，直到占比降到限值的80%以下（散热）。默认不检查：连贯的乐曲两分钟内
+//     开启占比常在90%以上，只有气泵手册给出额定占空比时才应配置
+//   - 没有在演奏但气泵开着超过 mismatch_grace_ms（手动调试留出宽限）：强制关闭
+//   - 演奏中气泵开着，但超过 watchdog_ms 没有按计划收到下一个事件：强制关闭
+// 每次干预都会打印日志，并记录在 /api/playback/status 的 pump_guard 字段中。
+// 默认限值不会被正常乐曲触发（仓库自带乐曲在60 BPM下最长的连续乐句约76秒）；
+// 预处理时按同样的规则检查生成的执行序列，演奏时会触发保护的乐曲会提前给出提示。
+
+const (
+	defaultPumpMaxOnMS        = 180000 // 默认最长连续开启时间（毫秒，远大于正常乐句，只防止气泵卡在开启状态）
+	defaultPumpDutyWindowMS   = 120000 // 默认占比统计窗口（毫秒）
+	defaultPumpWatchdogMS     = 2000   // 默认看门狗超时（毫秒）
+	defaultPumpMismatchMS     = 3000   // 默认状态不一致宽限（毫秒）
+	pumpDutyResumeRatio       = 0.8    // 占比降到限值的该比例以下才允许重新开启
+	pumpGuardCheckInterval    = 100 * time.Millisecond
+	pumpGuardMaxInterventions = 20 // 状态中保留的最近干预记录条数
+)
+
+// 干预原因
+const (
+	PumpGuardMaxOn    = "max_on"   // 连续开启超时
+	PumpGuardDuty     = "duty"     // 占比超限
+	PumpGuardMismatch = "mismatch" // 未在演奏但气泵开着
+	PumpGuardWatchdog = "watchdog" // 演奏事件超时未到
+	PumpGuardBlocked  = "blocked"  // 散热期间拒绝开启
+)
+
+// PumpGuardConfig 气泵保护配置（配置文件 pump 段，0表示使用默认值，负数表示关闭该项检查；
+// max_duty_ratio 例外：0表示不检查占比，需要时按气泵的额定占空比设置）
+type PumpGuardConfig struct {
+	MaxOnMS         int     `yaml:"max_on_ms" json:"max_on_ms"`                 // 最长连续开启时间（毫秒）
+	DutyWindowMS    int     `yaml:"duty_window_ms" json:"duty_window_ms"`       // 占比统计窗口（毫秒）
+	MaxDutyRatio    float64 `yaml:"max_duty_ratio" json:"max_duty_ratio"`       // 窗口内最大开启占比（0~1）
+	WatchdogMS      int     `yaml:"watchdog_ms" json:"watchdog_ms"`             // 演奏事件超时（毫秒）
+	MismatchGraceMS int     `yaml:"mismatch_grace_ms" json:"mismatch_grace_ms"` // 未演奏时允许气泵开启的时长（毫秒）
+}
+
+// withDefaults 补全默认值
+func (gc PumpGuardConfig) withDefaults() PumpGuardConfig {
+	if gc.MaxOnMS == 0 {
+		gc.MaxOnMS = defaultPumpMaxOnMS
+	}
+	if gc.DutyWindowMS == 0 {
+		gc.DutyWindowMS = defaultPumpDutyWindowMS
+	}
+	if gc.WatchdogMS == 0 {
+		gc.WatchdogMS = defaultPumpWatchdogMS
+	}
+	if gc.MismatchGraceMS == 0 {
+		gc.MismatchGraceMS = defaultPumpMismatchMS
+	}
+	return gc
+}
+
+// PumpIntervention 一次保护干预
+type PumpIntervention struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"` // max_on/duty/mismatch/watchdog/blocked
+	Detail string    `json:"detail"`
+}
+
+// PumpGuardStatus 保护器状态（用于 /api/playback/status）
+type PumpGuardStatus struct {
+	Limits            PumpGuardConfig    `json:"limits"`
+	PumpOn            bool               `json:"pump_on"`            // 保护器记录的气泵状态
+	OnForMS           float64            `json:"on_for_ms"`          // 本次连续开启时长（毫秒）
+	DutyRatio         float64            `json:"duty_ratio"`         // 窗口内开启占比
+	Cooling           bool               `json:"cooling"`            // 是否处于散热期（拒绝开启）
+	Playing           bool               `json:"playing"`            // 是否在演奏
+	InterventionCount int                `json:"intervention_count"` // 累计干预次数
+	Interventions     []PumpIntervention `json:"interventions"`      // 最近的干预记录
+}
+
+// pumpOnInterval 一段开启区间
+type pumpOnInterval struct {
+	start, end time.Time
+}
+
+// PumpGuard 气泵保护器
+type PumpGuard struct {
+	mutex    sync.Mutex
+	cfg      PumpGuardConfig
+	pumpOn   bool
+	onSince  time.Time
+	history  []pumpOnInterval // 窗口内已结束的开启区间
+	cooling  bool
+	playing  bool
+	idleFrom time.Time // 演奏结束（或保护器启动）时刻，状态不一致宽限从此计算
+	deadline time.Time // 看门狗截止时刻（下一个事件的计划时刻 + watchdog_ms）
+
+	interventions []PumpIntervention
+	count         int
+	controller    *PumpController // 强制关闭时写入的气泵控制器
+	stopChan      chan struct{}
+}
+
+// 全局气泵保护器（气泵控制器初始化成功后启动；演奏、急停与Web请求并发读取，使用原子指针）
+var globalPumpGuard atomic.Pointer[PumpGuard]
+
+// NewPumpGuard 创建气泵保护器
+func NewPumpGuard(cfg PumpGuardConfig, controller *PumpController) *PumpGuard {
+	return &PumpGuard{
+		cfg:        cfg.withDefaults(),
+		idleFrom:   time.Now(),
+		controller: controller,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// StartGlobalPumpGuard 启动全局气泵保护器（保护当前的全局气泵控制器）
+func StartGlobalPumpGuard(cfg PumpGuardConfig) {
+	StopGlobalPumpGuard()
+	guard := NewPumpGuard(cfg, globalPumpController)
+	globalPumpGuard.Store(guard)
+	go guard.run()
+	c := guard.cfg
+	fmt.Printf("🛡️  气泵保护已启动: 连续开启≤%s, %s, 看门狗%s, 非演奏宽限%s\n",
+		formatGuardMS(c.MaxOnMS), formatGuardDuty(c), formatGuardMS(c.WatchdogMS), formatGuardMS(c.MismatchGraceMS))
+}
+
+// formatGuardDuty 格式化占比限值
+func formatGuardDuty(c PumpGuardConfig) string {
+	if c.DutyWindowMS <= 0 || c.MaxDutyRatio <= 0 {
+		return "不检查占比"
+	}
+	return fmt.Sprintf("%s内占比≤%.0f%%", formatGuardMS(c.DutyWindowMS), c.MaxDutyRatio*100)
+}
+
+// CheckBreath 检查换气设置与连续开启上限是否一致：换气规划允许的连续吹奏时间达到上限时，
+// 每个最长的乐句都会被保护器强制关闭（返回提示，没有问题时返回空字符串）
+func (gc PumpGuardConfig) CheckBreath(breath BreathConfig) string {
+	gc = gc.withDefaults()
+	if gc.MaxOnMS <= 0 || breath.MaxBlowMS <= 0 || breath.MaxBlowMS < float64(gc.MaxOnMS) {
+		return ""
+	}
+	return fmt.Sprintf("breath.max_blow_ms（%.1fs）不小于 pump.max_on_ms（%s），换气前的长乐句会被气泵保护强制关闭",
+		breath.MaxBlowMS/1000.0, formatGuardMS(gc.MaxOnMS))
+}
+
+// CheckSequence 按保护器的规则检查执行序列中的 on/off 命令，返回演奏时会触发保护的位置（用于预处理时提示）
+// 只检查连续开启时长与占比；状态不一致与看门狗取决于运行时，不在此检查
+func (gc PumpGuardConfig) CheckSequence(sequence *ExecutionSequence) []string {
+	gc = gc.withDefaults()
+	type onInterval struct {
+		start, end float64
+		bar        int
+	}
+	var intervals []onInterval
+	onAt, onBar, pumpOn := 0.0, 0, false
+	for _, event := range sequence.Events {
+		switch strings.TrimSpace(event.SerialCmd) {
+		case "on":
+			if !pumpOn {
+				onAt, onBar, pumpOn = event.TimestampMS, event.Bar, true
+			}
+		case "off":
+			if pumpOn {
+				intervals = append(intervals, onInterval{onAt, event.TimestampMS, onBar})
+				pumpOn = false
+			}
+		}
+	}
+	if pumpOn {
+		intervals = append(intervals, onInterval{onAt, sequence.Meta.TotalDurationMS, onBar})
+	}
+
+	var warnings []string
+	position := func(interval onInterval) string {
+		if interval.bar > 0 {
+			return fmt.Sprintf("第%d小节", interval.bar)
+		}
+		return fmt.Sprintf("%.1fs", interval.start/1000.0)
+	}
+	if gc.MaxOnMS > 0 {
+		for _, interval := range intervals {
+			if onFor := interval.end - interval.start; onFor > float64(gc.MaxOnMS) {
+				warnings = append(warnings, fmt.Sprintf("%s起连续开启%.1fs，超过 max_on_ms（%s），演奏时会被强制关闭",
+					position(interval), onFor/1000.0, formatGuardMS(gc.MaxOnMS)))
+			}
+		}
+	}
+	if gc.DutyWindowMS > 0 && gc.MaxDutyRatio > 0 {
+		// 窗口内开启时长在某段开启结束时达到最大
+		window := float64(gc.DutyWindowMS)
+		for i, interval := range intervals {
+			from, on := interval.end-window, 0.0
+			for _, earlier := range intervals[:i+1] {
+				if earlier.end > from {
+					on += earlier.end - max(earlier.start, from)
+				}
+			}
+			if duty := on / window; duty > gc.MaxDutyRatio {
+				warnings = append(warnings, fmt.Sprintf("%s处%s内开启占比%.0f%%，超过 max_duty_ratio（%.0f%%），演奏时会被强制关闭并散热",
+					position(interval), formatGuardMS(gc.DutyWindowMS), duty*100, gc.MaxDutyRatio*100))
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// StopGlobalPumpGuard 停止全局气泵保护器
+func StopGlobalPumpGuard() {
+	if guard := globalPumpGuard.Swap(nil); guard != nil {
+		close(guard.stopChan)
+	}
+}
+
+// formatGuardMS 格式化限值（负数表示关闭）
+func formatGuardMS(ms int) string {
+	if ms < 0 {
+		return "关闭"
+	}
+	return fmt.Sprintf("%.1fs", float64(ms)/1000.0)
+}
+
+// allowCommand 气泵命令发送前调用：记录 on/off 状态，散热期间拒绝 on
+func (pg *PumpGuard) allowCommand(cmd string) bool {
+	cmd = strings.TrimSpace(cmd)
+	if cmd != "on" && cmd != "off" {
+		return true
+	}
+
+	pg.mutex.Lock()
+	defer pg.mutex.Unlock()
+	now := time.Now()
+	if cmd == "off" {
+		pg.setOff(now)
+		return true
+	}
+	if pg.cooling {
+		pg.intervene(now, PumpGuardBlocked, fmt.Sprintf("散热期间拒绝开启（占比%.0f%%）", pg.dutyRatio(now)*100))
+		return false
+	}
+	if !pg.pumpOn {
+		pg.pumpOn = true
+		pg.onSince = now
+	}
+	return true
+}
+
+// setOff 记录关闭（调用方持有锁）
+func (pg *PumpGuard) setOff(now time.Time) {
+	if pg.pumpOn {
+		pg.history = append(pg.history, pumpOnInterval{start: pg.onSince, end: now})
+		pg.pumpOn = false
+	}
+}
+
+// dutyRatio 窗口内开启占比（调用方持有锁）
+func (pg *PumpGuard) dutyRatio(now time.Time) float64 {
+	window := time.Duration(pg.cfg.DutyWindowMS) * time.Millisecond
+	if window <= 0 {
+		return 0
+	}
+	from := now.Add(-window)
+	kept := pg.history[:0]
+	var on time.Duration
+	for _, interval := range pg.history {
+		if interval.end.Before(from) {
+			continue
+		}
+		kept = append(kept, interval)
+		on += interval.end.Sub(maxTime(interval.start, from))
+	}
+	pg.history = kept
+	if pg.pumpOn {
+		on += now.Sub(maxTime(pg.onSince, from))
+	}
+	return float64(on) / float64(window)
+}
+
+// maxTime 较晚的时刻
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// PlaybackStarted 演奏开始（执行引擎调用；保护器未启动时为空操作）
+func (pg *PumpGuard) PlaybackStarted() {
+	if pg == nil {
+		return
+	}
+	pg.mutex.Lock()
+	pg.playing = true
+	pg.deadline = time.Time{}
+	pg.mutex.Unlock()
+}
+
+// PlaybackStopped 演奏结束（执行引擎调用）
+func (pg *PumpGuard) PlaybackStopped() {
+	if pg == nil {
+		return
+	}
+	pg.mutex.Lock()
+	pg.playing = false
+	pg.idleFrom = time.Now()
+	pg.deadline = time.Time{}
+	pg.mutex.Unlock()
+}
+
+// Feed 喂看门狗：执行引擎每处理一个事件前告知其计划时刻
+func (pg *PumpGuard) Feed(scheduled time.Time) {
+	if pg == nil {
+		return
+	}
+	pg.mutex.Lock()
+	pg.deadline = scheduled.Add(time.Duration(pg.cfg.WatchdogMS) * time.Millisecond)
+	pg.mutex.Unlock()
+}
+
+// run 后台定时检查
+func (pg *PumpGuard) run() {
+	ticker := time.NewTicker(pumpGuardCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pg.stopChan:
+			return
+		case <-ticker.C:
+			pg.check()
+		}
+	}
+}
+
+// check 执行一次检查，需要时强制关闭气泵
+func (pg *PumpGuard) check() {
+	pg.mutex.Lock()
+	now := time.Now()
+	duty := pg.dutyRatio(now)
+	if pg.cooling && duty < pg.cfg.MaxDutyRatio*pumpDutyResumeRatio {
+		pg.cooling = false
+		fmt.Printf("🛡️  气泵散热结束（占比%.0f%%），允许重新开启\n", duty*100)
+	}
+	if !pg.pumpOn {
+		pg.mutex.Unlock()
+		return
+	}
+
+	reason, detail := "", ""
+	onFor := now.Sub(pg.onSince)
+	switch {
+	case pg.cfg.MaxOnMS > 0 && onFor > time.Duration(pg.cfg.MaxOnMS)*time.Millisecond:
+		reason = PumpGuardMaxOn
+		detail = fmt.Sprintf("连续开启%.1fs，超过上限%s", onFor.Seconds(), formatGuardMS(pg.cfg.MaxOnMS))
+	case pg.cfg.DutyWindowMS > 0 && pg.cfg.MaxDutyRatio > 0 && duty > pg.cfg.MaxDutyRatio:
+		reason = PumpGuardDuty
+		detail = fmt.Sprintf("%s内开启占比%.0f%%，超过上限%.0f%%，进入散热期",
+			formatGuardMS(pg.cfg.DutyWindowMS), duty*100, pg.cfg.MaxDutyRatio*100)
+		pg.cooling = true
+	case !pg.playing && pg.cfg.MismatchGraceMS >= 0 &&
+		now.Sub(maxTime(pg.onSince, pg.idleFrom)) > time.Duration(pg.cfg.MismatchGraceMS)*time.Millisecond:
+		reason = PumpGuardMismatch
+		detail = fmt.Sprintf("未在演奏但气泵已开启%.1fs", now.Sub(maxTime(pg.onSince, pg.idleFrom)).Seconds())
+	case pg.playing && pg.cfg.WatchdogMS > 0 && !pg.deadline.IsZero() && now.After(pg.deadline):
+		reason = PumpGuardWatchdog
+		detail = fmt.Sprintf("演奏事件已超时%.1fs未到", now.Sub(pg.deadline).Seconds()+float64(pg.cfg.WatchdogMS)/1000.0)
+	}
+	if reason == "" {
+		pg.mutex.Unlock()
+		return
+	}
+	pg.setOff(now)
+	pg.intervene(now, reason, detail)
+	pg.mutex.Unlock()
+
+	// 经控制器的加锁写入发送，不经过 allowCommand（状态已在上面更新）
+	if pg.controller != nil && pg.controller.port != nil {
+		sentAt := time.Now()
+		pg.controller.write("off\n")
+		globalCapture.RecordSerial(sentAt, "off", "pump_guard:"+reason)
+	}
+}
+
+// intervene 记录一次干预并打印日志（调用方持有锁）
+func (pg *PumpGuard) intervene(now time.Time, reason, detail string) {
+	pg.count++
+	pg.interventions = append(pg.interventions, PumpIntervention{Time: now, Reason: reason, Detail: detail})
+	if len(pg.interventions) > pumpGuardMaxInterventions {
+		pg.interventions = pg.interventions[len(pg.interventions)-pumpGuardMaxInterventions:]
+	}
+	if reason == PumpGuardBlocked {
+		fmt.Printf("🛡️  气泵保护: %s\n", detail)
+	} else {
+		fmt.Printf("🛑 气泵保护强制关闭[%s]: %s\n", reason, detail)
+	}
+}
+
+// Status 当前状态
+func (pg *PumpGuard) Status() *PumpGuardStatus {
+	pg.mutex.Lock()
+	defer pg.mutex.Unlock()
+	now := time.Now()
+	status := &PumpGuardStatus{
+		Limits:            pg.cfg,
+		PumpOn:            pg.pumpOn,
+		DutyRatio:         pg.dutyRatio(now),
+		Cooling:           pg.cooling,
+		Playing:           pg.playing,
+		InterventionCount: pg.count,
+		Interventions:     append([]PumpIntervention{}, pg.interventions...),
+	}
+	if pg.pumpOn {
+		status.OnForMS = float64(now.Sub(pg.onSince).Milliseconds())
+	}
+	return status
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"sync"
+	"context"
 	"time"
 )
 
@@ -38,35 +38,20 @@ func (rgc *ReadyGestureController) ExecuteReadyGesture(cfg Config, instrument st
 	leftFrame := rgc.fingeringBuilder.BuildReleaseFrame(leftReleaseProfile)
 	rightFrame := rgc.fingeringBuilder.BuildReleaseFrame(rightReleaseProfile)
 
-	// 并发发送预备手势
-	var wg sync.WaitGroup
-	errChan := make(chan error, 2)
-
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		utils := NewUtils()
-		leftID := utils.ParseCanID(cfg.Hands.Left.ID)
-		errChan <- utils.SendCanFrame(cfg, cfg.Hands.Left.Interface, leftID, leftFrame)
-	}()
-
-	go func() {
-		defer wg.Done()
-		utils := NewUtils()
-		rightID := utils.ParseCanID(cfg.Hands.Right.ID)
-		errChan <- utils.SendCanFrame(cfg, cfg.Hands.Right.Interface, rightID, rightFrame)
-	}()
-
-	wg.Wait()
-	close(errChan)
+	// 左右手同时发送预备手势（桥接服务支持批量发送时在一个请求中到达）
+	utils := NewUtils()
+	return utils.SendCanFrames(cfg,
+		CanMessage{Interface: cfg.Hands.Left.Interface, Id: utils.ParseCanID(cfg.Hands.Left.ID), Data: leftFrame},
+		CanMessage{Interface: cfg.Hands.Right.Interface, Id: utils.ParseCanID(cfg.Hands.Right.ID), Data: rightFrame},
+	)
+}
 
-	for err := range errChan {
-		if err != nil {
-			return err
-		}
+// ExecuteEndGesture 末音之后的收尾：配置了 after 姿态序列时按步骤下发，否则执行预备手势（全释放）
+func (rgc *ReadyGestureController) ExecuteEndGesture(cfg Config, instrument string) error {
+	if HasPosture(cfg, instrument, PostureAfter) {
+		return RunPosture(context.Background(), cfg, instrument, PostureAfter)
 	}
-
-	return nil
+	return rgc.ExecuteReadyGesture(cfg, instrument)
 }
 
 // ExecuteReadyGestureWithDelay 执行预备手势并等待指定时间
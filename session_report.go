@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 演奏报告 - 每个演奏会话结束后保存一份报告，便于回看和对比
+////////////////////////////////////////////////////////////////////////////////
+//
+// 存储（目录由配置 sessions.dir 指定，默认 sessions/）：
+//   index.jsonl   每个会话一行摘要（追加写入，列表接口只读这个文件）
+//   <会话ID>.json 完整报告：执行文件与哈希、配置快照、逐事件延迟、CAN发送失败、气泵命令、结束原因
+
+const (
+	defaultSessionsDir     = "sessions"
+	sessionIndexFile       = "index.jsonl"
+	maxReportCanFailures   = 200 // 报告中保留的CAN发送失败明细条数
+	maxReportPumpCommands  = 2000
+	sessionCompareTopCount = 10 // 对比时列出延迟变化最大的事件数
+)
+
+// 会话结束原因
+const (
+	StopReasonCompleted     = "completed"
+	StopReasonUserStopped   = "user_stopped"
+	StopReasonReplaced      = "replaced"
+	StopReasonEmergencyStop = "emergency_stop"
+	StopReasonError         = "error"
+)
+
+// sessionIDPattern 会话ID格式（防止路径穿越）
+var sessionIDPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9]{3}$`)
+
+// EventTiming 单个事件的实际发送时刻相对计划时刻的延迟
+type EventTiming struct {
+	Index       int     `json:"i"`              // 事件序号（从0开始）
+	Pass        int     `json:"pass,omitempty"` // 循环播放时的遍数（从1开始，单遍时省略）
+	Note        string  `json:"n"`
+	Bar         int     `json:"bar,omitempty"`
+	ScheduledMS float64 `json:"t"`       // 计划时刻（相对开始，毫秒）
+	LateMS      float64 `json:"late_ms"` // 延迟（毫秒）
+}
+
+// CanFailure 一次CAN发送失败
+type CanFailure struct {
+	AtMS      float64 `json:"at_ms"` // 相对开始时刻（毫秒）
+	Interface string  `json:"interface"`
+	ID        uint32  `json:"id"`
+	Error     string  `json:"error"`
+}
+
+// PumpCommandRecord 一条气泵命令
+type PumpCommandRecord struct {
+	AtMS   float64 `json:"at_ms"`
+	Cmd    string  `json:"cmd"`
+	Result string  `json:"result"`
+}
+
+// LatenessStats 延迟统计（毫秒）
+type LatenessStats struct {
+	MeanMS float64 `json:"mean_ms"`
+	P95MS  float64 `json:"p95_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+// SessionSummary 会话摘要（index.jsonl 中的一行）
+type SessionSummary struct {
+	ID                  string        `json:"id"`
+	StartedAt           time.Time     `json:"started_at"`
+	EndedAt             time.Time     `json:"ended_at"`
+	ExecFile            string        `json:"exec_file"`
+	SourceFile          string        `json:"source_file"`
+	Instrument          string        `json:"instrument"`
+	StopReason          string        `json:"stop_reason"`
+	TheoreticalDuration float64       `json:"theoretical_duration"` // 理论时长（秒）
+	ActualDuration      float64       `json:"actual_duration"`      // 实际时长（秒）
+	EventsPlayed        int           `json:"events_played"`
+	Lateness            LatenessStats `json:"lateness"`
+	CanFailures         int           `json:"can_failures"`
+}
+
+// SessionReport 完整的演奏报告
+type SessionReport struct {
+	SessionSummary
+	Error            string               `json:"error,omitempty"`
+	Meta             SequenceMeta         `json:"meta"` // 执行序列元数据（含各项哈希）
+	FromBar          int                  `json:"from_bar,omitempty"`
+	ToBar            int                  `json:"to_bar,omitempty"`
+	Loop             int                  `json:"loop,omitempty"`
+	Config           Config               `json:"config"`                 // 演奏时的配置快照
+	CaptureFile      string               `json:"capture_file,omitempty"` // 硬件I/O录制文件（启用录制时）
+	SignificantRests []RestTimingResponse `json:"significant_rests"`
+	Events           []EventTiming        `json:"events"`
+	CanFailureList   []CanFailure         `json:"can_failure_list,omitempty"`
+	PumpCommands     []PumpCommandRecord  `json:"pump_commands"`
+	PWMCommands      int                  `json:"pwm_commands"` // 颤音PWM命令数（不逐条记录）
+}
+
+// SessionRecorder 演奏过程中收集报告数据（演奏循环与异步发送goroutine并发写入）
+type SessionRecorder struct {
+	mutex        sync.Mutex
+	start        time.Time
+	events       []EventTiming
+	canFailures  []CanFailure
+	canFailCount int
+	pumpCommands []PumpCommandRecord
+	pwmCommands  int
+}
+
+// NewSessionRecorder 创建报告收集器
+func NewSessionRecorder() *SessionRecorder {
+	return &SessionRecorder{}
+}
+
+// Begin 记录演奏开始时刻（延迟和失败时刻均相对此时刻）
+func (sr *SessionRecorder) Begin(start time.Time) {
+	if sr == nil {
+		return
+	}
+	sr.mutex.Lock()
+	sr.start = start
+	sr.mutex.Unlock()
+}
+
+// Event 记录一个事件的延迟
+func (sr *SessionRecorder) Event(index, pass int, event ExecutionEvent, scheduledMS float64, late time.Duration) {
+	if sr == nil {
+		return
+	}
+	sr.mutex.Lock()
+	sr.events = append(sr.events, EventTiming{
+		Index:       index,
+		Pass:        pass,
+		Note:        event.Note,
+		Bar:         event.Bar,
+		ScheduledMS: scheduledMS,
+		LateMS:      math.Round(float64(late.Microseconds())) / 1000.0,
+	})
+	sr.mutex.Unlock()
+}
+
+// CanFailure 记录一次CAN发送失败
+func (sr *SessionRecorder) CanFailure(iface string, id uint32, err error) {
+	if sr == nil {
+		return
+	}
+	sr.mutex.Lock()
+	sr.canFailCount++
+	if len(sr.canFailures) < maxReportCanFailures {
+		sr.canFailures = append(sr.canFailures, CanFailure{
+			AtMS:      sr.sinceStartMS(),
+			Interface: iface,
+			ID:        id,
+			Error:     err.Error(),
+		})
+	}
+	sr.mutex.Unlock()
+}
+
+// PumpCommand 记录一条气泵命令（颤音PWM命令只计数）
+func (sr *SessionRecorder) PumpCommand(cmd, result string) {
+	if sr == nil {
+		return
+	}
+	sr.mutex.Lock()
+	if _, ok := parsePumpSetCommand(cmd); ok {
+		sr.pwmCommands++
+	} else if len(sr.pumpCommands) < maxReportPumpCommands {
+		sr.pumpCommands = append(sr.pumpCommands, PumpCommandRecord{AtMS: sr.sinceStartMS(), Cmd: cmd, Result: result})
+	}
+	sr.mutex.Unlock()
+}
+
+// sinceStartMS 距开始时刻的毫秒数（调用方持有锁）
+func (sr *SessionRecorder) sinceStartMS() float64 {
+	if sr.start.IsZero() {
+		return 0
+	}
+	return float64(time.Since(sr.start).Microseconds()) / 1000.0
+}
+
+// stopReason 由演奏结果得出结束原因
+func stopReason(err error) string {
+	switch {
+	case err == nil:
+		return StopReasonCompleted
+	case errors.Is(err, ErrUserStopped):
+		return StopReasonUserStopped
+	case errors.Is(err, ErrPlaybackReplaced):
+		return StopReasonReplaced
+	case errors.Is(err, ErrEmergencyStop):
+		return StopReasonEmergencyStop
+	default:
+		return StopReasonError
+	}
+}
+
+// buildSessionReport 汇总演奏会话的报告
+func (ee *ExecutionEngine) buildSessionReport(session *PlaybackSession, significantRests []RestTimingResponse) *SessionReport {
+	sr := ee.recorder
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	report := &SessionReport{
+		SessionSummary: SessionSummary{
+			ID:                  session.ID,
+			StartedAt:           session.StartedAt,
+			EndedAt:             time.Now(),
+			ExecFile:            ee.execFile,
+			SourceFile:          ee.sequence.Meta.SourceFile,
+			Instrument:          ee.sequence.Meta.Instrument,
+			StopReason:          stopReason(session.err),
+			TheoreticalDuration: ee.theoreticalDurationSec(),
+			EventsPlayed:        len(sr.events),
+			Lateness:            latenessStats(sr.events),
+			CanFailures:         sr.canFailCount,
+		},
+		Meta:             ee.sequence.Meta,
+		FromBar:          ee.fromBar,
+		ToBar:            ee.toBar,
+		Loop:             ee.loop,
+		Config:           ee.cfg,
+		SignificantRests: significantRests,
+		Events:           sr.events,
+		CanFailureList:   sr.canFailures,
+		PumpCommands:     sr.pumpCommands,
+		PWMCommands:      sr.pwmCommands,
+	}
+	// 中途停止时没有 actualEnd，以报告结束时刻计算
+	if !ee.actualStart.IsZero() {
+		end := ee.actualEnd
+		if end.IsZero() {
+			end = report.EndedAt
+		}
+		report.ActualDuration = end.Sub(ee.actualStart).Seconds()
+	}
+	if session.err != nil && report.StopReason == StopReasonError {
+		report.Error = session.err.Error()
+	}
+	if report.Events == nil {
+		report.Events = []EventTiming{}
+	}
+	if report.PumpCommands == nil {
+		report.PumpCommands = []PumpCommandRecord{}
+	}
+	return report
+}
+
+// latenessStats 计算延迟统计
+func latenessStats(events []EventTiming) LatenessStats {
+	if len(events) == 0 {
+		return LatenessStats{}
+	}
+	late := make([]float64, len(events))
+	sum := 0.0
+	for i, e := range events {
+		late[i] = e.LateMS
+		sum += e.LateMS
+	}
+	sort.Float64s(late)
+	p95 := late[int(math.Ceil(0.95*float64(len(late))))-1]
+	return LatenessStats{
+		MeanMS: roundMS(sum / float64(len(late))),
+		P95MS:  roundMS(p95),
+		MaxMS:  roundMS(late[len(late)-1]),
+	}
+}
+
+// roundMS 毫秒值保留3位小数（微秒精度）
+func roundMS(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// 报告存储
+////////////////////////////////////////////////////////////////////////////////
+
+// SessionStore 演奏报告存储
+type SessionStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// 全局演奏报告存储（启动时按配置 sessions.dir 重新创建）
+var globalSessionStore = NewSessionStore("")
+
+// NewSessionStore 创建演奏报告存储（dir 为空时使用默认目录）
+func NewSessionStore(dir string) *SessionStore {
+	if dir == "" {
+		dir = defaultSessionsDir
+	}
+	return &SessionStore{dir: dir}
+}
+
+// Save 保存完整报告并在索引中追加摘要
+func (ss *SessionStore) Save(report *SessionReport) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if err := os.MkdirAll(ss.dir, 0755); err != nil {
+		return fmt.Errorf("创建报告目录失败: %v", err)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化报告失败: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ss.dir, report.ID+".json"), data, 0644); err != nil {
+		return fmt.Errorf("写入报告失败: %v", err)
+	}
+
+	line, err := json.Marshal(report.SessionSummary)
+	if err != nil {
+		return fmt.Errorf("序列化摘要失败: %v", err)
+	}
+	index, err := os.OpenFile(filepath.Join(ss.dir, sessionIndexFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("打开报告索引失败: %v", err)
+	}
+	defer index.Close()
+	if _, err := index.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("写入报告索引失败: %v", err)
+	}
+	return nil
+}
+
+// List 列出会话摘要（最新的在前，limit<=0 表示全部）
+func (ss *SessionStore) List(limit int) ([]SessionSummary, error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	summaries := []SessionSummary{}
+	file, err := os.Open(filepath.Join(ss.dir, sessionIndexFile))
+	if os.IsNotExist(err) {
+		return summaries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("打开报告索引失败: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var summary SessionSummary
+		if err := json.Unmarshal(scanner.Bytes(), &summary); err != nil {
+			continue // 跳过写入中断的残行
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取报告索引失败: %v", err)
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].StartedAt.After(summaries[j].StartedAt) })
+	if limit > 0 && len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	return summaries, nil
+}
+
+// Load 读取完整报告
+func (ss *SessionStore) Load(id string) (*SessionReport, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("无效的会话ID: %s", id)
+	}
+	data, err := os.ReadFile(filepath.Join(ss.dir, id+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取报告失败: %v", err)
+	}
+	var report SessionReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("解析报告失败: %v", err)
+	}
+	return &report, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// 报告对比
+////////////////////////////////////////////////////////////////////////////////
+
+// EventLatenessDiff 同一事件在两次演奏中的延迟变化
+type EventLatenessDiff struct {
+	Index   int     `json:"i"`
+	Pass    int     `json:"pass,omitempty"`
+	Note    string  `json:"n"`
+	Bar     int     `json:"bar,omitempty"`
+	LateA   float64 `json:"late_a_ms"`
+	LateB   float64 `json:"late_b_ms"`
+	DeltaMS float64 `json:"delta_ms"`
+}
+
+// SessionComparison 两次演奏的对比
+type SessionComparison struct {
+	A                   SessionSummary      `json:"a"`
+	B                   SessionSummary      `json:"b"`
+	SameInput           bool                `json:"same_input"`     // 执行序列输入哈希是否相同
+	ChangedHashes       []string            `json:"changed_hashes"` // 不同的哈希（config/fingering/timeline/params）
+	ActualDurationDelta float64             `json:"actual_duration_delta"`
+	MeanLateDeltaMS     float64             `json:"mean_late_delta_ms"`
+	P95LateDeltaMS      float64             `json:"p95_late_delta_ms"`
+	MaxLateDeltaMS      float64             `json:"max_late_delta_ms"`
+	CanFailuresDelta    int                 `json:"can_failures_delta"`
+	LargestChanges      []EventLatenessDiff `json:"largest_changes"` // 延迟变化最大的事件（事件序列相同时）
+}
+
+// CompareSessions 对比两次演奏（B 相对 A 的变化）
+func CompareSessions(a, b *SessionReport) SessionComparison {
+	cmp := SessionComparison{
+		A:                   a.SessionSummary,
+		B:                   b.SessionSummary,
+		SameInput:           a.Meta.InputHash != "" && a.Meta.InputHash == b.Meta.InputHash,
+		ChangedHashes:       []string{},
+		ActualDurationDelta: b.ActualDuration - a.ActualDuration,
+		MeanLateDeltaMS:     roundMS(b.Lateness.MeanMS - a.Lateness.MeanMS),
+		P95LateDeltaMS:      roundMS(b.Lateness.P95MS - a.Lateness.P95MS),
+		MaxLateDeltaMS:      roundMS(b.Lateness.MaxMS - a.Lateness.MaxMS),
+		CanFailuresDelta:    b.CanFailures - a.CanFailures,
+		LargestChanges:      []EventLatenessDiff{},
+	}
+	hashes := []struct {
+		name string
+		a, b string
+	}{
+		{"config", a.Meta.ConfigHash, b.Meta.ConfigHash},
+		{"fingering", a.Meta.FingeringHash, b.Meta.FingeringHash},
+		{"timeline", a.Meta.TimelineHash, b.Meta.TimelineHash},
+		{"params", a.Meta.ParamsHash, b.Meta.ParamsHash},
+	}
+	for _, h := range hashes {
+		if h.a != h.b {
+			cmp.ChangedHashes = append(cmp.ChangedHashes, h.name)
+		}
+	}
+
+	// 按（遍数, 序号）对齐两次演奏都播放到的事件
+	type key struct{ pass, index int }
+	lateA := make(map[key]float64, len(a.Events))
+	for _, e := range a.Events {
+		lateA[key{e.Pass, e.Index}] = e.LateMS
+	}
+	var diffs []EventLatenessDiff
+	for _, e := range b.Events {
+		la, ok := lateA[key{e.Pass, e.Index}]
+		if !ok {
+			continue
+		}
+		diffs = append(diffs, EventLatenessDiff{
+			Index: e.Index, Pass: e.Pass, Note: e.Note, Bar: e.Bar,
+			LateA: la, LateB: e.LateMS, DeltaMS: roundMS(e.LateMS - la),
+		})
+	}
+	if cmp.SameInput {
+		sort.Slice(diffs, func(i, j int) bool { return math.Abs(diffs[i].DeltaMS) > math.Abs(diffs[j].DeltaMS) })
+		if len(diffs) > sessionCompareTopCount {
+			diffs = diffs[:sessionCompareTopCount]
+		}
+		cmp.LargestChanges = append(cmp.LargestChanges, diffs...)
+	}
+	return cmp
+}
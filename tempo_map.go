@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 速度图 - 曲中变速、渐慢/渐快
+////////////////////////////////////////////////////////////////////////////////
+//
+// 时间轴元数据中的 tempo_map 为按拍位置排列的速度点：
+//
+//	"tempo_map": [
+//	    {"beat": 0,  "bpm": 100},
+//	    {"beat": 64, "bpm": 120},               // 第64拍起突变为120
+//	    {"beat": 96, "bpm": 80, "ramp": true}   // 第64拍到第96拍从120线性渐慢到80
+//	]
+//
+// ramp 为 true 表示从上一个速度点线性过渡到本点，否则在本点突变。最后一个速度点之后保持该速度。
+// 延长记号（fermata）写在单个音符的选项中：["C5", 2, {"fermata": 1.5}] 表示该音符时值乘以1.5。
+
+// TempoPoint 速度点
+type TempoPoint struct {
+	Beat float64 `json:"beat"`           // 拍位置（从0开始）
+	BPM  float64 `json:"bpm"`            // 速度
+	Ramp bool    `json:"ramp,omitempty"` // 是否从上一个速度点线性过渡到本点
+}
+
+// TempoMap 速度图
+type TempoMap struct {
+	points []TempoPoint
+}
+
+// NewConstantTempoMap 创建匀速速度图
+func NewConstantTempoMap(bpm float64) *TempoMap {
+	return &TempoMap{points: []TempoPoint{{Beat: 0, BPM: bpm}}}
+}
+
+// ParseTempoMap 解析时间轴元数据中的 tempo_map（没有时返回nil）
+func ParseTempoMap(meta map[string]any) (*TempoMap, error) {
+	raw, ok := meta["tempo_map"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+
+	// 元数据为通用map，借助JSON转换为结构体
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("tempo_map 格式错误: %v", err)
+	}
+	var points []TempoPoint
+	if err := json.Unmarshal(data, &points); err != nil {
+		return nil, fmt.Errorf("tempo_map 格式错误: %v", err)
+	}
+	if len(points) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Beat < points[j].Beat })
+	for i, point := range points {
+		if point.BPM <= 0 || math.IsNaN(point.BPM) {
+			return nil, fmt.Errorf("tempo_map 第%d个速度点BPM无效: %v", i+1, point.BPM)
+		}
+		if point.Beat < 0 {
+			return nil, fmt.Errorf("tempo_map 第%d个速度点拍位置为负: %v", i+1, point.Beat)
+		}
+		if i > 0 && point.Beat == points[i-1].Beat && point.Ramp {
+			return nil, fmt.Errorf("tempo_map 第%d个速度点的渐变区间长度为0", i+1)
+		}
+	}
+
+	// 第一个速度点不在0拍时，之前的部分使用第一个速度点的速度
+	if points[0].Beat > 0 {
+		points = append([]TempoPoint{{Beat: 0, BPM: points[0].BPM}}, points...)
+	}
+	points[0].Ramp = false
+
+	return &TempoMap{points: points}, nil
+}
+
+// InitialBPM 起始速度
+func (tm *TempoMap) InitialBPM() float64 {
+	return tm.points[0].BPM
+}
+
+// Points 速度点列表（副本）
+func (tm *TempoMap) Points() []TempoPoint {
+	return append([]TempoPoint(nil), tm.points...)
+}
+
+// IsConstant 是否为匀速
+func (tm *TempoMap) IsConstant() bool {
+	for _, point := range tm.points[1:] {
+		if point.BPM != tm.points[0].BPM {
+			return false
+		}
+	}
+	return true
+}
+
+// Scaled 按比例缩放所有速度点（-bpm 覆盖时保持整体速度关系不变）
+func (tm *TempoMap) Scaled(factor float64) *TempoMap {
+	points := tm.Points()
+	for i := range points {
+		points[i].BPM *= factor
+	}
+	return &TempoMap{points: points}
+}
+
+// BPMAt 指定拍位置的速度
+func (tm *TempoMap) BPMAt(beat float64) float64 {
+	i := tm.segmentIndex(beat)
+	if i+1 < len(tm.points) && tm.points[i+1].Ramp {
+		start, end := tm.points[i], tm.points[i+1]
+		return start.BPM + (end.BPM-start.BPM)*(beat-start.Beat)/(end.Beat-start.Beat)
+	}
+	return tm.points[i].BPM
+}
+
+// segmentIndex 拍位置所在区间的起始速度点下标
+func (tm *TempoMap) segmentIndex(beat float64) int {
+	i := sort.Search(len(tm.points), func(i int) bool { return tm.points[i].Beat > beat }) - 1
+	return max(i, 0)
+}
+
+// DurationMS 从 startBeat 开始、长度为 beats 拍的时长（毫秒）
+// 对 60000/bpm(拍) 分段积分；线性渐变区间 bpm(b)=b0+k·(b-s)，积分为 60000/k·ln(bpm末/bpm初)
+func (tm *TempoMap) DurationMS(startBeat, beats float64) float64 {
+	total := 0.0
+	beat := startBeat
+	end := startBeat + beats
+
+	for beat < end {
+		i := tm.segmentIndex(beat)
+		segmentEnd := end
+		ramp := false
+		if i+1 < len(tm.points) {
+			segmentEnd = math.Min(end, tm.points[i+1].Beat)
+			ramp = tm.points[i+1].Ramp
+		}
+
+		bpmStart := tm.BPMAt(beat)
+		if ramp {
+			bpmEnd := tm.BPMAt(segmentEnd)
+			if bpmEnd != bpmStart {
+				k := (bpmEnd - bpmStart) / (segmentEnd - beat)
+				total += 60000.0 / k * math.Log(bpmEnd/bpmStart)
+			} else {
+				total += 60000.0 / bpmStart * (segmentEnd - beat)
+			}
+		} else {
+			total += 60000.0 / bpmStart * (segmentEnd - beat)
+		}
+		beat = segmentEnd
+	}
+
+	return total
+}
+
+// readTimelineInitialBPM 读取时间轴速度图的起始速度（没有速度图时返回false）
+func readTimelineInitialBPM(path string) (float64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	var timeline TimelineFile
+	if err := json.Unmarshal(data, &timeline); err != nil {
+		return 0, false
+	}
+	tempoMap, err := ParseTempoMap(timeline.Meta)
+	if err != nil || tempoMap == nil {
+		return 0, false
+	}
+	return tempoMap.InitialBPM(), true
+}
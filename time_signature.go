@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// 拍号与小节位置
+////////////////////////////////////////////////////////////////////////////////
+//
+// 时间轴元数据 "time_signature": "3/4"（缺省4/4）。时间轴时值以四分音符为1拍，
+// 每小节拍数 = 分子 × 4 / 分母（如 6/8 为3拍）。小节与拍均从1开始计数。
+
+// TimeSignature 拍号
+type TimeSignature struct {
+	Numerator   int // 分子（每小节几个单位拍）
+	Denominator int // 分母（以几分音符为一拍）
+}
+
+// DefaultTimeSignature 缺省拍号 4/4
+var DefaultTimeSignature = TimeSignature{Numerator: 4, Denominator: 4}
+
+// ParseTimeSignature 解析时间轴元数据中的 time_signature（缺省4/4）
+func ParseTimeSignature(meta map[string]any) (TimeSignature, error) {
+	raw, ok := meta["time_signature"]
+	if !ok || raw == nil {
+		return DefaultTimeSignature, nil
+	}
+	text, ok := raw.(string)
+	if !ok {
+		return TimeSignature{}, fmt.Errorf("time_signature 应为字符串，如 \"3/4\"")
+	}
+
+	parts := strings.Split(strings.TrimSpace(text), "/")
+	if len(parts) != 2 {
+		return TimeSignature{}, fmt.Errorf("time_signature %q 格式应为 分子/分母", text)
+	}
+	numerator, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	denominator, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || numerator <= 0 || denominator <= 0 || denominator&(denominator-1) != 0 {
+		return TimeSignature{}, fmt.Errorf("time_signature %q 无效", text)
+	}
+	return TimeSignature{Numerator: numerator, Denominator: denominator}, nil
+}
+
+// String 拍号文本（如 "3/4"）
+func (ts TimeSignature) String() string {
+	return fmt.Sprintf("%d/%d", ts.Numerator, ts.Denominator)
+}
+
+// BeatsPerBar 每小节的四分音符拍数
+func (ts TimeSignature) BeatsPerBar() float64 {
+	return float64(ts.Numerator) * 4.0 / float64(ts.Denominator)
+}
+
+// Position 拍位置（从0开始的四分音符拍数）对应的小节与小节内拍位置（均从1开始）
+func (ts TimeSignature) Position(beatPosition float64) (int, float64) {
+	perBar := ts.BeatsPerBar()
+	// 容忍浮点累加误差，避免 3.9999999 被算成上一小节
+	bar := math.Floor(beatPosition/perBar + 1e-9)
+	beat := beatPosition - bar*perBar
+	if beat < 0 {
+		beat = 0
+	}
+	return int(bar) + 1, beat + 1
+}
+
+// FormatBarBeat 格式化小节位置（如 "第12小节第3拍"）
+func FormatBarBeat(bar int, beat float64) string {
+	if bar <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("第%d小节第%s拍", bar, strconv.FormatFloat(math.Round(beat*100)/100, 'f', -1, 64))
+}
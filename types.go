@@ -25,7 +25,8 @@ type Config struct {
 
 	// 气泵控制配置（仅串口）
 	Pump struct {
-		PortName string `yaml:"port_name"` // 串口名称（如：/dev/ttyUSB0）
+		PortName string          `yaml:"port_name"` // 串口名称（如：/dev/ttyUSB0）
+		Guard    PumpGuardConfig `yaml:",inline"`   // 气泵保护限值
 	} `yaml:"pump"`
 
 	// 萨克斯手指力度配置：[拇指, 拇指旋转, 食指, 中指, 无名指, 小指]
@@ -48,6 +49,85 @@ type Config struct {
 		Enabled bool `yaml:"enabled"` // 是否启用预备手势
 		HoldMS  int  `yaml:"hold_ms"` // 预备手势持续时间（毫秒）
 	} `yaml:"ready"`
+
+	// 乐器时序配置（按乐器类型区分，键为 sks/sn）
+	Timing map[string]InstrumentTiming `yaml:"timing"`
+
+	// 换气规划：长乐句中自动安排换气点
+	Breath BreathConfig `yaml:"breath"`
+
+	// 表情演奏设置（抖动、乐句尾延长、摇摆、颤音；全部为0表示机械演奏）
+	Expression ExpressionSettings `yaml:"expression"`
+
+	// 急停输入（GPIO/串口，均为可选；API与SIGUSR1始终可用）
+	EStop EStopConfig `yaml:"estop"`
+
+	// 演奏报告存储（每个会话一份报告，见 /api/sessions）
+	Sessions struct {
+		Dir string `yaml:"dir"` // 报告目录（默认 sessions）
+	} `yaml:"sessions"`
+
+	// 硬件I/O录制（CAN消息与气泵串口命令，可用 -replay 按原时序重放）
+	Capture CaptureConfig `yaml:"capture"`
+
+	// CAN桥接服务健康检查（演奏前预检）
+	CanHealth CanHealthConfig `yaml:"can_health"`
+
+	// 内置CAN桥接服务（-bridge 模式）
+	Bridge BridgeConfig `yaml:"bridge"`
+
+	// 黑臂（键为CAN接口）与手臂编排（抬臂 → 预姿态 → 演奏 → 释放 → 落臂）
+	Arms       map[string]ArmConfig `yaml:"arms"`
+	ArmRoutine ArmRoutineConfig     `yaml:"arm_routine"`
+	HandsLeft  []int                `yaml:"handsleft"`  // 左手防撞预姿态（抬臂后、演奏前下发）
+	HandsRight []int                `yaml:"handsright"` // 右手防撞预姿态
+
+	// 演奏前后姿态序列（按乐器区分，键为 sks/sn，见 posture.go）
+	Posture map[string]InstrumentPosture `yaml:"posture"`
+
+	// 多机合奏配置（协调者模式使用）
+	Ensemble EnsembleConfig `yaml:"ensemble"`
+
+	// 时钟同步配置：合奏时各机器人以领队的时间为准
+	Clock struct {
+		Leader     string `yaml:"leader"`      // 领队WebServer地址（留空表示本机即领队）
+		IntervalMS int    `yaml:"interval_ms"` // 测量间隔（毫秒，默认1000）
+	} `yaml:"clock"`
+}
+
+// 多机合奏配置
+type EnsembleConfig struct {
+	StartDelayMS int            `yaml:"start_delay_ms"` // 预加载完成后到统一开始的最小延迟（毫秒，默认2000）
+	Peers        []EnsemblePeer `yaml:"peers"`          // 参与合奏的机器人
+	// 多声部总谱的声部分配（声部名 → 机器人与乐器），协调者据此分发声部并由各机器人用自己的指法编译
+	Assignments map[string]PartAssignment `yaml:"assignments"`
+}
+
+// 声部分配：声部由哪台机器人以哪种乐器演奏
+type PartAssignment struct {
+	Host       string `yaml:"host" json:"host"`             // 机器人WebServer地址
+	Instrument string `yaml:"instrument" json:"instrument"` // 乐器类型（sks/sn）
+}
+
+// 合奏成员
+type EnsemblePeer struct {
+	Name     string `yaml:"name" json:"name"`                     // 名称（如 sks1）
+	Host     string `yaml:"host" json:"host"`                     // WebServer地址（如 192.168.1.21:1105）
+	ExecFile string `yaml:"exec_file" json:"exec_file,omitempty"` // 该成员的执行文件（exec目录下的文件名，留空使用协调者指定的文件）
+}
+
+// 乐器时序配置
+type InstrumentTiming struct {
+	FingerLeadMS int `yaml:"finger_lead_ms"` // 换指提前量（毫秒）：CAN帧早于音符起点发送，占用上一个音符的尾部
+	SwitchDipMS  int `yaml:"switch_dip_ms"`  // 换指时气泵短暂关闭的时长（毫秒，0表示不启用）
+
+	// 空拍预切换：空拍结束前提前切换到下一个音符的指法
+	RestPreSwitchMS    int      `yaml:"rest_pre_switch_ms"`    // 固定提前量（毫秒，>0时优先于比例）
+	RestPreSwitchRatio *float64 `yaml:"rest_pre_switch_ratio"` // 按空拍时长比例提前（未配置时0.2，即最后20%；0表示不启用）
+
+	// 显著空拍阈值：满足任一条件即视为显著空拍
+	SignificantRestBeats float64 `yaml:"significant_rest_beats"` // 拍数阈值（默认4拍）
+	SignificantRestMS    float64 `yaml:"significant_rest_ms"`    // 时长阈值（默认1000毫秒）
 }
 
 // 手部配置
@@ -58,8 +138,9 @@ type HandConfig struct {
 
 // 时间轴文件结构
 type TimelineFile struct {
-	Meta     map[string]any `json:"meta"`     // 元数据（包含BPM等信息）
-	Timeline [][]any        `json:"timeline"` // 时间轴：[[音符, 持续拍数], ...]
+	Meta     map[string]any     `json:"meta"`            // 元数据（包含BPM等信息，所有声部共用）
+	Timeline [][]any            `json:"timeline"`        // 时间轴：[[音符, 持续拍数], ...]
+	Parts    map[string][][]any `json:"parts,omitempty"` // 多声部总谱：声部名 → 时间轴（如 melody/harmony）
 }
 
 // 指法映射条目
@@ -92,6 +173,7 @@ type MusicFileInfo struct {
 // 演奏状态
 type PlaybackStatus struct {
 	IsPlaying           bool                 `json:"is_playing"`           // 是否正在演奏
+	SessionID           string               `json:"session_id"`           // 演奏会话ID
 	CurrentFile         string               `json:"current_file"`         // 当前文件
 	CurrentNote         int                  `json:"current_note"`         // 当前音符索引
 	TotalNotes          int                  `json:"total_notes"`          // 总音符数
@@ -101,6 +183,17 @@ type PlaybackStatus struct {
 	TheoreticalDuration float64              `json:"theoretical_duration"` // 理论时长（秒）
 	ActualDuration      float64              `json:"actual_duration"`      // 实际时长（秒）
 	SignificantRests    []RestTimingResponse `json:"significant_rests"`    // 显著空拍列表
+	ScheduledStartMS    int64                `json:"scheduled_start_ms"`   // 预定开始时刻（Unix毫秒，合奏时由协调者下发，0表示立即开始）
+	CurrentBar          int                  `json:"current_bar"`          // 当前小节（旧执行文件没有小节信息时为0）
+	CurrentBeat         float64              `json:"current_beat"`         // 当前小节内拍位置
+	FromBar             int                  `json:"from_bar,omitempty"`   // 按小节截取播放时的起始小节
+	ToBar               int                  `json:"to_bar,omitempty"`     // 按小节截取播放时的结束小节
+	Loop                int                  `json:"loop,omitempty"`       // 循环次数（-1表示直到停止）
+	Pass                int                  `json:"pass,omitempty"`       // 循环播放时的当前遍数（从1开始）
+	PumpGuard           *PumpGuardStatus     `json:"pump_guard,omitempty"` // 气泵保护状态（气泵控制器未初始化时省略）
+	EStop               *EStopStatus         `json:"estop,omitempty"`      // 急停状态
+	Can                 *CanStatsSnapshot    `json:"can,omitempty"`        // 本次演奏的CAN发送统计
+	ArmPhase            string               `json:"arm_phase,omitempty"`  // 手臂编排的当前阶段（见 arm_routine.go）
 }
 
 // RestTimingResponse 空拍时间响应（用于前端显示）
@@ -114,10 +207,9 @@ type RestTimingResponse struct {
 // 演奏控制器
 type PlaybackController struct {
 	mutex        sync.RWMutex
+	sessionMutex sync.Mutex // 串行化开始/停止/替换
+	session      *PlaybackSession
 	status       PlaybackStatus
-	stopChan     chan bool
-	doneChan     chan bool // 播放完成信号
-	isRunning    bool
 	config       Config
 	timeline     TimelineFile              //记录日志
 	fingeringMap map[string]FingeringEntry //记录指法映射，打印发送日志
@@ -134,6 +226,12 @@ type NoteEvent struct {
 	Note     string
 	Duration float64
 	Index    int
+	Fermata  float64   // 延长记号：时值倍数（0或1表示无延长）
+	Bar      int       // 所在小节（从1开始）
+	Beat     float64   // 小节内拍位置（从1开始）
+	Slur     bool      // 连音：与下一个音符之间不吐音
+	Breath   bool      // 手动换气标记：该音符之后换气
+	Ornament *Ornament // 装饰音（解析时间轴时展开，展开后为nil）
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -48,9 +47,84 @@ func InitGlobalHTTPClient() *http.Client {
 // Utils 工具函数集合
 type Utils struct{}
 
+// pumpReplyTimeout 同步命令等待串口应答的时间
+const pumpReplyTimeout = 500 * time.Millisecond
+
 // PumpController 气泵控制器
+// 串口读取没有超时，所以只有一个后台goroutine读取串口（见 readLoop），
+// 同步命令在 replies 上带超时等待应答，不会有阻塞在串口上、抢走后续应答的读取者
 type PumpController struct {
-	port serial.Port
+	port       serial.Port
+	writeMutex sync.Mutex  // 串行化命令写入（演奏、急停、气泵保护可能同时发送）
+	syncMutex  sync.Mutex  // 串行化同步命令（发送并等待应答），应答不会被另一个同步命令取走
+	replies    chan string // 后台读取goroutine收到的串口数据
+}
+
+// newPumpController 创建气泵控制器并启动串口读取goroutine（串口关闭时退出）
+func newPumpController(port serial.Port) *PumpController {
+	pc := &PumpController{port: port, replies: make(chan string, 16)}
+	go pc.readLoop()
+	return pc
+}
+
+// readLoop 唯一的串口读取者：收到的数据放入 replies，缓冲已满时丢弃（异步命令的应答没有人等待）
+func (pc *PumpController) readLoop() {
+	buf := make([]byte, 1024)
+	for {
+		n, err := pc.port.Read(buf)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		select {
+		case pc.replies <- string(buf[:n]):
+		default:
+		}
+	}
+}
+
+// write 写入一条命令（加锁，保证命令之间不会交错）
+func (pc *PumpController) write(cmd string) error {
+	pc.writeMutex.Lock()
+	defer pc.writeMutex.Unlock()
+	_, err := pc.port.Write([]byte(cmd))
+	return err
+}
+
+// request 写入一条命令并等待应答，超时未收到应答时返回空字符串
+// 发送前丢弃之前异步命令留下的应答，收到应答后一并取走紧随其后已到达的数据
+func (pc *PumpController) request(cmd string, timeout time.Duration) string {
+	pc.syncMutex.Lock()
+	defer pc.syncMutex.Unlock()
+
+	for drained := false; !drained; {
+		select {
+		case <-pc.replies:
+		default:
+			drained = true
+		}
+	}
+	if err := pc.write(cmd); err != nil {
+		return ""
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-pc.replies:
+		for {
+			select {
+			case more := <-pc.replies:
+				response += more
+			default:
+				return response
+			}
+		}
+	case <-timer.C:
+		return ""
+	}
 }
 
 // NewUtils 创建新的工具函数实例
@@ -87,7 +161,7 @@ func InitGlobalPumpController(portName string) error {
 	//time.Sleep(1 * time.Second)
 	port.ResetInputBuffer()
 
-	globalPumpController = &PumpController{port: port}
+	globalPumpController = newPumpController(port)
 
 	// 设置为手动模式并关闭气泵
 	GlobalPumpManual()
@@ -102,6 +176,7 @@ func CloseGlobalPumpController() {
 	if globalPumpController != nil && globalPumpController.port != nil {
 		// 确保气泵关闭
 		GlobalPumpOff()
+		StopGlobalPumpGuard()
 		globalPumpController.port.Close()
 		globalPumpController = nil
 		fmt.Println("✅ 气泵控制器已关闭")
@@ -120,32 +195,55 @@ func (u *Utils) ClosePumpController() {
 
 // GlobalPumpSend 发送气泵命令（异步版本，不等待响应，提高演奏速度）
 func GlobalPumpSend(cmd string) string {
-
+	if globalEStop.blocksPumpCommand(cmd) {
+		return "BLOCKED"
+	}
+	if guard := globalPumpGuard.Load(); guard != nil && !guard.allowCommand(cmd) {
+		return "BLOCKED"
+	}
 	if !strings.HasSuffix(cmd, "\n") {
 		cmd += "\n"
 	}
-	globalPumpController.port.Write([]byte(cmd))
+	sentAt := time.Now()
+	globalPumpController.write(cmd)
+	globalCapture.RecordSerial(sentAt, cmd, "OK")
 	//time.Sleep(10 * time.Millisecond)
 	// 演奏过程中不需要等待响应，立即返回以避免延迟累积
 	return "OK"
 }
 
+// GlobalPumpSendContext 发送气泵命令（演奏用）：ctx 取消后只允许关闭气泵，避免停止后迟到的 on/set
+func GlobalPumpSendContext(ctx context.Context, cmd string) string {
+	if ctx.Err() != nil && strings.TrimSpace(cmd) != "off" {
+		return "CANCELED"
+	}
+	return GlobalPumpSend(cmd)
+}
+
 // GlobalPumpSendSync 发送气泵命令（同步版本，等待响应，确保命令执行）
 func GlobalPumpSendSync(cmd string) string {
+	return GlobalPumpSendSyncTimeout(cmd, pumpReplyTimeout)
+}
+
+// GlobalPumpSendSyncTimeout 发送气泵命令并最多等待 timeout 接收应答（超时返回空字符串）
+func GlobalPumpSendSyncTimeout(cmd string, timeout time.Duration) string {
 	if globalPumpController == nil || globalPumpController.port == nil {
 		return "气泵控制器未初始化"
 	}
+	if globalEStop.blocksPumpCommand(cmd) {
+		return "急停已锁定，拒绝开启气泵"
+	}
+	if guard := globalPumpGuard.Load(); guard != nil && !guard.allowCommand(cmd) {
+		return "气泵保护: 散热期间拒绝开启"
+	}
 
 	if !strings.HasSuffix(cmd, "\n") {
 		cmd += "\n"
 	}
-	globalPumpController.port.Write([]byte(cmd))
-
-	// 等待足够时间让命令执行
-	//time.Sleep(1 * time.Millisecond)
-	buf := make([]byte, 1024)
-	n, _ := globalPumpController.port.Read(buf)
-	return string(buf[:n])
+	sentAt := time.Now()
+	response := globalPumpController.request(cmd, timeout)
+	globalCapture.RecordSerial(sentAt, cmd, response)
+	return response
 }
 
 // PumpSend 发送气泵命令（实例版本，已废弃）
@@ -272,70 +370,41 @@ func (u *Utils) SendCanFrame(cfg Config, iface string, id uint32, data []byte) e
 	return u.ForwardToCanService(cfg.CanBridgeURL, msg)
 }
 
-// SendCanFrameAsync 异步发送CAN数据帧（不等待响应，极速模式）
-// 适用于演奏过程中的高频指法切换
-func (u *Utils) SendCanFrameAsync(cfg Config, iface string, id uint32, data []byte) {
+// SendCanFrames 同时发送多个CAN数据帧（同步版本，如左右手的预备手势）
+// 桥接服务支持批量发送时在一个请求中到达
+func (u *Utils) SendCanFrames(cfg Config, msgs ...CanMessage) error {
 	if cfg.DryRun {
-		return
+		return nil
 	}
+	return globalCanSender.Send(cfg.CanBridgeURL, msgs...)
+}
 
-	msg := CanMessage{
-		Interface: iface,
-		Id:        id,
-		Data:      data,
+// SendCanFramesAsync 异步发送同一时刻的多个CAN数据帧（不等待响应，极速模式）
+// 适用于演奏过程中的高频指法切换；桥接服务支持批量发送时左右手的帧在一个请求中到达
+// ctx 取消后不再发出，在途请求被中断；onError 可为 nil，对每个失败的帧在发送goroutine中调用
+func (u *Utils) SendCanFramesAsync(ctx context.Context, cfg Config, msgs []CanMessage, onError func(CanMessage, error)) {
+	if cfg.DryRun || len(msgs) == 0 {
+		return
 	}
-
-	u.ForwardToCanServiceAsync(cfg.CanBridgeURL, msg)
+	globalCanSender.SendAsync(ctx, cfg.CanBridgeURL, msgs, onError)
 }
 
 // ForwardToCanService 转发消息到CAN桥接服务（同步版本，等待响应）
+// 经过该接口的有序发送队列，不会被之前入队的异步帧覆盖
 func (u *Utils) ForwardToCanService(canBridgeURL string, msg CanMessage) error {
-	jsonData, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("消息序列化失败: %v", err)
-	}
-
-	// 使用全局HTTP客户端（连接池复用）
-	client := InitGlobalHTTPClient()
-	resp, err := client.Post(canBridgeURL+"/api/can", "application/json", bytes.NewReader(jsonData))
-	if err != nil {
-		return fmt.Errorf("发送到CAN服务失败: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("CAN服务错误: %s", string(body))
-	}
-
-	return nil
+	return globalCanSender.Send(canBridgeURL, msg)
 }
 
 // ForwardToCanServiceAsync 异步转发消息到CAN桥接服务（不等待响应，极速模式）
-// 适用于演奏过程中的高频指法切换，显著降低延迟
-func (u *Utils) ForwardToCanServiceAsync(canBridgeURL string, msg CanMessage) {
-	go func() {
-		jsonData, err := json.Marshal(msg)
-		if err != nil {
-			// 异步模式下，错误不影响主流程，仅记录（可选）
-			return
-		}
-
-		// 使用全局HTTP客户端（连接池复用）
-		client := InitGlobalHTTPClient()
-		resp, err := client.Post(canBridgeURL+"/api/can", "application/json", bytes.NewReader(jsonData))
-		if err != nil {
-			// 异步模式下，错误不影响主流程
-			return
-		}
-		defer resp.Body.Close()
-
-		// 不检查响应状态，快速返回
-		if resp.StatusCode != http.StatusOK {
-			// 可选：记录错误，但不阻塞演奏
-			io.ReadAll(resp.Body) // 读取body以释放连接
-		}
-	}()
+// 按接口排队串行发送，同一设备待发的旧帧被新帧合并
+// ctx 取消（停止、替换、急停）后不再发出，在途请求被中断；急停锁定期间直接丢弃
+// onError 可为 nil；请求失败或CAN服务返回非200时调用，因 ctx 取消而中断的请求不算失败
+func (u *Utils) ForwardToCanServiceAsync(ctx context.Context, canBridgeURL string, msg CanMessage, onError func(error)) {
+	var onFrameError func(CanMessage, error)
+	if onError != nil {
+		onFrameError = func(_ CanMessage, err error) { onError(err) }
+	}
+	globalCanSender.SendAsync(ctx, canBridgeURL, []CanMessage{msg}, onFrameError)
 }
 
 // ControlAirPumpWithLock 控制气泵开关（同步版本，等待操作完成）
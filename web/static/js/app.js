@@ -12,7 +12,7 @@ let editingRestIndex = -1; // 正在编辑的空拍索引
 let searchInput, searchBtn, fileList, startBtn, stopBtn;
 let clearLogBtn, autoScrollBtn, logContent, loadFingeringsBtn, fingeringButtonsEl;
 let sksBtn, snBtn;
-let currentFileEl, progressEl, currentNoteEl, totalNotesEl;
+let currentFileEl, progressEl, currentNoteEl, totalNotesEl, currentBarEl;
 let elapsedTimeEl, playStatusEl, progressBarEl;
 
 // 初始化
@@ -34,6 +34,7 @@ document.addEventListener('DOMContentLoaded', function() {
     progressEl = document.getElementById('progress');
     currentNoteEl = document.getElementById('currentNote');
     totalNotesEl = document.getElementById('totalNotes');
+    currentBarEl = document.getElementById('currentBar');
     elapsedTimeEl = document.getElementById('elapsedTime');
     playStatusEl = document.getElementById('playStatus');
     progressBarEl = document.getElementById('progressBar');
@@ -71,6 +72,8 @@ function setupEventListeners() {
     // 控制按钮
     startBtn.addEventListener('click', startPlayback);
     stopBtn.addEventListener('click', stopPlayback);
+    document.getElementById('estopBtn').addEventListener('click', triggerEStop);
+    document.getElementById('estopClearBtn').addEventListener('click', clearEStop);
     
     // 日志控制
     clearLogBtn.addEventListener('click', clearLogs);
@@ -323,6 +326,42 @@ async function stopPlayback() {
     }
 }
 
+// 急停（不论是否在演奏都可触发，触发后锁定直到解除）
+async function triggerEStop() {
+    try {
+        const response = await fetch('/api/estop', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ reason: 'Web界面急停按钮' })
+        });
+        const data = await response.json();
+        showNotification('急停', data.estop && data.estop.pump_confirmed ? '急停已触发，气泵已确认关闭' : '急停已触发，气泵关闭未确认！', 'error');
+        updateStatus();
+    } catch (error) {
+        console.error('急停失败:', error);
+        showNotification('错误', '急停请求失败，请检查网络连接或使用硬件急停', 'error');
+    }
+}
+
+// 解除急停
+async function clearEStop() {
+    try {
+        const response = await fetch('/api/estop/clear', { method: 'POST' });
+        const data = await response.json();
+        if (data.error) {
+            showNotification('错误', data.error, 'error');
+            return;
+        }
+        showNotification('成功', '急停已解除', 'success');
+        updateStatus();
+    } catch (error) {
+        console.error('解除急停失败:', error);
+        showNotification('错误', '解除急停失败，请检查网络连接', 'error');
+    }
+}
+
 // 更新按钮状态
 function updateButtonStates() {
     startBtn.disabled = isPlaying;
@@ -335,6 +374,7 @@ function resetStatus() {
     progressEl.textContent = '0%';
     currentNoteEl.textContent = '-';
     totalNotesEl.textContent = '-';
+    currentBarEl.textContent = '-';
     elapsedTimeEl.textContent = '-';
     playStatusEl.textContent = '未开始';
     progressBarEl.style.width = '0%';
@@ -355,13 +395,20 @@ async function updateStatus() {
 		progressEl.textContent = `${Math.round(status.progress || 0)}%`;
 		currentNoteEl.textContent = status.current_note || '-';
 		totalNotesEl.textContent = status.total_notes || '-';
+		currentBarEl.textContent = status.current_bar
+			? `${status.current_bar}:${Math.round(status.current_beat * 100) / 100}` + (status.pass ? ` (第${status.pass}遍)` : '')
+			: '-';
 		elapsedTimeEl.textContent = status.elapsed_time || '-';
 		
-		if (status.is_playing) {
+		const estopLatched = status.estop && status.estop.latched;
+		if (estopLatched) {
+			playStatusEl.textContent = `急停锁定（${status.estop.reason}）`;
+		} else if (status.is_playing) {
 			playStatusEl.textContent = '播放中';
 		} else {
 			playStatusEl.textContent = '未开始';
 		}
+		document.getElementById('estopClearBtn').style.display = estopLatched ? '' : 'none';
 		
 		progressBarEl.style.width = `${status.progress || 0}%`;
 		
@@ -1014,6 +1061,10 @@ async function checkExecCache() {
         if (data.exists) {
             currentExecFile = data.exec_file;
             theoreticalDuration = data.duration_sec;
+            if (data.stale) {
+                updatePreprocessStatus(`⚠️ 缓存已过期（${data.stale_reasons.join('；')}），开始时将自动重新编译`, 'info');
+                return;
+            }
             updatePreprocessStatus(`✅ 找到缓存文件（时长: ${data.duration_sec.toFixed(2)}秒）`, 'success');
             updateSongDuration(data.duration_sec);
         } else {
@@ -1171,7 +1222,14 @@ async function playExecSequence() {
         const data = await response.json();
         
         if (response.ok) {
-            showNotification('成功', '开始播放执行序列', 'success');
+            if (data.recompiled) {
+                // 输入已变化，服务端已自动重新编译
+                showNotification('提示', `执行文件已重新编译: ${data.recompile_reasons.join('；')}`, 'info');
+                theoreticalDuration = data.duration_sec;
+                updateSongDuration(data.duration_sec);
+            } else {
+                showNotification('成功', '开始播放执行序列', 'success');
+            }
             return true;
         } else {
             showNotification('错误', `播放失败: ${data.error}`, 'error');
@@ -0,0 +1,105 @@
+// 执行序列查看与对比页面
+
+const fileA = document.getElementById('execFileA');
+const fileB = document.getElementById('execFileB');
+const summary = document.getElementById('inspectSummary');
+const result = document.getElementById('inspectResult');
+
+// 转义HTML
+function escapeHtml(text) {
+    const div = document.createElement('div');
+    div.textContent = text == null ? '' : String(text);
+    return div.innerHTML;
+}
+
+// 加载执行序列文件列表
+async function loadExecFiles() {
+    const response = await fetch('/api/exec/list');
+    const data = await response.json();
+    for (const name of data.files || []) {
+        fileA.add(new Option(name, name));
+        fileB.add(new Option(name, name));
+    }
+}
+
+// 查看单个执行序列
+async function inspect() {
+    if (!fileA.value) return;
+    summary.textContent = '加载中...';
+    const response = await fetch('/api/exec/inspect?file=' + encodeURIComponent(fileA.value));
+    const data = await response.json();
+    if (!response.ok) {
+        summary.textContent = '❌ ' + data.error;
+        result.innerHTML = '';
+        return;
+    }
+
+    const meta = data.meta;
+    summary.textContent = `乐器: ${meta.instrument}, BPM: ${meta.bpm}, 版本: ${meta.version}, ` +
+        `事件数: ${meta.total_events}, 总时长: ${(meta.total_duration_ms / 1000).toFixed(2)}s` +
+        (meta.time_signature ? `, 拍号: ${meta.time_signature}, 小节数: ${meta.total_bars}` : '');
+
+    const fingers = (row, hand) => {
+        if (!row.has_frames) return '';
+        const list = row[hand] || [];
+        return list.length ? list.join('+') : '(松开)';
+    };
+    const barBeat = (row) => row.bar ? `${row.bar}:${Math.round(row.beat * 100) / 100}` : '-';
+    let html = '<table class="inspect-table"><tr><th>#</th><th>时间(ms)</th><th>时长(ms)</th><th>小节:拍</th>' +
+        '<th>事件</th><th>气泵</th><th>左手</th><th>右手</th><th>左手帧</th><th>右手帧</th></tr>';
+    for (const row of data.rows) {
+        html += `<tr class="${row.m ? 'marker' : ''}">` +
+            `<td class="num">${row.index}</td>` +
+            `<td class="num">${row.t.toFixed(1)}</td>` +
+            `<td class="num">${row.d.toFixed(1)}</td>` +
+            `<td class="num">${barBeat(row)}</td>` +
+            `<td>${escapeHtml(row.note)}${row.m ? ' [' + escapeHtml(row.m) + ']' : ''}</td>` +
+            `<td>${escapeHtml(row.serial || '')}</td>` +
+            `<td>${escapeHtml(fingers(row, 'left'))}</td>` +
+            `<td>${escapeHtml(fingers(row, 'right'))}</td>` +
+            `<td class="bytes">${escapeHtml(row.left_bytes || '')}</td>` +
+            `<td class="bytes">${escapeHtml(row.right_bytes || '')}</td></tr>`;
+    }
+    result.innerHTML = html + '</table>';
+}
+
+// 对比两个执行序列
+async function diff() {
+    if (!fileA.value || !fileB.value) {
+        summary.textContent = '请选择要对比的两个执行序列';
+        return;
+    }
+    summary.textContent = '对比中...';
+    const url = '/api/exec/diff?a=' + encodeURIComponent(fileA.value) + '&b=' + encodeURIComponent(fileB.value);
+    const response = await fetch(url);
+    const data = await response.json();
+    if (!response.ok) {
+        summary.textContent = '❌ ' + data.error;
+        result.innerHTML = '';
+        return;
+    }
+
+    summary.textContent = `按时间对齐 ${data.matched} 个事件: 音符变化 ${data.notes}, 时间变化 ${data.timing}, 帧变化 ${data.frames}, ` +
+        `气泵命令变化 ${data.serial}, 新增 ${data.added}, 删除 ${data.removed}`;
+
+    let html = '';
+    if (data.meta_changes && data.meta_changes.length) {
+        html += '<p><strong>元数据差异:</strong> ' + data.meta_changes.map(escapeHtml).join('；') + '</p>';
+    }
+    html += '<table class="inspect-table"><tr><th>类型</th><th>A#</th><th>B#</th><th>小节</th><th>事件</th>' +
+        '<th>A时间(ms)</th><th>B时间(ms)</th><th>说明</th></tr>';
+    for (const e of data.entries || []) {
+        html += `<tr class="diff-${e.kind}"><td>${e.kind}</td>` +
+            `<td class="num">${e.index_a || '-'}</td><td class="num">${e.index_b || '-'}</td>` +
+            `<td class="num">${e.bar || '-'}</td>` +
+            `<td>${escapeHtml(e.note)}</td>` +
+            `<td class="num">${e.index_a ? e.t_a.toFixed(1) : '-'}</td>` +
+            `<td class="num">${e.index_b ? e.t_b.toFixed(1) : '-'}</td>` +
+            `<td>${escapeHtml(e.detail)}</td></tr>`;
+    }
+    result.innerHTML = html + '</table>';
+}
+
+document.getElementById('inspectBtn').addEventListener('click', inspect);
+document.getElementById('diffBtn').addEventListener('click', diff);
+loadExecFiles();
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
@@ -10,7 +12,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +31,14 @@ var staticFiles embed.FS
 type WebServer struct {
 	fileReader   *FileReader
 	musicScanner *MusicFileScanner
+
+	// 合奏预加载：协调者先预加载，再下发开始时刻
+	preloadMutex  sync.Mutex
+	preloaded     *ExecutionEngine
+	preloadedFile string
+
+	// 手动执行的手臂动作同一时刻只允许一个
+	armMutex sync.Mutex
 }
 
 // NewWebServer 创建新的Web服务器
@@ -76,10 +88,43 @@ func (ws *WebServer) StartWebServer() {
 	r.POST("/api/preprocess", ws.preprocessSequence)
 	r.GET("/api/exec/check", ws.checkExecFile)
 	r.POST("/api/exec/play", ws.playExecSequence)
+	r.GET("/api/exec/list", ws.listExecFiles)
+	r.GET("/api/exec/inspect", ws.inspectExecFile)
+	r.GET("/api/exec/diff", ws.diffExecFiles)
+
+	// 多机合奏API（成员端：预加载与定时开始；协调者端：统一开始、汇总状态）
+	r.POST("/api/exec/preload", ws.preloadExecSequence)
+	r.POST("/api/exec/start_at", ws.startExecSequenceAt)
+	r.POST("/api/ensemble/play", ws.playEnsemble)
+	r.GET("/api/ensemble/status", ws.getEnsembleStatus)
+	r.POST("/api/ensemble/stop", ws.stopEnsemble)
+	r.POST("/api/parts/compile", ws.compilePart)
+
+	// 时钟同步API（领队端应答时间交换，成员端查询同步状态）
+	r.GET("/api/clock", ws.getClock)
+	r.GET("/api/clock/status", ws.getClockStatus)
 
 	// 气泵调试API
 	r.POST("/api/pump/debug", ws.debugPumpCommand)
 
+	// 健康检查API（CAN桥接服务探测、发送统计、气泵与急停）
+	r.GET("/api/health", ws.getHealth)
+
+	// 急停API（触发后锁定，需显式解除）
+	r.GET("/api/estop", ws.getEStopStatus)
+	r.POST("/api/estop", ws.triggerEStop)
+	r.POST("/api/estop/clear", ws.clearEStop)
+
+	// 手臂与姿态API（配置与动作序列、手动执行动作序列、演奏前后姿态序列检查）
+	r.GET("/api/arms", ws.getArms)
+	r.POST("/api/arms/run", ws.runArmSequence)
+	r.GET("/api/posture", ws.getPosture)
+
+	// 演奏报告API（每个会话一份报告）
+	r.GET("/api/sessions", ws.listSessions)
+	r.GET("/api/sessions/compare", ws.compareSessions)
+	r.GET("/api/sessions/:id", ws.getSession)
+
 	// 配置管理API
 	r.GET("/api/config", ws.getConfig)
 	r.GET("/api/config/reload", ws.reloadConfig)
@@ -96,6 +141,9 @@ func (ws *WebServer) StartWebServer() {
 	r.GET("/", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.html", nil)
 	})
+	r.GET("/inspect", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "inspect.html", nil)
+	})
 
 	fmt.Println("🎵 萨克斯/唢呐演奏Web服务启动成功!")
 	fmt.Println("🌐 访问地址: http://localhost:1105")
@@ -139,7 +187,11 @@ func (ws *WebServer) getTimeline(c *gin.Context) {
 		return
 	}
 
-	timeline := ws.fileReader.LoadTimeline(fpath)
+	timeline, err := ws.fileReader.ReadTimeline(fpath)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// 提取BPM
 	bpm := 60.0
@@ -237,14 +289,11 @@ func (ws *WebServer) stopPlayback(c *gin.Context) {
 	fmt.Println("🛑 === 开始停止流程 ===")
 
 	playbackController.mutex.RLock()
-	isRunning := playbackController.isRunning
 	instrument := playbackController.instrument
 	cfg := playbackController.config
 	playbackController.mutex.RUnlock()
 
-	fmt.Printf("🔍 当前播放状态: isRunning=%v, instrument=%s\n", isRunning, instrument)
-
-	if !isRunning {
+	if !playbackController.Running() {
 		fmt.Println("ℹ️  没有正在运行的播放任务")
 		c.JSON(http.StatusOK, gin.H{"message": "演奏已停止"})
 		return
@@ -259,26 +308,14 @@ func (ws *WebServer) stopPlayback(c *gin.Context) {
 		fmt.Println("⚠️  气泵控制器为nil（可能是串口未连接）")
 	}
 
-	// 2. 发送停止信号并等待播放goroutine真正结束
-	fmt.Println("📤 步骤2: 发送停止信号并等待播放完全停止...")
-	select {
-	case playbackController.stopChan <- true:
-		fmt.Println("✅ 停止信号已发送")
-	default:
-		fmt.Println("⚠️  停止信号通道已满")
-	}
-
-	// 等待播放goroutine真正结束（最多等待3秒）
-	fmt.Println("⏳ 等待播放goroutine完全退出...")
-	select {
-	case <-playbackController.doneChan:
-		fmt.Println("✅ 播放goroutine已完全退出")
-	case <-time.After(3 * time.Second):
-		fmt.Println("⚠️  等待超时（3秒），强制继续")
-	}
+	// 2. 取消演奏会话并等待其完全退出（在途的帧发送随之取消）
+	fmt.Println("📤 步骤2: 取消演奏会话并等待退出...")
+	session := playbackController.Stop(ErrUserStopped)
 
-	// 3. 执行预备手势（松开手指）
-	if instrument != "" {
+	// 3. 执行预备手势（松开手指；会话退出前已下发收尾姿态时跳过）
+	if session != nil && session.engine.endsWithGesture() {
+		fmt.Println("🤲 步骤3: 会话已下发收尾姿态")
+	} else if instrument != "" {
 		fmt.Printf("🤲 步骤3: 执行预备手势（松开手指，乐器: %s）...\n", instrument)
 		readyController := NewReadyGestureController()
 		readyController.ExecuteReadyGesture(cfg, instrument)
@@ -287,14 +324,12 @@ func (ws *WebServer) stopPlayback(c *gin.Context) {
 		fmt.Println("⚠️  乐器类型为空，无法执行预备手势")
 	}
 
-	// 4. 更新状态
-	playbackController.mutex.Lock()
-	playbackController.isRunning = false
-	playbackController.status.IsPlaying = false
-	playbackController.mutex.Unlock()
-
 	fmt.Println("✅ === 停止流程完成，可以安全启动新播放 ===")
-	c.JSON(http.StatusOK, gin.H{"message": "演奏已停止"})
+	response := gin.H{"message": "演奏已停止"}
+	if session != nil {
+		response["session_id"] = session.ID
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // GetPlaybackStatus 获取演奏状态
@@ -303,9 +338,243 @@ func (ws *WebServer) getPlaybackStatus(c *gin.Context) {
 	status := playbackController.status
 	playbackController.mutex.RUnlock()
 
+	if guard := globalPumpGuard.Load(); guard != nil {
+		status.PumpGuard = guard.Status()
+	}
+	estop := globalEStop.Status()
+	status.EStop = &estop
+	canStats := sessionCanStats.Snapshot()
+	status.Can = &canStats
 	c.JSON(http.StatusOK, status)
 }
 
+// playbackStartErrorCode 启动演奏失败时的HTTP状态码
+func playbackStartErrorCode(err error) int {
+	switch {
+	case errors.Is(err, ErrPreflightFailed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrEmergencyStop):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidPosture):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// getHealth 健康检查：实时探测CAN桥接服务，并汇总CAN发送统计、气泵与急停状态
+// status: ok / degraded（桥接服务偏慢或有超时丢帧）/ down（桥接服务不可达、气泵未连接或急停锁定）
+func (ws *WebServer) getHealth(c *gin.Context) {
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	maxPingMS := cfg.CanHealth.MaxPingMS
+	if maxPingMS <= 0 {
+		maxPingMS = defaultMaxPingMS
+	}
+
+	canStats := globalCanStats.Snapshot()
+	estop := globalEStop.Status()
+	health := gin.H{
+		"dry_run": cfg.DryRun,
+		"can":     canStats,
+		"estop":   estop,
+		"playing": playbackController.Running(),
+		"pump":    gin.H{"connected": globalPumpController != nil},
+	}
+	if guard := globalPumpGuard.Load(); guard != nil {
+		health["pump_guard"] = guard.Status()
+	}
+
+	status := "ok"
+	var problems []string
+	if !cfg.DryRun {
+		ping := PingCanBridge(cfg.CanBridgeURL)
+		health["can_bridge"] = ping
+		health["can_batch"] = globalCanSender.BatchSupported(cfg.CanBridgeURL)
+		switch {
+		case !ping.Reachable:
+			status = "down"
+			problems = append(problems, fmt.Sprintf("CAN桥接服务不可达: %s", ping.Error))
+		case ping.LatencyMS > maxPingMS:
+			status = "degraded"
+			problems = append(problems, fmt.Sprintf("CAN桥接服务响应过慢: %.1fms", ping.LatencyMS))
+		}
+	}
+	if canStats.TimedOut > 0 && status == "ok" {
+		status = "degraded"
+		problems = append(problems, fmt.Sprintf("累计%d帧因超时丢失", canStats.TimedOut))
+	}
+	if globalPumpController == nil {
+		status = "down"
+		problems = append(problems, "气泵未连接")
+	}
+	if estop.Latched {
+		status = "down"
+		problems = append(problems, "急停已锁定")
+	}
+	health["status"] = status
+	health["problems"] = problems
+
+	code := http.StatusOK
+	if status == "down" {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, health)
+}
+
+// getEStopStatus 查询急停状态
+func (ws *WebServer) getEStopStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, globalEStop.Status())
+}
+
+// triggerEStop 触发急停（请求体可选：{"reason": "..."}）
+func (ws *WebServer) triggerEStop(c *gin.Context) {
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&request)
+	if request.Reason == "" {
+		request.Reason = "Web API"
+	}
+
+	status := globalEStop.Trigger("api", request.Reason)
+	c.JSON(http.StatusOK, gin.H{"message": "急停已触发", "estop": status})
+}
+
+// clearEStop 解除急停
+func (ws *WebServer) clearEStop(c *gin.Context) {
+	if err := globalEStop.Clear(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "estop": globalEStop.Status()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "急停已解除", "estop": globalEStop.Status()})
+}
+
+// getArms 查询手臂配置、编排设置与可用的动作序列
+func (ws *WebServer) getArms(c *gin.Context) {
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	sequences, err := ListArmSequences(cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	playbackController.mutex.RLock()
+	phase := playbackController.status.ArmPhase
+	playbackController.mutex.RUnlock()
+	c.JSON(http.StatusOK, gin.H{
+		"arms":       cfg.Arms,
+		"routine":    cfg.ArmRoutine.effective(),
+		"handsleft":  cfg.HandsLeft,
+		"handsright": cfg.HandsRight,
+		"sequences":  sequences,
+		"phase":      phase,
+	})
+}
+
+// runArmSequence 手动执行一个动作序列（如 hlsup/hlsdown），执行完成后返回；演奏中拒绝
+func (ws *WebServer) runArmSequence(c *gin.Context) {
+	var request struct {
+		Sequence string `json:"sequence"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.Sequence == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求参数"})
+		return
+	}
+	if playbackController.Running() {
+		c.JSON(http.StatusConflict, gin.H{"error": "正在演奏，不能手动执行手臂动作"})
+		return
+	}
+	if !ws.armMutex.TryLock() {
+		c.JSON(http.StatusConflict, gin.H{"error": "另一个手臂动作正在执行"})
+		return
+	}
+	defer ws.armMutex.Unlock()
+
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	seq, err := LoadArmSequence(cfg, request.Sequence)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := RunArmSequence(context.Background(), cfg, seq); err != nil {
+		code := http.StatusBadGateway
+		if errors.Is(err, ErrEmergencyStop) || globalEStop.Latched() {
+			code = http.StatusConflict
+		}
+		c.JSON(code, gin.H{"error": fmt.Sprintf("手臂动作失败: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "手臂动作完成", "sequence": seq.Name, "steps": len(seq.Steps)})
+}
+
+// getPosture 检查乐器的演奏前后姿态序列（?instrument=sks|sn，默认 sn），返回每一步与约束检查结果
+func (ws *WebServer) getPosture(c *gin.Context) {
+	instrument := c.DefaultQuery("instrument", "sn")
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	plans := gin.H{}
+	var problems []string
+	for _, phase := range []string{PostureBefore, PostureAfter} {
+		plan, err := PlanPosture(cfg, instrument, phase)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if plan != nil {
+			plans[phase] = plan
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"instrument": instrument,
+		"dry_run":    cfg.DryRun,
+		"plans":      plans,
+		"valid":      len(problems) == 0,
+		"problems":   problems,
+	})
+}
+
+// listSessions 列出演奏会话摘要（最新的在前，?limit=N 限制条数，默认50）
+func (ws *WebServer) listSessions(c *gin.Context) {
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("无效的limit: %s", v)})
+			return
+		}
+		limit = n
+	}
+
+	sessions, err := globalSessionStore.List(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "count": len(sessions)})
+}
+
+// getSession 获取演奏会话的完整报告
+func (ws *WebServer) getSession(c *gin.Context) {
+	report, err := globalSessionStore.Load(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// compareSessions 对比两次演奏（?a=会话ID&b=会话ID，结果为 b 相对 a 的变化）
+func (ws *WebServer) compareSessions(c *gin.Context) {
+	a, err := globalSessionStore.Load(c.Query("a"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("会话a: %v", err)})
+		return
+	}
+	b, err := globalSessionStore.Load(c.Query("b"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("会话b: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, CompareSessions(a, b))
+}
+
 // GetFingeringMap 获取指法映射
 func (ws *WebServer) getFingeringMap(c *gin.Context) {
 	instrument := c.Query("instrument") // 获取乐器类型参数
@@ -313,7 +582,11 @@ func (ws *WebServer) getFingeringMap(c *gin.Context) {
 		instrument = "sn" // 默认唢呐
 	}
 
-	fingeringMap := ws.fileReader.LoadFingeringMapByInstrument(instrument)
+	fingeringMap, err := ws.fileReader.ReadFingeringMapByInstrument(instrument)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	// 转换为前端友好的格式
 	var fingerings []gin.H
@@ -346,10 +619,18 @@ func (ws *WebServer) sendSingleFingering(c *gin.Context) {
 	if request.Instrument == "" {
 		request.Instrument = "sn"
 	}
+	if err := globalEStop.Check(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 
 	// 加载配置和指法映射
 	cfg := ws.fileReader.LoadConfig("config.yaml")
-	fingeringMap := ws.fileReader.LoadFingeringMapByInstrument(request.Instrument)
+	fingeringMap, err := ws.fileReader.ReadFingeringMapByInstrument(request.Instrument)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	fingering, exists := fingeringMap[request.Note]
 	if !exists {
@@ -374,10 +655,14 @@ func (ws *WebServer) sendSingleFingering(c *gin.Context) {
 // preprocessSequence 预处理音乐文件生成执行序列
 func (ws *WebServer) preprocessSequence(c *gin.Context) {
 	var request struct {
-		SourceFile    string  `json:"source_file"`
-		Instrument    string  `json:"instrument"`
-		BPM           float64 `json:"bpm"`
-		TonguingDelay int     `json:"tonguing_delay"`
+		SourceFile    string              `json:"source_file"`
+		Instrument    string              `json:"instrument"`
+		BPM           float64             `json:"bpm"`
+		TonguingDelay int                 `json:"tonguing_delay"`
+		FingerLeadMS  *int                `json:"finger_lead_ms"` // 换指提前量（毫秒，缺省使用配置文件）
+		SwitchDipMS   *int                `json:"switch_dip_ms"`  // 换指气泵降压时长（毫秒，缺省使用配置文件）
+		Part          string              `json:"part"`           // 多声部总谱中的声部名（单声部留空）
+		Expression    *ExpressionSettings `json:"expression"`     // 表情演奏设置（缺省使用配置文件）
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -385,38 +670,28 @@ func (ws *WebServer) preprocessSequence(c *gin.Context) {
 		return
 	}
 
-	// 确保exec目录存在
-	execDir := "exec"
-	if err := os.MkdirAll(execDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("创建exec目录失败: %v", err)})
-		return
-	}
-
-	// 生成输出文件名
-	baseFilename := filepath.Base(request.SourceFile)
-	baseFilename = baseFilename[:len(baseFilename)-5] // 移除.json
-	outputFilename := fmt.Sprintf("%s_%s_%.0f_%d.exec.json",
-		baseFilename, request.Instrument, request.BPM, request.TonguingDelay)
-	outputPath := filepath.Join(execDir, outputFilename)
-
-	// 加载配置和指法映射
 	cfg := ws.fileReader.LoadConfig("config.yaml")
-	fingeringMap := ws.fileReader.LoadFingeringMapByInstrument(request.Instrument)
-
-	// 获取BPM
-	bpm := request.BPM
-	if bpm <= 0 {
-		bpm = cfg.BPM
-		if bpm <= 0 {
-			bpm = 60
-		}
+	compileCache := NewCompileCache(cfg)
+	compileRequest := CompileRequest{
+		SourceFile:    request.SourceFile,
+		Part:          request.Part,
+		Instrument:    request.Instrument,
+		BPM:           request.BPM,
+		TonguingDelay: request.TonguingDelay,
+		FingerLeadMS:  request.FingerLeadMS,
+		SwitchDipMS:   request.SwitchDipMS,
+		Expression:    request.Expression,
+	}
+
+	// 生成输出文件名（按设置区分；预处理接口总是重新生成）
+	outputPath, err := compileCache.ExecPath(compileRequest)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("预处理失败: %v", err)})
+		return
 	}
-
-	// 创建预处理器
-	preprocessor := NewSequencePreprocessor(cfg, fingeringMap, request.Instrument, bpm, request.TonguingDelay)
-
-	// 生成执行序列
-	if err := preprocessor.GenerateExecutionSequence(request.SourceFile, outputPath); err != nil {
+	outputFilename := filepath.Base(outputPath)
+	compileRequest.OutputFile = outputPath
+	if err := compileCache.Compile(compileRequest); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("预处理失败: %v", err)})
 		return
 	}
@@ -429,12 +704,15 @@ func (ws *WebServer) preprocessSequence(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":      "预处理完成",
-		"exec_file":    outputFilename,
-		"exec_path":    outputPath,
-		"total_events": sequence.Meta.TotalEvents,
-		"duration_ms":  sequence.Meta.TotalDurationMS,
-		"duration_sec": sequence.Meta.TotalDurationMS / 1000.0,
+		"message":        "预处理完成",
+		"exec_file":      outputFilename,
+		"exec_path":      outputPath,
+		"total_events":   sequence.Meta.TotalEvents,
+		"duration_ms":    sequence.Meta.TotalDurationMS,
+		"duration_sec":   sequence.Meta.TotalDurationMS / 1000.0,
+		"finger_lead_ms": sequence.Meta.FingerLeadMS,
+		"switch_dip_ms":  sequence.Meta.SwitchDipMS,
+		"expression":     sequence.Meta.Expression,
 	})
 }
 
@@ -450,12 +728,31 @@ func (ws *WebServer) checkExecFile(c *gin.Context) {
 		return
 	}
 
-	// 生成预期的文件名
-	baseFilename := filepath.Base(sourceFile)
-	baseFilename = baseFilename[:len(baseFilename)-5]
-	execFilename := fmt.Sprintf("%s_%s_%s_%s.exec.json",
-		baseFilename, instrument, bpm, tonguingDelay)
-	execPath := filepath.Join("exec", execFilename)
+	bpmValue, err := strconv.ParseFloat(bpm, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bpm 无效"})
+		return
+	}
+	delayValue, err := strconv.Atoi(tonguingDelay)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tonguing_delay 无效"})
+		return
+	}
+
+	// 按当前配置生成预期的文件名
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	compileCache := NewCompileCache(cfg)
+	execPath, err := compileCache.ExecPath(CompileRequest{
+		SourceFile:    sourceFile,
+		Instrument:    instrument,
+		BPM:           bpmValue,
+		TonguingDelay: delayValue,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	execFilename := filepath.Base(execPath)
 
 	// 检查文件是否存在
 	if _, err := os.Stat(execPath); os.IsNotExist(err) {
@@ -476,20 +773,31 @@ func (ws *WebServer) checkExecFile(c *gin.Context) {
 		return
 	}
 
+	// 按编译缓存规则检查输入是否变化（播放时会自动重新编译）
+	_, staleReasons := compileCache.Check(RequestFromMeta(sequence.Meta, execPath))
+
 	c.JSON(http.StatusOK, gin.H{
-		"exists":       true,
-		"exec_file":    execFilename,
-		"exec_path":    execPath,
-		"total_events": sequence.Meta.TotalEvents,
-		"duration_ms":  sequence.Meta.TotalDurationMS,
-		"duration_sec": sequence.Meta.TotalDurationMS / 1000.0,
+		"exists":        true,
+		"exec_file":     execFilename,
+		"exec_path":     execPath,
+		"total_events":  sequence.Meta.TotalEvents,
+		"duration_ms":   sequence.Meta.TotalDurationMS,
+		"duration_sec":  sequence.Meta.TotalDurationMS / 1000.0,
+		"version":       sequence.Meta.Version,
+		"stale":         len(staleReasons) > 0,
+		"stale_reasons": staleReasons,
 	})
 }
 
 // playExecSequence 播放预计算的执行序列
+// 可选 from_bar/to_bar 按小节截取（排练），loop 为循环次数（-1表示直到停止）
 func (ws *WebServer) playExecSequence(c *gin.Context) {
 	var request struct {
 		ExecFile string `json:"exec_file"`
+		FromBar  int    `json:"from_bar"`
+		ToBar    int    `json:"to_bar"`
+		Loop     int    `json:"loop"`
+		Arms     *bool  `json:"arms"` // 是否走手臂编排（省略时使用 arm_routine.enabled）
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -506,58 +814,361 @@ func (ws *WebServer) playExecSequence(c *gin.Context) {
 		return
 	}
 
-	// 停止当前播放（如果有）
-	if playbackController.isRunning {
-		fmt.Println("⚠️  检测到正在播放，先停止旧的播放任务...")
-		select {
-		case playbackController.stopChan <- true:
-			fmt.Println("✅ 停止信号已发送")
-		default:
-			fmt.Println("⚠️  停止信号通道已满")
-		}
+	// 加载配置
+	cfg := ws.fileReader.LoadConfig("config.yaml")
 
-		// 等待旧播放完全停止
-		fmt.Println("⏳ 等待旧播放完全停止...")
-		select {
-		case <-playbackController.doneChan:
-			fmt.Println("✅ 旧播放已完全停止")
-		case <-time.After(2 * time.Second):
-			fmt.Println("⚠️  等待超时（2秒），强制继续")
+	// 输入（时间轴/指法/配置）变化时自动重新编译
+	compileResult, err := NewCompileCache(cfg).EnsureExecFile(execPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("加载执行序列失败: %v", err)})
+		return
+	}
+
+	// 创建执行引擎（已过期时使用当前设置对应的执行文件）
+	engine, err := NewExecutionEngine(compileResult.ExecFile, cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("创建执行引擎失败: %v", err)})
+		return
+	}
+	if err := engine.SetRange(request.FromBar, request.ToBar, request.Loop); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	withArms := cfg.ArmRoutine.Enabled
+	if request.Arms != nil {
+		withArms = *request.Arms
+	}
+	if withArms {
+		arms, err := NewArmRoutine(cfg)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("手臂编排不可用: %v", err)})
+			return
 		}
+		engine.SetArmRoutine(arms)
+	}
+	//检测气泵是否连接
+	if globalPumpController == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "气泵控制器未初始化"})
+		return
+	}
 
-		// 短暂延迟确保资源释放
-		time.Sleep(100 * time.Millisecond)
+	// 异步开始播放（正在进行的演奏先被停止并等待退出）
+	session, err := engine.PlayAsync(context.Background())
+	if err != nil {
+		c.JSON(playbackStartErrorCode(err), gin.H{"error": fmt.Sprintf("启动播放失败: %v", err)})
+		return
 	}
 
-	// 加载配置
-	cfg := ws.fileReader.LoadConfig("config.yaml")
+	c.JSON(http.StatusOK, gin.H{
+		"message":           "开始播放执行序列",
+		"session_id":        session.ID,
+		"exec_file":         filepath.Base(compileResult.ExecFile),
+		"total_events":      engine.sequence.Meta.TotalEvents,
+		"duration_sec":      engine.sequence.Meta.TotalDurationMS / 1000.0,
+		"from_bar":          engine.fromBar,
+		"to_bar":            engine.toBar,
+		"loop":              engine.loop,
+		"recompiled":        compileResult.Recompiled,
+		"recompile_reasons": compileResult.Reasons,
+		"arms":              withArms,
+	})
+}
+
+// preloadExecSequence 预加载执行序列（合奏成员端）
+// 提前完成加载与按需重新编译，收到开始时刻后无需再读文件
+func (ws *WebServer) preloadExecSequence(c *gin.Context) {
+	var request struct {
+		ExecFile string `json:"exec_file"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.ExecFile == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求参数"})
+		return
+	}
 
-	// 创建执行引擎
-	engine, err := NewExecutionEngine(execPath, cfg)
+	execPath := filepath.Join("exec", filepath.Base(request.ExecFile))
+	if _, err := os.Stat(execPath); os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("执行序列文件不存在: %s", request.ExecFile)})
+		return
+	}
+
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	compileResult, err := NewCompileCache(cfg).EnsureExecFile(execPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("加载执行序列失败: %v", err)})
+		return
+	}
+	engine, err := NewExecutionEngine(compileResult.ExecFile, cfg)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("创建执行引擎失败: %v", err)})
 		return
 	}
-	//检测气泵是否连接
+
+	ws.preloadMutex.Lock()
+	ws.preloaded = engine
+	ws.preloadedFile = request.ExecFile
+	ws.preloadMutex.Unlock()
+
+	fmt.Printf("📦 已预加载执行序列: %s\n", compileResult.ExecFile)
+	c.JSON(http.StatusOK, gin.H{
+		"ready":             true,
+		"exec_file":         request.ExecFile,
+		"total_events":      engine.sequence.Meta.TotalEvents,
+		"duration_sec":      engine.sequence.Meta.TotalDurationMS / 1000.0,
+		"from_bar":          engine.fromBar,
+		"to_bar":            engine.toBar,
+		"loop":              engine.loop,
+		"recompiled":        compileResult.Recompiled,
+		"recompile_reasons": compileResult.Reasons,
+	})
+}
+
+// startExecSequenceAt 在指定时刻（领队时间）开始播放已预加载的执行序列（合奏成员端）
+func (ws *WebServer) startExecSequenceAt(c *gin.Context) {
+	var request struct {
+		ExecFile  string `json:"exec_file"`
+		StartAtMS int64  `json:"start_at_ms"` // Unix毫秒
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.StartAtMS <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求参数"})
+		return
+	}
+
+	// 开始时刻为领队时间
+	startAt := time.UnixMilli(request.StartAtMS)
+	if lead := startAt.Sub(LeaderNow()); lead <= 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("开始时刻已过 %v", (-lead).Round(time.Millisecond))})
+		return
+	}
+
+	ws.preloadMutex.Lock()
+	engine := ws.preloaded
+	if engine == nil || ws.preloadedFile != request.ExecFile {
+		ws.preloadMutex.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("执行序列 %s 未预加载", request.ExecFile)})
+		return
+	}
+	ws.preloaded = nil // 预加载的引擎只使用一次
+	ws.preloadMutex.Unlock()
+
 	if globalPumpController == nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "气泵控制器未初始化"})
 		return
 	}
 
-	// 异步开始播放
-	if err := engine.PlayAsync(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("启动播放失败: %v", err)})
+	engine.SetStartAt(startAt)
+	session, err := engine.PlayAsync(context.Background())
+	if err != nil {
+		c.JSON(playbackStartErrorCode(err), gin.H{"error": fmt.Sprintf("启动播放失败: %v", err)})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":      "开始播放执行序列",
-		"exec_file":    request.ExecFile,
-		"total_events": engine.sequence.Meta.TotalEvents,
-		"duration_sec": engine.sequence.Meta.TotalDurationMS / 1000.0,
+		"message":     "已安排定时开始",
+		"session_id":  session.ID,
+		"exec_file":   request.ExecFile,
+		"start_at_ms": request.StartAtMS,
+		"lead_ms":     startAt.Sub(LeaderNow()).Milliseconds(),
 	})
 }
 
+// getClock 时间交换（NTP风格）：返回收到请求与发送响应的时刻
+func (ws *WebServer) getClock(c *gin.Context) {
+	receiveNS := time.Now().UnixNano()
+	c.JSON(http.StatusOK, ClockResponse{ReceiveNS: receiveNS, SendNS: time.Now().UnixNano()})
+}
+
+// getClockStatus 获取本机相对领队的时钟同步状态
+func (ws *WebServer) getClockStatus(c *gin.Context) {
+	if globalClockSync == nil {
+		c.JSON(http.StatusOK, gin.H{"leader": "", "is_leader": true, "synced": true})
+		return
+	}
+	c.JSON(http.StatusOK, globalClockSync.Status())
+}
+
+// compilePart 用本机的指法映射与力度配置编译总谱中的一个声部（合奏成员端）
+// 总谱保存到本机 trsmusic 目录，执行文件按编译缓存规则复用
+func (ws *WebServer) compilePart(c *gin.Context) {
+	var request struct {
+		ScoreName     string              `json:"score_name"`
+		Score         json.RawMessage     `json:"score"`
+		Part          string              `json:"part"`
+		Instrument    string              `json:"instrument"`
+		BPM           float64             `json:"bpm"`
+		TonguingDelay int                 `json:"tonguing_delay"`
+		Expression    *ExpressionSettings `json:"expression"` // 协调者统一的表情设置（缺省使用本机配置）
+		Breath        *BreathConfig       `json:"breath"`     // 协调者统一的换气设置（缺省使用本机配置）
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.ScoreName == "" || request.Part == "" || len(request.Score) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求参数"})
+		return
+	}
+	if request.Instrument != "sks" && request.Instrument != "sn" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("未知的乐器类型: %s", request.Instrument)})
+		return
+	}
+
+	// 先解析并检查声部，避免预处理器读取无效文件
+	var score TimelineFile
+	if err := json.Unmarshal(request.Score, &score); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("总谱格式错误: %v", err)})
+		return
+	}
+	if _, err := score.PartTimeline(request.Part); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 内容相同时不改写文件
+	scorePath := filepath.Join("trsmusic", filepath.Base(request.ScoreName))
+	if existing, err := os.ReadFile(scorePath); err != nil || string(existing) != string(request.Score) {
+		if err := os.MkdirAll("trsmusic", 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("创建目录失败: %v", err)})
+			return
+		}
+		if err := os.WriteFile(scorePath, request.Score, 0644); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("保存总谱失败: %v", err)})
+			return
+		}
+	}
+
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	result, err := NewCompileCache(cfg).Ensure(CompileRequest{
+		SourceFile:    scorePath,
+		Part:          request.Part,
+		Instrument:    request.Instrument,
+		BPM:           request.BPM,
+		TonguingDelay: request.TonguingDelay,
+		Expression:    request.Expression,
+		Breath:        request.Breath,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("编译声部失败: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, PartCompileResult{
+		ExecFile:        filepath.Base(result.ExecFile),
+		Recompiled:      result.Recompiled,
+		Reasons:         result.Reasons,
+		TotalEvents:     result.Sequence.Meta.TotalEvents,
+		TotalDurationMS: result.Sequence.Meta.TotalDurationMS,
+	})
+}
+
+// ensembleCoordinator 按当前配置创建合奏协调者
+func (ws *WebServer) ensembleCoordinator() *EnsembleCoordinator {
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	return NewEnsembleCoordinator(cfg, cfg.Ensemble.Peers)
+}
+
+// playEnsemble 作为协调者开始合奏
+// 指定 score_file 时按 ensemble.assignments 分发声部；否则成员来自配置文件 ensemble.peers
+func (ws *WebServer) playEnsemble(c *gin.Context) {
+	var request struct {
+		ExecFile      string  `json:"exec_file"`      // 成员未单独配置执行文件时使用
+		ScoreFile     string  `json:"score_file"`     // 多声部总谱（trsmusic目录下的文件名）
+		BPM           float64 `json:"bpm"`            // 总谱速度（0表示使用总谱元数据）
+		TonguingDelay int     `json:"tonguing_delay"` // 吐音延迟
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求参数"})
+		return
+	}
+
+	coordinator := ws.ensembleCoordinator()
+	if request.ScoreFile != "" {
+		cfg := ws.fileReader.LoadConfig("config.yaml")
+		scorePath := filepath.Join("trsmusic", filepath.Base(request.ScoreFile))
+		if _, err := coordinator.DistributeParts(scorePath, cfg.Ensemble.Assignments, request.BPM, request.TonguingDelay); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	startAt, statuses, err := coordinator.Start(request.ExecFile)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "peers": statuses})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "合奏已安排",
+		"start_at_ms": startAt.UnixMilli(),
+		"peers":       statuses,
+	})
+}
+
+// getEnsembleStatus 汇总合奏成员状态
+func (ws *WebServer) getEnsembleStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"peers": ws.ensembleCoordinator().Status()})
+}
+
+// stopEnsemble 停止所有合奏成员
+func (ws *WebServer) stopEnsemble(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"peers": ws.ensembleCoordinator().Stop()})
+}
+
+// listExecFiles 列出exec目录下的执行序列文件
+func (ws *WebServer) listExecFiles(c *gin.Context) {
+	entries, err := os.ReadDir("exec")
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("读取exec目录失败: %v", err)})
+		return
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasSuffix(name, ".exec.json") || strings.HasSuffix(name, ExecBinaryExt)) {
+			files = append(files, name)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"files": files})
+}
+
+// inspectExecFile 以表格形式查看执行序列（解码各手按下的手指）
+func (ws *WebServer) inspectExecFile(c *gin.Context) {
+	execFile := c.Query("file")
+	if execFile == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少file参数"})
+		return
+	}
+
+	sequence, err := loadExecutionSequence(filepath.Join("exec", filepath.Base(execFile)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("加载执行序列失败: %v", err)})
+		return
+	}
+
+	cfg := ws.fileReader.LoadConfig("config.yaml")
+	c.JSON(http.StatusOK, gin.H{
+		"meta": sequence.Meta,
+		"rows": NewExecInspector(cfg).Inspect(sequence),
+	})
+}
+
+// diffExecFiles 对比两个执行序列
+func (ws *WebServer) diffExecFiles(c *gin.Context) {
+	fileA, fileB := c.Query("a"), c.Query("b")
+	if fileA == "" || fileB == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少a或b参数"})
+		return
+	}
+
+	sequenceA, err := loadExecutionSequence(filepath.Join("exec", filepath.Base(fileA)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("加载 %s 失败: %v", fileA, err)})
+		return
+	}
+	sequenceB, err := loadExecutionSequence(filepath.Join("exec", filepath.Base(fileB)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("加载 %s 失败: %v", fileB, err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, DiffExecutionSequences(sequenceA, sequenceB))
+}
+
 // loadTemplates 加载嵌入的模板文件
 func (ws *WebServer) loadTemplates(templatesFS fs.FS) *template.Template {
 	tmpl := template.New("")